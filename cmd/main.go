@@ -1,7 +1,24 @@
 package main
 
-import "link-availability-checker/internal/core"
+import (
+	"os"
+
+	"link-availability-checker/internal/core"
+)
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "worker":
+			core.LoadWorker().Run()
+			return
+		case "probe":
+			core.LoadProbe().Run()
+			return
+		case "migrate":
+			core.LoadMigration().Run()
+			return
+		}
+	}
 	core.Load().Run()
 }
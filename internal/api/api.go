@@ -16,6 +16,7 @@ import (
 	"go.uber.org/fx"
 
 	"link-availability-checker/internal/api/controllers"
+	"link-availability-checker/internal/api/middlewares"
 	"link-availability-checker/internal/config"
 	"link-availability-checker/internal/logger"
 	"link-availability-checker/internal/services"
@@ -30,18 +31,25 @@ func NewEngine() *gin.Engine {
 	engine.Use(
 		logger.CustomGinLogger(io.MultiWriter(os.Stdout, logger.GetLogFile())),
 		gin.RecoveryWithWriter(io.MultiWriter(os.Stdout, logger.GetLogFile())),
+		middlewares.Metrics(),
+		middlewares.Tracing(),
 	)
 	_ = engine.SetTrustedProxies(nil) // No error expected since no proxy addresses were passed
 
 	return engine
 }
 
-func RegisterRoutes(sc *controllers.SystemController, lc *controllers.LinkController) {
+func RegisterRoutes(sc *controllers.SystemController, lc *controllers.LinkController, mc *controllers.MonitoringController, wc *controllers.WorkerController, pc *controllers.ProbeController, mtc *controllers.MetricsController, hc *controllers.HealthController) {
 	sc.RegisterRoutes()
 	lc.RegisterRoutes()
+	mc.RegisterRoutes()
+	wc.RegisterRoutes()
+	pc.RegisterRoutes()
+	mtc.RegisterRoutes()
+	hc.RegisterRoutes()
 }
 
-func Run(lc fx.Lifecycle, engine *gin.Engine, svc services.LinkService) {
+func Run(lc fx.Lifecycle, engine *gin.Engine, svc services.LinkService, sched services.SchedulerService, hs services.HealthService) {
 	addr := "0.0.0.0:" + viper.GetString(config.ApiPort)
 	srv := &http.Server{
 		Addr:    addr,
@@ -66,7 +74,18 @@ func Run(lc fx.Lifecycle, engine *gin.Engine, svc services.LinkService) {
 		},
 		OnStop: func(ctx context.Context) error {
 			log.Println("[FX] Shutdown signal received.")
+			hs.BeginShutdown()
+			if delay := viper.GetDuration(config.HealthDrainDelay); delay > 0 {
+				log.Printf("[FX] Waiting %s for load balancers to notice the service is not ready...", delay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+				}
+			}
 			//<-queueDone // Was a bad idea
+			if err := sched.Shutdown(ctx); err != nil { // No new runs while the queue is draining
+				log.Printf("Scheduler shutdown error: %v", err)
+			}
 			if err := svc.Shutdown(ctx); err != nil {
 				log.Printf("Service shutdown error: %v", err)
 			}
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/services"
+)
+
+type HealthController struct {
+	engine        *gin.Engine
+	HealthService services.HealthService
+}
+
+func NewHealthController(e *gin.Engine, hs services.HealthService) *HealthController {
+	return &HealthController{engine: e, HealthService: hs}
+}
+
+// RegisterRoutes exposes probes outside of API base path and without password, they are meant for load balancers
+func (ctrl *HealthController) RegisterRoutes() {
+	ctrl.engine.GET("/healthz", ctrl.Liveness)
+	ctrl.engine.GET("/readyz", ctrl.Readiness)
+}
+
+// Liveness only tells that the process serves requests, it stays ok while draining so that it isn't killed early
+func (ctrl *HealthController) Liveness(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, apiModels.HealthResponse{Status: "ok"})
+}
+
+// Readiness responds 503 if the service shouldn't get traffic, deep=true adds resolver and disk space checks
+func (ctrl *HealthController) Readiness(ctx *gin.Context) {
+	r := ctrl.HealthService.Readiness(ctx.Request.Context(), ctx.Query("deep") == "true")
+
+	resp := apiModels.ReadinessResponse{Status: "ready", Checks: make([]apiModels.HealthCheck, len(r.Checks))}
+	for i, c := range r.Checks {
+		resp.Checks[i] = apiModels.HealthCheck{Name: c.Name, Status: "ok"}
+		if c.Err != nil {
+			resp.Checks[i].Status = "fail"
+			resp.Checks[i].Error = c.Err.Error()
+		}
+	}
+
+	if !r.Ready {
+		resp.Status = "not ready"
+		ctx.JSON(http.StatusServiceUnavailable, resp)
+		return
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
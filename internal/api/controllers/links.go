@@ -1,37 +1,58 @@
 package controllers
 
 import (
+	"context"
 	"errors"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
 
+	"link-availability-checker/internal/api/middlewares"
 	apiModels "link-availability-checker/internal/api/models"
 	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
 	"link-availability-checker/internal/services"
+	"link-availability-checker/internal/storage"
 	"link-availability-checker/internal/utils/files"
-	"link-availability-checker/pkg/filestore"
 )
 
 type LinkController struct {
-	engine      *gin.Engine
-	LinkService services.LinkService
+	engine          *gin.Engine
+	LinkService     services.LinkService
+	WebhookService  services.WebhookService
+	HistoryService  services.HistoryService
+	IncidentService services.IncidentService
 }
 
-func NewLinkController(engine *gin.Engine, ls services.LinkService) *LinkController {
+func NewLinkController(engine *gin.Engine, ls services.LinkService, ws services.WebhookService, hs services.HistoryService, is services.IncidentService) *LinkController {
 	return &LinkController{
-		engine:      engine,
-		LinkService: ls,
+		engine:          engine,
+		LinkService:     ls,
+		WebhookService:  ws,
+		HistoryService:  hs,
+		IncidentService: is,
 	}
 }
 
 func (ctrl *LinkController) RegisterRoutes() {
 	basePath := ctrl.engine.Group(viper.GetString(config.ApiBasePath))
-	linkRoutes := basePath.Group("/links")
+	linkRoutes := basePath.Group("/links").Use(middlewares.IdentifyClient(), middlewares.RateLimit())
 	{
 		linkRoutes.POST("/check", ctrl.CheckLinksInSet)
 		linkRoutes.POST("/get_report", ctrl.GetLinkSetAsPDF)
+		linkRoutes.GET("/queue", ctrl.GetQueueStats)
+		linkRoutes.GET("/jobs/:id", ctrl.GetJob)
+		linkRoutes.DELETE("/jobs/:id", ctrl.CancelJob)
+		linkRoutes.GET("/jobs/:id/events", ctrl.StreamJobEvents)
+		linkRoutes.DELETE("/sets/:num", middlewares.AskPassword(), ctrl.DeleteLinkSet)
+		linkRoutes.GET("/sets/:num/deliveries", ctrl.GetDeliveries)
+		linkRoutes.GET("/domains/:domain/uptime", ctrl.GetDomainUptime)
+		linkRoutes.GET("/incidents", ctrl.GetIncidents)
 	}
 }
 
@@ -41,23 +62,203 @@ func (ctrl *LinkController) CheckLinksInSet(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid request payload"})
 		return
 	}
+	req.IdempotencyKey = ctx.GetHeader(IdempotencyKeyHeader)
 
-	set, err := ctrl.LinkService.CheckLinkSet(&req)
-	if err != nil {
-		if errors.Is(err, services.ErrServiceStopping) {
-			ctx.JSON(http.StatusServiceUnavailable, apiModels.Error{Error: "Service is restarting; task queued, fetch result later"})
+	if req.CallbackURL != "" {
+		err := services.CheckCallbackURL(ctx.Request.Context(), req.CallbackURL)
+		if errors.Is(err, services.ErrCallbacksDisabled) {
+			ctx.JSON(http.StatusNotImplemented, apiModels.Error{Error: "Callbacks are disabled on this server"})
 			return
 		}
-		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to process link set"})
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid callback URL: " + err.Error()})
+			return
+		}
+	}
+
+	// Retries with the same Idempotency-Key don't create new checks, so only new requests take domain quota
+	client := middlewares.GetClient(ctx)
+	if !ctrl.LinkService.HasIdempotencyKey(client.ID, req.IdempotencyKey) && !middlewares.TakeDomains(ctx, len(req.Links)) {
 		return
 	}
 
+	if req.Async {
+		job, err := ctrl.LinkService.SubmitLinkSet(ctx.Request.Context(), &req, client)
+		if err != nil {
+			ctrl.respondSubmitError(ctx, job, err)
+			return
+		}
+		setReplayedHeader(ctx, job)
+		ctx.JSON(http.StatusAccepted, convertJob(job))
+		return
+	}
+
+	job, err := ctrl.LinkService.CheckLinkSet(ctx.Request.Context(), &req, client)
+	if err != nil {
+		ctrl.respondSubmitError(ctx, job, err)
+		return
+	}
+	setReplayedHeader(ctx, job)
+
 	ctx.JSON(http.StatusOK, apiModels.CheckLinkSetResponse{
-		Links:    set.ConvertLinksToStrMap(),
-		LinksNum: set.Number,
+		Links:    job.Set.ConvertLinksToStrMap(),
+		Verdicts: convertVerdicts(job.Set),
+		LinksNum: job.Set.Number,
+		JobID:    job.ID,
+		Canceled: job.Set.Canceled,
 	})
 }
 
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotencyReplayedHeader = "Idempotent-Replayed" // Set to "true" when response is for an earlier request
+)
+
+func setReplayedHeader(ctx *gin.Context, job services.Job) {
+	if job.Replayed {
+		ctx.Header(IdempotencyReplayedHeader, "true")
+	}
+}
+
+func (ctrl *LinkController) respondSubmitError(ctx *gin.Context, job services.Job, err error) {
+	switch {
+	case errors.Is(err, services.ErrIdempotencyConflict):
+		ctx.JSON(http.StatusConflict, apiModels.Error{Error: "Idempotency-Key was already used with a different request"})
+	case errors.Is(err, services.ErrServiceStopping):
+		ctx.JSON(http.StatusServiceUnavailable, apiModels.JobError{Error: "Service is restarting; task queued, fetch result later", JobID: job.ID})
+	case errors.Is(err, services.ErrQueueFull):
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(viper.GetDuration(config.QueueRetryAfter).Seconds()))))
+		ctx.JSON(http.StatusTooManyRequests, apiModels.Error{Error: "Queue is full, retry later"})
+	case errors.Is(err, context.Canceled):
+		// Client is gone, nobody to respond to
+	default:
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to process link set"})
+	}
+}
+
+func (ctrl *LinkController) GetJob(ctx *gin.Context) {
+	job, ok := ctrl.ownJob(ctx)
+	if !ok {
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Job not found"})
+		return
+	}
+	ctx.JSON(http.StatusOK, convertJob(job))
+}
+
+// ownJob returns the job if it was submitted by the calling client, other clients' jobs are only reachable with the
+// password and look like missing ones otherwise
+func (ctrl *LinkController) ownJob(ctx *gin.Context) (services.Job, bool) {
+	job, err := ctrl.LinkService.GetJob(ctx.Param("id"))
+	if err != nil || job.Client != middlewares.GetClient(ctx).ID && !middlewares.HasPassword(ctx) {
+		return services.Job{}, false
+	}
+	return job, true
+}
+
+func (ctrl *LinkController) CancelJob(ctx *gin.Context) {
+	if _, ok := ctrl.ownJob(ctx); !ok {
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Job not found"})
+		return
+	}
+
+	job, err := ctrl.LinkService.CancelJob(ctx.Param("id"))
+	if err != nil {
+		if errors.Is(err, services.ErrJobFinished) {
+			ctx.JSON(http.StatusConflict, apiModels.Error{Error: "Job is already finished"})
+		} else {
+			ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Job not found"})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, convertJob(job))
+}
+
+// StreamJobEvents sends Server-Sent Events: "link" for every checked link (including ones checked before subscribing)
+// and final "done" with set number
+func (ctrl *LinkController) StreamJobEvents(ctx *gin.Context) {
+	if _, ok := ctrl.ownJob(ctx); !ok {
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Job not found"})
+		return
+	}
+
+	past, events, unsubscribe, err := ctrl.LinkService.SubscribeJob(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Job not found"})
+		return
+	}
+	defer unsubscribe()
+
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no") // Disable proxy buffering
+
+	for _, e := range past {
+		sendJobEvent(ctx, e)
+	}
+	ctx.Writer.Flush()
+
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			sendJobEvent(ctx, e)
+			return e.Type != services.JobEventDone
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+func sendJobEvent(ctx *gin.Context, e services.JobEvent) {
+	switch e.Type {
+	case services.JobEventLink:
+		ctx.SSEvent(string(e.Type), apiModels.LinkEvent{Index: e.Index, Domain: e.Link.Domain, Status: e.Link.StatusString()})
+	case services.JobEventDone:
+		ctx.SSEvent(string(e.Type), apiModels.JobDoneEvent{State: string(e.State), LinksNum: e.Number})
+	}
+}
+
+func convertJob(job services.Job) apiModels.JobResponse {
+	resp := apiModels.JobResponse{
+		JobID:     job.ID,
+		State:     string(job.State),
+		Priority:  job.Priority.String(),
+		LinksNum:  job.Number,
+		Total:     job.Total,
+		Checked:   job.Checked,
+		CreatedAt: job.CreatedAt,
+		Worker:    job.Worker,
+	}
+	if !job.FinishedAt.IsZero() {
+		resp.FinishedAt = &job.FinishedAt
+	}
+	if job.Set != nil {
+		resp.Links = job.Set.ConvertLinksToStrMap()
+		resp.Verdicts = convertVerdicts(job.Set)
+	}
+	return resp
+}
+
+// convertVerdicts returns verdicts of vantage points by domain, nil if the set was checked without probe agents
+func convertVerdicts(set *models.Set) map[string][]apiModels.Verdict {
+	var result map[string][]apiModels.Verdict
+	for _, link := range set.Links {
+		if len(link.Verdicts) == 0 {
+			continue
+		}
+		if result == nil {
+			result = make(map[string][]apiModels.Verdict)
+		}
+		verdicts := make([]apiModels.Verdict, len(link.Verdicts))
+		for i, v := range link.Verdicts {
+			verdicts[i] = apiModels.Verdict{Agent: v.Agent, Location: v.Location, Status: models.ConvertStatusToString(v.Status), Reason: v.Reason}
+		}
+		result[link.Domain] = verdicts
+	}
+	return result
+}
+
 func (ctrl *LinkController) GetLinkSetAsPDF(ctx *gin.Context) {
 	var req apiModels.GetLinkSetRequest
 	if err := ctx.ShouldBindJSON(&req); err != nil {
@@ -67,7 +268,7 @@ func (ctrl *LinkController) GetLinkSetAsPDF(ctx *gin.Context) {
 
 	filePath, err := ctrl.LinkService.GetLinkSetAsPDF(ctx.Request.Context(), req.LinksList)
 	if err != nil {
-		if errors.Is(err, filestore.ErrSetNotFound) {
+		if errors.Is(err, storage.ErrSetNotFound) {
 			ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Requested set not found"})
 		} else {
 			ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to generate PDF"})
@@ -79,3 +280,195 @@ func (ctrl *LinkController) GetLinkSetAsPDF(ctx *gin.Context) {
 
 	files.Delete(filePath)
 }
+
+// GetQueueStats shows the caller only its own entries among per-client stats, all clients are shown with the password
+func (ctrl *LinkController) GetQueueStats(ctx *gin.Context) {
+	stats := ctrl.LinkService.QueueStats()
+	everyone, self := middlewares.HasPassword(ctx), middlewares.GetClient(ctx).ID
+
+	levels := make([]apiModels.QueueLevelStats, len(stats.Levels))
+	for i, level := range stats.Levels {
+		clients := make([]apiModels.QueueClientStats, 0, len(level.Clients))
+		for _, c := range level.Clients {
+			if everyone || c.ID == self {
+				clients = append(clients, apiModels.QueueClientStats{ID: c.ID, Weight: c.Weight, Depth: c.Depth, Dequeued: c.Dequeued})
+			}
+		}
+		levels[i] = apiModels.QueueLevelStats{
+			Priority:    level.Priority.String(),
+			Depth:       level.Depth,
+			Dequeued:    level.Dequeued,
+			VirtualTime: level.VirtualTime,
+			Clients:     clients,
+		}
+	}
+
+	ctx.JSON(http.StatusOK, apiModels.QueueStatsResponse{
+		Depth:    stats.Depth,
+		Capacity: stats.Capacity,
+		Spilled:  stats.Spilled,
+		Skipped:  stats.SpillSkipped,
+		InFlight: stats.InFlight,
+		Leased:   stats.Leased,
+		Workers:  stats.Workers,
+		Busy:     stats.Busy,
+		Levels:   levels,
+	})
+}
+
+func (ctrl *LinkController) DeleteLinkSet(ctx *gin.Context) {
+	num, err := strconv.Atoi(ctx.Param("num"))
+	if err != nil || num <= 0 {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid set number"})
+		return
+	}
+
+	err = ctrl.LinkService.DeleteLinkSet(num)
+	switch {
+	case err == nil:
+		ctx.Status(http.StatusNoContent)
+	case errors.Is(err, storage.ErrSetNotFound):
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Requested set not found"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to delete set"})
+	}
+}
+
+// GetDeliveries shows callback deliveries of the set made for the calling client, callback URLs may carry tokens, so
+// other clients' deliveries are only shown with the password
+func (ctrl *LinkController) GetDeliveries(ctx *gin.Context) {
+	num, err := strconv.Atoi(ctx.Param("num"))
+	if err != nil || num <= 0 {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid set number"})
+		return
+	}
+
+	client := middlewares.GetClient(ctx).ID
+	if middlewares.HasPassword(ctx) {
+		client = ""
+	}
+	deliveries, err := ctrl.WebhookService.GetDeliveries(num, client)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to read delivery log"})
+		return
+	}
+
+	resp := apiModels.DeliveriesResponse{LinksNum: num, Deliveries: make([]apiModels.Delivery, len(deliveries))}
+	for i, d := range deliveries {
+		resp.Deliveries[i] = apiModels.Delivery{
+			ID:         d.ID,
+			JobID:      d.JobID,
+			URL:        d.URL,
+			Attempt:    d.Attempt,
+			Time:       d.Time,
+			StatusCode: d.StatusCode,
+			Error:      d.Error,
+			Delivered:  d.Delivered,
+			GaveUp:     d.GaveUp,
+		}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// GetDomainUptime summarizes domain history between "from" and "to" (RFC 3339), by default over the last "window"
+// (24h if not set)
+func (ctrl *LinkController) GetDomainUptime(ctx *gin.Context) {
+	to, from := time.Now(), time.Time{}
+	var err error
+	if v := ctx.Query("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid \"to\" time"})
+			return
+		}
+	}
+	if v := ctx.Query("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid \"from\" time"})
+			return
+		}
+	} else {
+		window := 24 * time.Hour
+		if v = ctx.Query("window"); v != "" {
+			if window, err = time.ParseDuration(v); err != nil || window <= 0 {
+				ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid window"})
+				return
+			}
+		}
+		from = to.Add(-window)
+	}
+	if !from.Before(to) {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "\"from\" must be before \"to\""})
+		return
+	}
+
+	uptime, err := ctrl.HistoryService.GetUptime(ctx.Param("domain"), from, to)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to read domain history"})
+		return
+	}
+
+	resp := apiModels.UptimeResponse{
+		Domain:       uptime.Domain,
+		From:         uptime.From,
+		To:           uptime.To,
+		Checks:       uptime.Checks,
+		Available:    uptime.Available,
+		Uptime:       uptime.Percent,
+		Outages:      uptime.Outages,
+		AvgLatencyMs: milliseconds(uptime.AvgLatency),
+	}
+	if uptime.LastCheck != nil {
+		resp.LastCheck = &apiModels.CheckRecord{
+			Time:      uptime.LastCheck.Time,
+			Status:    models.ConvertStatusToString(uptime.LastCheck.Available),
+			Reason:    uptime.LastCheck.Reason,
+			LatencyMs: milliseconds(uptime.LastCheck.Latency),
+		}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// GetIncidents lists incidents, optionally filtered by "state" (open or closed), "domain" and "window" (only incidents
+// that were ongoing during the last window are returned)
+func (ctrl *LinkController) GetIncidents(ctx *gin.Context) {
+	filter := services.IncidentFilter{Domain: ctx.Query("domain"), State: ctx.Query("state")}
+	if filter.State != "" && filter.State != "open" && filter.State != "closed" {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid state"})
+		return
+	}
+	if v := ctx.Query("window"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid window"})
+			return
+		}
+		filter.Since = time.Now().Add(-window)
+	}
+
+	incidents, err := ctrl.IncidentService.GetIncidents(filter)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to read incidents"})
+		return
+	}
+
+	now := time.Now()
+	resp := make([]apiModels.Incident, len(incidents))
+	for i, inc := range incidents {
+		resp[i] = apiModels.Incident{
+			ID:              inc.ID,
+			Domain:          inc.Domain,
+			Open:            inc.Open(),
+			Start:           inc.Start,
+			End:             inc.End,
+			DurationSeconds: inc.Duration(now).Seconds(),
+			FirstReason:     inc.FirstReason,
+			LastReason:      inc.LastReason,
+			Checks:          inc.Checks,
+		}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,24 @@
+package controllers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/api/middlewares"
+	"link-availability-checker/internal/config"
+)
+
+type MetricsController struct {
+	engine *gin.Engine
+}
+
+func NewMetricsController(e *gin.Engine) *MetricsController { return &MetricsController{engine: e} }
+
+// RegisterRoutes exposes metrics outside of API base path, where Prometheus looks for them by default
+func (ctrl *MetricsController) RegisterRoutes() {
+	if !viper.GetBool(config.MetricsEnabled) {
+		return
+	}
+	ctrl.engine.GET("/metrics", middlewares.MetricsToken(), gin.WrapH(promhttp.Handler()))
+}
@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/api/middlewares"
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/services"
+)
+
+type MonitoringController struct {
+	engine           *gin.Engine
+	SchedulerService services.SchedulerService
+	ProbeService     services.ProbeService
+}
+
+func NewMonitoringController(engine *gin.Engine, ss services.SchedulerService, ps services.ProbeService) *MonitoringController {
+	return &MonitoringController{
+		engine:           engine,
+		SchedulerService: ss,
+		ProbeService:     ps,
+	}
+}
+
+func (ctrl *MonitoringController) RegisterRoutes() {
+	basePath := ctrl.engine.Group(viper.GetString(config.ApiBasePath))
+	monitoringRoutes := basePath.Group("/monitoring").Use(middlewares.AskPassword())
+	{
+		monitoringRoutes.GET("/watchlists", ctrl.GetWatchlists)
+		monitoringRoutes.POST("/watchlists", ctrl.SaveWatchlist)
+		monitoringRoutes.DELETE("/watchlists/:name", ctrl.DeleteWatchlist)
+		monitoringRoutes.GET("/schedules", ctrl.GetSchedules)
+		monitoringRoutes.POST("/schedules", ctrl.CreateSchedule)
+		monitoringRoutes.DELETE("/schedules/:id", ctrl.DeleteSchedule)
+		monitoringRoutes.GET("/schedules/:id/runs", ctrl.GetScheduleRuns)
+		monitoringRoutes.GET("/probes", ctrl.GetProbeAgents)
+	}
+}
+
+func (ctrl *MonitoringController) GetWatchlists(ctx *gin.Context) {
+	watchlists := ctrl.SchedulerService.GetWatchlists()
+
+	resp := make([]apiModels.Watchlist, len(watchlists))
+	for i, w := range watchlists {
+		resp[i] = apiModels.Watchlist{Name: w.Name, Domains: w.Domains}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// SaveWatchlist creates a watchlist or replaces domains of existing one
+func (ctrl *MonitoringController) SaveWatchlist(ctx *gin.Context) {
+	var req apiModels.Watchlist
+	if err := ctx.ShouldBindJSON(&req); err != nil || len(req.Domains) == 0 {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid request payload"})
+		return
+	}
+	if maxSize := viper.GetInt(config.ApiMaxSetSize); len(req.Domains) > maxSize {
+		ctx.JSON(http.StatusRequestEntityTooLarge, apiModels.Error{Error: fmt.Sprintf("Watchlist is larger than %d domains allowed", maxSize)})
+		return
+	}
+
+	if err := ctrl.SchedulerService.SaveWatchlist(models.Watchlist{Name: req.Name, Domains: req.Domains}); err != nil {
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to save watchlist"})
+		return
+	}
+	ctx.JSON(http.StatusOK, req)
+}
+
+func (ctrl *MonitoringController) DeleteWatchlist(ctx *gin.Context) {
+	err := ctrl.SchedulerService.DeleteWatchlist(ctx.Param("name"))
+	switch {
+	case err == nil:
+		ctx.Status(http.StatusNoContent)
+	case errors.Is(err, services.ErrWatchlistNotFound):
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Watchlist not found"})
+	case errors.Is(err, services.ErrWatchlistInUse):
+		ctx.JSON(http.StatusConflict, apiModels.Error{Error: "Watchlist is used by a schedule"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to delete watchlist"})
+	}
+}
+
+func (ctrl *MonitoringController) GetSchedules(ctx *gin.Context) {
+	schedules := ctrl.SchedulerService.GetSchedules()
+
+	resp := make([]apiModels.ScheduleResponse, len(schedules))
+	for i, s := range schedules {
+		resp[i] = convertSchedule(s)
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (ctrl *MonitoringController) CreateSchedule(ctx *gin.Context) {
+	var req apiModels.ScheduleRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid request payload"})
+		return
+	}
+
+	schedule := models.Schedule{SetNumber: req.LinksNum, Watchlist: req.Watchlist, Cron: req.Cron, Priority: models.PriorityLow}
+	if req.Interval != "" {
+		interval, err := time.ParseDuration(req.Interval)
+		if err != nil || interval <= 0 {
+			ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid interval"})
+			return
+		}
+		schedule.Interval = interval
+	}
+	if req.Priority != "" {
+		schedule.Priority, _ = models.ParsePriority(req.Priority)
+	}
+
+	schedule, err := ctrl.SchedulerService.CreateSchedule(schedule)
+	switch {
+	case err == nil:
+		ctx.JSON(http.StatusCreated, convertSchedule(schedule))
+	case errors.Is(err, services.ErrInvalidSchedule):
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: err.Error()})
+	case errors.Is(err, services.ErrWatchlistNotFound):
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Watchlist not found"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to create schedule"})
+	}
+}
+
+func (ctrl *MonitoringController) DeleteSchedule(ctx *gin.Context) {
+	err := ctrl.SchedulerService.DeleteSchedule(ctx.Param("id"))
+	switch {
+	case err == nil:
+		ctx.Status(http.StatusNoContent)
+	case errors.Is(err, services.ErrScheduleNotFound):
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Schedule not found"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to delete schedule"})
+	}
+}
+
+func (ctrl *MonitoringController) GetScheduleRuns(ctx *gin.Context) {
+	runs, err := ctrl.SchedulerService.GetRuns(ctx.Param("id"))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to read runs log"})
+		return
+	}
+
+	resp := make([]apiModels.ScheduleRun, len(runs))
+	for i, r := range runs {
+		resp[i] = apiModels.ScheduleRun{JobID: r.JobID, LinksNum: r.SetNumber, Time: r.Time, Error: r.Error}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (ctrl *MonitoringController) GetProbeAgents(ctx *gin.Context) {
+	agents := ctrl.ProbeService.GetAgents()
+
+	resp := make([]apiModels.ProbeAgent, len(agents))
+	for i, a := range agents {
+		resp[i] = convertProbeAgent(a)
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func convertSchedule(s models.Schedule) apiModels.ScheduleResponse {
+	resp := apiModels.ScheduleResponse{
+		ID:        s.ID,
+		LinksNum:  s.SetNumber,
+		Watchlist: s.Watchlist,
+		Cron:      s.Cron,
+		Priority:  s.Priority.String(),
+		CreatedAt: s.CreatedAt,
+		NextRun:   s.NextRun,
+	}
+	if s.Interval > 0 {
+		resp.Interval = s.Interval.String()
+	}
+	if !s.LastRun.IsZero() {
+		resp.LastRun = &s.LastRun
+	}
+	return resp
+}
@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/api/middlewares"
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/services"
+)
+
+// ProbeController serves probe agents, which register, long-poll for domains to check from their location and report
+// results back
+type ProbeController struct {
+	engine       *gin.Engine
+	ProbeService services.ProbeService
+}
+
+func NewProbeController(engine *gin.Engine, ps services.ProbeService) *ProbeController {
+	return &ProbeController{
+		engine:       engine,
+		ProbeService: ps,
+	}
+}
+
+func (ctrl *ProbeController) RegisterRoutes() {
+	basePath := ctrl.engine.Group(viper.GetString(config.ApiBasePath))
+	probeRoutes := basePath.Group("/probes").Use(middlewares.ProbeToken())
+	{
+		probeRoutes.POST("/register", ctrl.Register)
+		probeRoutes.POST("/poll", ctrl.Poll)
+		probeRoutes.POST("/requests/:id/results", ctrl.ReportResults)
+	}
+}
+
+func (ctrl *ProbeController) Register(ctx *gin.Context) {
+	var req apiModels.ProbeRegisterRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid request payload"})
+		return
+	}
+
+	agent := ctrl.ProbeService.RegisterAgent(req.AgentID, req.Location)
+	ctx.JSON(http.StatusOK, convertProbeAgent(agent))
+}
+
+// Poll long-polls for probe requests, 204 is returned if none came before poll timeout
+func (ctrl *ProbeController) Poll(ctx *gin.Context) {
+	var req apiModels.ProbePollRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid request payload"})
+		return
+	}
+
+	requests, err := ctrl.ProbeService.PollRequests(ctx.Request.Context(), req.AgentID)
+	if err != nil {
+		ctrl.respondProbeError(ctx, err)
+		return
+	}
+	if len(requests) == 0 {
+		ctx.Status(http.StatusNoContent)
+		return
+	}
+
+	resp := apiModels.ProbePollResponse{Requests: make([]apiModels.ProbeRequest, len(requests))}
+	for i, r := range requests {
+		resp.Requests[i] = apiModels.ProbeRequest{RequestID: r.ID, Domains: r.Domains, Deadline: r.Deadline}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func (ctrl *ProbeController) ReportResults(ctx *gin.Context) {
+	var req apiModels.ProbeResultsRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid request payload"})
+		return
+	}
+
+	results := make([]services.ProbeResult, len(req.Results))
+	for i, r := range req.Results {
+		results[i] = services.ProbeResult{Index: r.Index, Available: r.Status, Reason: r.Reason}
+	}
+
+	if err := ctrl.ProbeService.ReportResults(req.AgentID, ctx.Param("id"), results); err != nil {
+		ctrl.respondProbeError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// respondProbeError tells the agent to register again (404) or that its results came too late (410)
+func (ctrl *ProbeController) respondProbeError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrAgentNotFound):
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Agent is not registered"})
+	case errors.Is(err, services.ErrProbeRequestNotFound):
+		ctx.JSON(http.StatusGone, apiModels.Error{Error: "Probe request not found or expired"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to process probe request"})
+	}
+}
+
+func convertProbeAgent(a services.ProbeAgent) apiModels.ProbeAgent {
+	return apiModels.ProbeAgent{
+		AgentID:      a.ID,
+		Location:     a.Location,
+		RegisteredAt: a.RegisteredAt,
+		LastSeen:     a.LastSeen,
+		Live:         time.Since(a.LastSeen) <= viper.GetDuration(config.ProbeAgentTTL),
+	}
+}
@@ -1,6 +1,7 @@
 package controllers
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"time"
@@ -9,15 +10,23 @@ import (
 	"github.com/spf13/viper"
 
 	"link-availability-checker/internal/api/middlewares"
+	apiModels "link-availability-checker/internal/api/models"
 	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/services"
+	"link-availability-checker/internal/storage"
 	"link-availability-checker/internal/utils/signals"
 )
 
 type SystemController struct {
-	engine *gin.Engine
+	engine              *gin.Engine
+	AvailabilityService services.AvailabilityService
+	LinkStorage         storage.LinkStorage // Maintenance and quarantine are only there if the backend has them
 }
 
-func NewSystemController(e *gin.Engine) *SystemController { return &SystemController{engine: e} }
+func NewSystemController(e *gin.Engine, as services.AvailabilityService, ls storage.LinkStorage) *SystemController {
+	return &SystemController{engine: e, AvailabilityService: as, LinkStorage: ls}
+}
 
 func (ctrl *SystemController) RegisterRoutes() {
 	basePath := ctrl.engine.Group(viper.GetString(config.ApiBasePath))
@@ -25,6 +34,11 @@ func (ctrl *SystemController) RegisterRoutes() {
 	{
 		systemRoutes.GET("/stop", ctrl.StopService)
 		systemRoutes.GET("/restart", ctrl.RestartService)
+		systemRoutes.GET("/concurrency", ctrl.GetConcurrency)
+		systemRoutes.POST("/storage/maintain", ctrl.MaintainStorage)
+		systemRoutes.GET("/storage/quarantine", ctrl.GetQuarantined)
+		systemRoutes.GET("/storage/quarantine/:id", ctrl.DownloadQuarantined)
+		systemRoutes.DELETE("/storage/quarantine/:id", ctrl.DeleteQuarantined)
 	}
 }
 
@@ -43,3 +57,114 @@ func (ctrl *SystemController) RestartService(ctx *gin.Context) {
 		signals.SendInterruptSignal()
 	}
 }
+
+// GetConcurrency shows limit of checks running at once and recent decisions of adaptive controller
+func (ctrl *SystemController) GetConcurrency(ctx *gin.Context) {
+	state := ctrl.AvailabilityService.ConcurrencyState()
+
+	resp := apiModels.ConcurrencyResponse{
+		Adaptive:  state.Adaptive,
+		Limit:     state.Limit,
+		InFlight:  state.InFlight,
+		Min:       state.Min,
+		Max:       state.Max,
+		Decisions: make([]apiModels.ConcurrencyDecision, len(state.Decisions)),
+	}
+	for i, d := range state.Decisions {
+		resp.Decisions[i] = apiModels.ConcurrencyDecision{
+			Time:         d.Time,
+			Action:       d.Action,
+			Reason:       d.Reason,
+			From:         d.From,
+			To:           d.To,
+			Samples:      d.Samples,
+			TimeoutRate:  d.TimeoutRate,
+			AvgLatencyMs: float64(d.AvgLatency) / float64(time.Millisecond),
+		}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// MaintainStorage runs segment maintenance of links file without waiting for the next interval
+func (ctrl *SystemController) MaintainStorage(ctx *gin.Context) {
+	maintainer, ok := ctrl.LinkStorage.(storage.Maintainer)
+	if !ok {
+		ctx.JSON(http.StatusNotImplemented, apiModels.Error{Error: "Storage backend has no segments to maintain"})
+		return
+	}
+	report, err := maintainer.MaintainLinkSets()
+	if err != nil {
+		log.Printf("[FILESTORE] Maintenance requested through API failed: %v", err)
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Storage maintenance failed"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, apiModels.MaintenanceResponse{
+		Sealed:      report.Sealed,
+		Expired:     report.Expired,
+		ExpiredSets: report.ExpiredSets,
+		Compacted:   report.Compacted,
+		Reclaimed:   report.Reclaimed,
+		Compressed:  report.Compressed,
+	})
+}
+
+// GetQuarantined lists damaged records found in links file, quarantine of backends without one is empty
+func (ctrl *SystemController) GetQuarantined(ctx *gin.Context) {
+	var records []models.QuarantinedRecord
+	var err error
+	if quarantine, ok := ctrl.LinkStorage.(storage.Quarantine); ok {
+		records, err = quarantine.QuarantinedRecords()
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to read quarantine"})
+		return
+	}
+
+	resp := make([]apiModels.QuarantinedRecord, len(records))
+	for i, r := range records {
+		resp[i] = apiModels.QuarantinedRecord{
+			ID:      r.ID,
+			Segment: r.Segment,
+			Offset:  r.Offset,
+			Length:  r.Length,
+			Reason:  r.Reason,
+			Number:  r.Number,
+			Time:    r.Time,
+		}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// DownloadQuarantined responds with raw bytes of a damaged record
+func (ctrl *SystemController) DownloadQuarantined(ctx *gin.Context) {
+	data, err := []byte(nil), storage.ErrQuarantinedNotFound
+	if quarantine, ok := ctrl.LinkStorage.(storage.Quarantine); ok {
+		data, err = quarantine.ReadQuarantined(ctx.Param("id"))
+	}
+	switch {
+	case err == nil:
+		ctx.Data(http.StatusOK, "application/octet-stream", data)
+	case errors.Is(err, storage.ErrQuarantinedNotFound):
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Quarantined record not found"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to read quarantined record"})
+	}
+}
+
+func (ctrl *SystemController) DeleteQuarantined(ctx *gin.Context) {
+	id := ctx.Param("id")
+	err := storage.ErrQuarantinedNotFound
+	if quarantine, ok := ctrl.LinkStorage.(storage.Quarantine); ok {
+		err = quarantine.DeleteQuarantined(id)
+	}
+	switch {
+	case err == nil:
+		log.Printf("[FILESTORE] Deleted quarantined record %s", id)
+		ctx.Status(http.StatusNoContent)
+	case errors.Is(err, storage.ErrQuarantinedNotFound):
+		ctx.JSON(http.StatusNotFound, apiModels.Error{Error: "Quarantined record not found"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to delete quarantined record"})
+	}
+}
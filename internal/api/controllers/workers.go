@@ -0,0 +1,150 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/api/middlewares"
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/services"
+)
+
+// WorkerController serves remote worker processes, which lease queued tasks, report results with heartbeats and
+// complete or release the lease
+type WorkerController struct {
+	engine      *gin.Engine
+	LinkService services.LinkService
+}
+
+func NewWorkerController(engine *gin.Engine, ls services.LinkService) *WorkerController {
+	return &WorkerController{
+		engine:      engine,
+		LinkService: ls,
+	}
+}
+
+func (ctrl *WorkerController) RegisterRoutes() {
+	basePath := ctrl.engine.Group(viper.GetString(config.ApiBasePath))
+	workerRoutes := basePath.Group("/workers").Use(middlewares.WorkerToken())
+	{
+		workerRoutes.POST("/lease", ctrl.LeaseTask)
+		workerRoutes.POST("/leases/:id/heartbeat", ctrl.Heartbeat)
+		workerRoutes.POST("/leases/:id/complete", ctrl.Complete)
+		workerRoutes.POST("/leases/:id/release", ctrl.Release)
+	}
+}
+
+// LeaseTask long-polls for a queued task, 204 is returned if none appeared before poll timeout
+func (ctrl *WorkerController) LeaseTask(ctx *gin.Context) {
+	var req apiModels.LeaseRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid request payload"})
+		return
+	}
+
+	lease, ok, err := ctrl.LinkService.LeaseTask(ctx.Request.Context(), req.WorkerID)
+	if err != nil {
+		ctrl.respondLeaseError(ctx, err)
+		return
+	}
+	if !ok {
+		ctx.Status(http.StatusNoContent)
+		return
+	}
+
+	links := make([]apiModels.LeasedLink, len(lease.Links))
+	for i, l := range lease.Links {
+		links[i] = apiModels.LeasedLink{Index: l.Index, Domain: l.Domain}
+	}
+	ctx.JSON(http.StatusOK, apiModels.LeaseResponse{
+		LeaseID:             lease.ID,
+		JobID:               lease.JobID,
+		LinksNum:            lease.SetNumber,
+		Links:               links,
+		ExpiresAt:           lease.ExpiresAt,
+		HeartbeatIntervalMs: (viper.GetDuration(config.LeaseDuration) / 3).Milliseconds(),
+	})
+}
+
+func (ctrl *WorkerController) Heartbeat(ctx *gin.Context) {
+	results, ok := bindLeaseResults(ctx)
+	if !ok {
+		return
+	}
+
+	expires, err := ctrl.LinkService.HeartbeatLease(ctx.Param("id"), results)
+	if err != nil {
+		ctrl.respondLeaseError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, apiModels.HeartbeatResponse{ExpiresAt: expires})
+}
+
+func (ctrl *WorkerController) Complete(ctx *gin.Context) {
+	results, ok := bindLeaseResults(ctx)
+	if !ok {
+		return
+	}
+
+	if err := ctrl.LinkService.CompleteLease(ctx.Param("id"), results); err != nil {
+		ctrl.respondLeaseError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func (ctrl *WorkerController) Release(ctx *gin.Context) {
+	results, ok := bindLeaseResults(ctx)
+	if !ok {
+		return
+	}
+
+	if err := ctrl.LinkService.ReleaseLease(ctx.Param("id"), results); err != nil {
+		ctrl.respondLeaseError(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+func bindLeaseResults(ctx *gin.Context) ([]services.LinkResult, bool) {
+	var req apiModels.LeaseResultsRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, apiModels.Error{Error: "Invalid request payload"})
+		return nil, false
+	}
+
+	results := make([]services.LinkResult, len(req.Results))
+	for i, r := range req.Results {
+		results[i] = services.LinkResult{
+			Index: r.Index,
+			Result: models.CheckResult{
+				Available: r.Status,
+				Reason:    r.Reason,
+				Latency:   time.Duration(r.LatencyMs * float64(time.Millisecond)),
+			},
+			Time: r.Time,
+		}
+		if results[i].Time.IsZero() {
+			results[i].Time = time.Now()
+		}
+	}
+	return results, true
+}
+
+// respondLeaseError tells the worker whether to drop the task (410) or retry later (503)
+func (ctrl *WorkerController) respondLeaseError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrLeaseNotFound):
+		ctx.JSON(http.StatusGone, apiModels.Error{Error: "Lease not found or expired"})
+	case errors.Is(err, services.ErrServiceStopping):
+		ctx.JSON(http.StatusServiceUnavailable, apiModels.Error{Error: "Service is shutting down"})
+	default:
+		ctx.JSON(http.StatusInternalServerError, apiModels.Error{Error: "Failed to process lease"})
+	}
+}
@@ -0,0 +1,55 @@
+package middlewares
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+)
+
+const clientKey = "client"
+
+// IdentifyClient resolves client by X-API-Key header or falls back to anonymous client identified by IP. Client IDs
+// are shown in queue stats and jobs, so keys without name are identified by a short hash instead of the key itself.
+func IdentifyClient() gin.HandlerFunc {
+	keys := make(map[string]models.Client)
+	for key, c := range config.GetAPIKeys() {
+		priority, _ := models.ParsePriority(c.Priority)
+		name := c.Name
+		if name == "" {
+			sum := sha256.Sum256([]byte(key))
+			name = "#" + hex.EncodeToString(sum[:6])
+		}
+		keys[key] = models.Client{ID: "key:" + name, Priority: priority, Weight: max(c.Weight, 1), Tier: c.Tier}
+	}
+
+	return func(c *gin.Context) {
+		header := c.GetHeader("X-API-Key")
+		if header == "" {
+			c.Set(clientKey, models.Client{ID: "ip:" + c.ClientIP(), Priority: models.PriorityNormal, Weight: 1})
+			c.Next()
+			return
+		}
+
+		client, ok := keys[strings.ToLower(header)] // Viper lowercases map keys when reading config
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid API key"})
+			return
+		}
+
+		c.Set(clientKey, client)
+		c.Next()
+	}
+}
+
+// GetClient returns client resolved by IdentifyClient
+func GetClient(c *gin.Context) models.Client {
+	client, _ := c.Get(clientKey)
+	result, _ := client.(models.Client)
+	return result
+}
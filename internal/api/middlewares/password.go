@@ -25,3 +25,10 @@ func AskPassword() gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+// HasPassword tells if the request carries the password without rejecting requests that don't, for endpoints that only
+// show more to the administrator
+func HasPassword(c *gin.Context) bool {
+	password := viper.GetString(config.ApiPassword)
+	return password != "" && c.GetHeader("Password") == password
+}
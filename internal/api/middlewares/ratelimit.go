@@ -0,0 +1,102 @@
+package middlewares
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/pkg/ratelimit"
+)
+
+const quotaKey = "quota"
+
+type quota struct {
+	limiter  *ratelimit.Limiter
+	clientID string
+	tier     config.RateLimitTier
+}
+
+// RateLimit limits requests of the client identified by IdentifyClient according to its tier, domain limits are
+// applied by handlers with TakeDomains once they know the set size
+func RateLimit() gin.HandlerFunc {
+	tiers := config.GetRateLimitTiers()
+	defaultTier := viper.GetString(config.RateLimitDefaultTier)
+	limiter := ratelimit.New()
+
+	return func(c *gin.Context) {
+		client := GetClient(c)
+		name := client.Tier
+		if name == "" {
+			name = defaultTier
+		}
+		tier := tiers[name] // Unknown tier has no limits
+
+		c.Set(quotaKey, &quota{limiter: limiter, clientID: client.ID, tier: tier})
+
+		if tier.RequestsPerMinute > 0 {
+			burst := tier.RequestsBurst
+			if burst <= 0 {
+				burst = tier.RequestsPerMinute
+			}
+			res := limiter.Take(client.ID+"|requests", 1, tier.RequestsPerMinute, burst)
+			setRateLimitHeaders(c, "X-RateLimit", res)
+			if !res.Allowed {
+				rejectRateLimited(c, res, "Request rate limit exceeded")
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// TakeDomains accounts n links submitted by the client, if the set is larger than app.api.max_set_size or the tier
+// allows, or domain limit is exceeded, it responds with an error and returns false
+func TakeDomains(c *gin.Context, n int) bool {
+	maxSize := viper.GetInt(config.ApiMaxSetSize) // Tiers may only lower it
+	value, ok := c.Get(quotaKey)
+	var q *quota
+	if ok {
+		q = value.(*quota)
+		if q.tier.MaxSetSize > 0 {
+			maxSize = min(maxSize, q.tier.MaxSetSize)
+		}
+		// Set that doesn't fit into a minute's worth of domains would never be allowed
+		if q.tier.DomainsPerMinute > 0 {
+			maxSize = min(maxSize, q.tier.DomainsPerMinute)
+		}
+	}
+	if n > maxSize {
+		c.Header("X-RateLimit-Max-Set-Size", strconv.Itoa(maxSize))
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"Error": "Set is larger than " + strconv.Itoa(maxSize) + " links allowed"})
+		return false
+	}
+	if q == nil {
+		return true
+	}
+
+	if q.tier.DomainsPerMinute > 0 {
+		res := q.limiter.Take(q.clientID+"|domains", n, q.tier.DomainsPerMinute, q.tier.DomainsPerMinute)
+		setRateLimitHeaders(c, "X-RateLimit-Domains", res)
+		if !res.Allowed {
+			rejectRateLimited(c, res, "Domain rate limit exceeded")
+			return false
+		}
+	}
+	return true
+}
+
+func setRateLimitHeaders(c *gin.Context, prefix string, res ratelimit.Result) {
+	c.Header(prefix+"-Limit", strconv.Itoa(res.Limit))
+	c.Header(prefix+"-Remaining", strconv.Itoa(res.Remaining))
+	c.Header(prefix+"-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+}
+
+func rejectRateLimited(c *gin.Context, res ratelimit.Result, msg string) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"Error": msg})
+}
@@ -0,0 +1,74 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+)
+
+const (
+	WorkerTokenHeader = "X-Worker-Token"
+	ProbeTokenHeader  = "X-Probe-Token"
+)
+
+// WorkerToken admits remote worker processes presenting the shared token, the endpoints are disabled if it isn't set
+func WorkerToken() gin.HandlerFunc {
+	return sharedToken(config.LeaseToken, WorkerTokenHeader, "Remote workers are disabled")
+}
+
+// ProbeToken admits probe agents presenting the shared token, the endpoints are disabled if it isn't set
+func ProbeToken() gin.HandlerFunc {
+	return sharedToken(config.ProbeToken, ProbeTokenHeader, "Probe agents are disabled")
+}
+
+func sharedToken(key, headerName, disabled string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := viper.GetString(key)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"Error": disabled})
+			return
+		}
+
+		header := c.GetHeader(headerName)
+		if header == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": "Token required"})
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// MetricsToken admits scrapers presenting the token as a bearer token, anyone is admitted if it isn't set
+func MetricsToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := viper.GetString(config.MetricsToken)
+		if token == "" {
+			c.Next()
+			return
+		}
+
+		header, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": "Token required"})
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"Error": "Invalid token"})
+			return
+		}
+
+		c.Next()
+	}
+}
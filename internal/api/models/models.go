@@ -1,6 +1,8 @@
 package apiModels
 
 import (
+	"time"
+
 	"link-availability-checker/internal/models"
 )
 
@@ -8,8 +10,72 @@ type Error struct {
 	Error string `json:"error"`
 }
 
+type ConcurrencyResponse struct {
+	Adaptive  bool                  `json:"adaptive"`
+	Limit     int                   `json:"limit"` // Checks at once overall if adaptive, per set otherwise
+	InFlight  int                   `json:"in_flight"`
+	Min       int                   `json:"min,omitempty"`
+	Max       int                   `json:"max"`
+	Decisions []ConcurrencyDecision `json:"decisions"`
+}
+
+type ConcurrencyDecision struct {
+	Time         time.Time `json:"time"`
+	Action       string    `json:"action"`
+	Reason       string    `json:"reason"`
+	From         int       `json:"from"`
+	To           int       `json:"to"`
+	Samples      int       `json:"samples"`
+	TimeoutRate  float64   `json:"timeout_rate"`
+	AvgLatencyMs float64   `json:"avg_latency_ms"`
+}
+
+type MaintenanceResponse struct {
+	Sealed      bool  `json:"sealed"`
+	Expired     int   `json:"expired_segments"`
+	ExpiredSets int   `json:"expired_sets"`
+	Compacted   int   `json:"compacted_segments"`
+	Reclaimed   int64 `json:"reclaimed_bytes"`
+	Compressed  int   `json:"compressed_segments"`
+}
+
+type QuarantinedRecord struct {
+	ID      string    `json:"id"`
+	Segment string    `json:"segment"`
+	Offset  int64     `json:"offset"`
+	Length  int64     `json:"length"`
+	Reason  string    `json:"reason"`
+	Number  int       `json:"links_num,omitempty"` // Salvaged from damaged bytes
+	Time    time.Time `json:"time"`
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type ReadinessResponse struct {
+	Status string        `json:"status"` // ready or not ready
+	Checks []HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // ok or fail
+	Error  string `json:"error,omitempty"`
+}
+
+type JobError struct {
+	Error string `json:"error"`
+	JobID string `json:"job_id"`
+}
+
 type CheckLinkSetRequest struct {
-	Links []string `json:"links" binding:"required"`
+	Links       []string `json:"links" binding:"required"`
+	Priority    string   `json:"priority" binding:"omitempty,oneof=low normal high"`
+	Async       bool     `json:"async"`                                // Respond with job ID right away instead of waiting for result
+	CallbackURL string   `json:"callback_url" binding:"omitempty,url"` // POST result here once the set is stored
+
+	IdempotencyKey string `json:"-"` // From Idempotency-Key header
 }
 
 func (l *CheckLinkSetRequest) ConvertLinksToModel() []models.Link {
@@ -21,8 +87,33 @@ func (l *CheckLinkSetRequest) ConvertLinksToModel() []models.Link {
 }
 
 type CheckLinkSetResponse struct {
-	Links    map[string]string `json:"links"`
-	LinksNum int               `json:"links_num"`
+	Links    map[string]string    `json:"links"`
+	Verdicts map[string][]Verdict `json:"verdicts,omitempty"`
+	LinksNum int                  `json:"links_num"`
+	JobID    string               `json:"job_id"`
+	Canceled bool                 `json:"canceled,omitempty"`
+}
+
+// Verdict is a status of a link seen from one vantage point
+type Verdict struct {
+	Agent    string `json:"agent"`
+	Location string `json:"location,omitempty"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+type JobResponse struct {
+	JobID      string               `json:"job_id"`
+	State      string               `json:"state"`
+	Priority   string               `json:"priority"`
+	LinksNum   int                  `json:"links_num,omitempty"` // Set number is reserved once the job is started
+	Total      int                  `json:"total"`
+	Checked    int                  `json:"checked"`
+	Links      map[string]string    `json:"links,omitempty"`
+	Verdicts   map[string][]Verdict `json:"verdicts,omitempty"`
+	CreatedAt  time.Time            `json:"created_at"`
+	FinishedAt *time.Time           `json:"finished_at,omitempty"`
+	Worker     string               `json:"worker,omitempty"`
 }
 
 type GetLinkSetRequest struct {
@@ -32,3 +123,202 @@ type GetLinkSetRequest struct {
 type GetLinkSetResponse struct {
 	File []byte `json:"file"`
 }
+
+type QueueStatsResponse struct {
+	Depth    int               `json:"depth"`
+	Capacity int               `json:"capacity"`
+	Spilled  int               `json:"spilled"`
+	Skipped  int               `json:"spill_skipped"` // Spilled tasks that couldn't be read until restart
+	InFlight int               `json:"in_flight"`
+	Leased   int               `json:"leased"`
+	Workers  int               `json:"workers"`
+	Busy     int               `json:"busy_workers"`
+	Levels   []QueueLevelStats `json:"levels"`
+}
+
+type QueueLevelStats struct {
+	Priority    string             `json:"priority"`
+	Depth       int                `json:"depth"`
+	Dequeued    int                `json:"dequeued"`
+	VirtualTime float64            `json:"virtual_time"`
+	Clients     []QueueClientStats `json:"clients"`
+}
+
+type QueueClientStats struct {
+	ID       string `json:"id"`
+	Weight   int    `json:"weight"`
+	Depth    int    `json:"depth"`
+	Dequeued int    `json:"dequeued"`
+}
+
+type UptimeResponse struct {
+	Domain       string       `json:"domain"`
+	From         time.Time    `json:"from"`
+	To           time.Time    `json:"to"`
+	Checks       int          `json:"checks"`
+	Available    int          `json:"available"`
+	Uptime       float64      `json:"uptime_percent"`
+	Outages      int          `json:"outages"`
+	AvgLatencyMs float64      `json:"avg_latency_ms"`
+	LastCheck    *CheckRecord `json:"last_check,omitempty"`
+}
+
+type CheckRecord struct {
+	Time      time.Time `json:"time"`
+	Status    string    `json:"status"`
+	Reason    string    `json:"reason"`
+	LatencyMs float64   `json:"latency_ms"`
+}
+
+type Incident struct {
+	ID              string     `json:"id"`
+	Domain          string     `json:"domain"`
+	Open            bool       `json:"open"`
+	Start           time.Time  `json:"start"`
+	End             *time.Time `json:"end,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	FirstReason     string     `json:"first_reason"`
+	LastReason      string     `json:"last_reason"`
+	Checks          int        `json:"checks"`
+}
+
+type WebhookPayload struct {
+	JobID    string            `json:"job_id"`
+	State    string            `json:"state"`
+	LinksNum int               `json:"links_num"`
+	Links    map[string]string `json:"links"`
+	Canceled bool              `json:"canceled,omitempty"`
+}
+
+type DeliveriesResponse struct {
+	LinksNum   int        `json:"links_num"`
+	Deliveries []Delivery `json:"deliveries"`
+}
+
+type Delivery struct {
+	ID         string    `json:"id"`
+	JobID      string    `json:"job_id"`
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+	GaveUp     bool      `json:"gave_up,omitempty"`
+}
+
+type LinkEvent struct {
+	Index  int    `json:"index"`
+	Domain string `json:"domain"`
+	Status string `json:"status"`
+}
+
+type JobDoneEvent struct {
+	State    string `json:"state"`
+	LinksNum int    `json:"links_num"`
+}
+
+type Watchlist struct {
+	Name    string   `json:"name" binding:"required"`
+	Domains []string `json:"domains" binding:"required"`
+}
+
+type ScheduleRequest struct {
+	LinksNum  int    `json:"links_num" binding:"omitempty,gt=0"` // Stored set to re-check, or
+	Watchlist string `json:"watchlist"`                          // watchlist to check
+	Interval  string `json:"interval"`                           // Go duration like "15m", or
+	Cron      string `json:"cron"`                               // standard 5-field cron expression
+	Priority  string `json:"priority" binding:"omitempty,oneof=low normal high"`
+}
+
+type ScheduleResponse struct {
+	ID        string     `json:"id"`
+	LinksNum  int        `json:"links_num,omitempty"`
+	Watchlist string     `json:"watchlist,omitempty"`
+	Interval  string     `json:"interval,omitempty"`
+	Cron      string     `json:"cron,omitempty"`
+	Priority  string     `json:"priority"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	NextRun   time.Time  `json:"next_run"`
+}
+
+type ScheduleRun struct {
+	JobID    string    `json:"job_id,omitempty"`
+	LinksNum int       `json:"links_num,omitempty"`
+	Time     time.Time `json:"time"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type LeaseRequest struct {
+	WorkerID string `json:"worker_id" binding:"required"`
+}
+
+type LeaseResponse struct {
+	LeaseID             string       `json:"lease_id"`
+	JobID               string       `json:"job_id"`
+	LinksNum            int          `json:"links_num"`
+	Links               []LeasedLink `json:"links"`
+	ExpiresAt           time.Time    `json:"expires_at"`
+	HeartbeatIntervalMs int64        `json:"heartbeat_interval_ms"`
+}
+
+type LeasedLink struct {
+	Index  int    `json:"index"`
+	Domain string `json:"domain"`
+}
+
+// LeaseResultsRequest carries results of leased links, it's the body of heartbeat, complete and release requests
+type LeaseResultsRequest struct {
+	Results []LinkResult `json:"results"`
+}
+
+type LinkResult struct {
+	Index     int       `json:"index"`
+	Status    bool      `json:"status"`
+	Reason    string    `json:"reason"`
+	LatencyMs float64   `json:"latency_ms"`
+	Time      time.Time `json:"time"`
+}
+
+type HeartbeatResponse struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type ProbeRegisterRequest struct {
+	AgentID  string `json:"agent_id" binding:"required"`
+	Location string `json:"location" binding:"required"`
+}
+
+type ProbePollRequest struct {
+	AgentID string `json:"agent_id" binding:"required"`
+}
+
+type ProbePollResponse struct {
+	Requests []ProbeRequest `json:"requests"`
+}
+
+type ProbeRequest struct {
+	RequestID string    `json:"request_id"`
+	Domains   []string  `json:"domains"`
+	Deadline  time.Time `json:"deadline"` // Results reported later are ignored
+}
+
+type ProbeResultsRequest struct {
+	AgentID string        `json:"agent_id" binding:"required"`
+	Results []ProbeResult `json:"results"`
+}
+
+type ProbeResult struct {
+	Index  int    `json:"index"`
+	Status bool   `json:"status"`
+	Reason string `json:"reason"`
+}
+
+type ProbeAgent struct {
+	AgentID      string    `json:"agent_id"`
+	Location     string    `json:"location"`
+	RegisteredAt time.Time `json:"registered_at"`
+	LastSeen     time.Time `json:"last_seen"`
+	Live         bool      `json:"live"`
+}
@@ -3,7 +3,9 @@ package config
 import (
 	"fmt"
 	"log"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 	"go.uber.org/fx"
@@ -13,38 +15,381 @@ import (
 
 const DefaultConfigLocation = "./config.yaml"
 
+// RestartLockWaitEnv tells a process started by restart how long to wait for the old one to release data directories,
+// it overrides LockWait if that is shorter
+const RestartLockWaitEnv = "LINK_CHECKER_RESTART_LOCK_WAIT"
+
 func LoadConfig() {
 	viper.SetConfigFile(DefaultConfigLocation)
 	if err := viper.ReadInConfig(); err != nil {
 		log.Fatalf("Failed to load config: %s", err)
 	}
+	setDefaults()
 	if err := ValidateConfigFields(); err != nil {
 		log.Fatalf("Failed to validate config: %s", err)
 	}
 }
 
+// LoadWorkerConfig loads config of a worker process, which only needs logging, worker pool and coordinator settings
+func LoadWorkerConfig() {
+	viper.SetConfigFile(DefaultConfigLocation)
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to load config: %s", err)
+	}
+	setDefaults()
+	if err := ValidateWorkerConfigFields(); err != nil {
+		log.Fatalf("Failed to validate config: %s", err)
+	}
+}
+
+// LoadProbeConfig loads config of a probe agent, which only needs logging, worker pool and coordinator settings
+func LoadProbeConfig() {
+	viper.SetConfigFile(DefaultConfigLocation)
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to load config: %s", err)
+	}
+	setDefaults()
+	if err := ValidateProbeConfigFields(); err != nil {
+		log.Fatalf("Failed to validate config: %s", err)
+	}
+}
+
 const (
 	LogFilePath  = "app.log.path"           // string
 	MuteFx       = "app.log.mute_fx"        // bool
 	MuteGinDebug = "app.log.mute_gin_debug" // bool
 
-	LinksFilePath = "app.filestore.path" // string
+	StorageBackend = "app.filestore.backend"         // string, file or bolt
+	LinksFilePath  = "app.filestore.path"            // string
+	BoltPath       = "app.filestore.bolt_path"       // string, bbolt database of link sets used by bolt backend
+	IndexPath      = "app.filestore.index_path"      // string, sidecar file with offsets of sets in links file, empty - don't save
+	HistoryPath    = "app.filestore.history_path"    // string
+	HistoryDomains = "app.filestore.history_domains" // int, domains that may have history, new ones aren't recorded above it, 0 - no limit
+	HistoryKeep    = "app.filestore.history_keep"    // time.Duration, check results older than this are pruned, 0 - keep forever
+	QuarantinePath = "app.filestore.quarantine_path" // string, directory with copies of damaged records of links file
+	LockWait       = "app.filestore.lock_wait"       // time.Duration, how long to wait for another instance to release data directory
+
+	SegmentMaxSize       = "app.filestore.segments.max_size_mb"          // int, seal links file once it's this large, 0 - no limit
+	SegmentMaxAge        = "app.filestore.segments.max_age"              // time.Duration, seal links file this long after the previous seal, 0 - no limit
+	SegmentCompress      = "app.filestore.segments.compress"             // bool, gzip sealed segments
+	SegmentCompressAfter = "app.filestore.segments.compress_after"       // time.Duration, age of sealed segment to gzip it
+	SegmentRetention     = "app.filestore.segments.retention"            // time.Duration, drop sets of segments sealed this long ago, 0 - keep forever
+	SegmentMaintenance   = "app.filestore.segments.maintenance_interval" // time.Duration, how often rotation by age, retention, compaction and compression run
 
 	ApiPort     = "app.api.port"      // int
 	ApiBasePath = "app.api.base_path" // string
 	ApiPassword = "app.api.password"  // string
+	ApiKeys     = "app.api.keys"      // map[string]APIKey
 
-	QueueFilePath = "app.queue.path"    // string
-	QueueWorkers  = "app.queue.workers" // int
+	ApiMaxSetSize = "app.api.max_set_size" // int, the largest set accepted for checking, rate limit tiers may only lower it
+
+	HealthDrainDelay     = "app.health.drain_delay"     // time.Duration, how long to report not ready before stopping
+	HealthQueueThreshold = "app.health.queue_threshold" // float64, share of queue capacity above which service is not ready
+	HealthResolverDomain = "app.health.resolver_domain" // string, resolved by deep readiness check
+	HealthMinFreeSpace   = "app.health.min_free_mb"     // uint64, free disk space required by deep readiness check
+
+	MetricsEnabled = "app.metrics.enabled" // bool
+	MetricsToken   = "app.metrics.token"   // string, bearer token required from scrapers, anyone may scrape if empty
+
+	TracingExporter    = "app.tracing.exporter"     // string, none, stdout or otlp
+	TracingEndpoint    = "app.tracing.endpoint"     // string, host:port of OTLP HTTP receiver
+	TracingInsecure    = "app.tracing.insecure"     // bool, plain HTTP to OTLP receiver
+	TracingSampleRatio = "app.tracing.sample_ratio" // float64, share of traces started by the service that are kept
+	TracingServiceName = "app.tracing.service_name" // string
+
+	RateLimitDefaultTier = "app.rate_limits.default_tier" // string
+	RateLimitTiers       = "app.rate_limits.tiers"        // map[string]RateLimitTier
+
+	QueueFilePath         = "app.queue.path"              // string
+	QueueWorkers          = "app.queue.workers"           // int
+	QueueCompactThreshold = "app.queue.compact_threshold" // int
+	QueueLimit            = "app.queue.limit"             // int
+	QueueWaitTimeout      = "app.queue.wait_timeout"      // time.Duration
+	QueueRetryAfter       = "app.queue.retry_after"       // time.Duration
+	QueueSpillPath        = "app.queue.spill_path"        // string
+	QueueSmallSetSize     = "app.queue.small_set_size"    // int
+	QueueAbandonPolicy    = "app.queue.abandon_policy"    // string
+	QueueJobRetention     = "app.queue.job_retention"     // time.Duration
+
+	IdempotencyPath      = "app.idempotency.path"      // string
+	IdempotencyRetention = "app.idempotency.retention" // time.Duration
 
 	WorkersRatio = "app.worker_pool.workers_ratio" // int
 	MaxWorkers   = "app.worker_pool.workers_limit" // int
 
+	AdaptiveEnabled        = "app.worker_pool.adaptive.enabled"          // bool, limit checks running at once by observed latency and timeouts
+	AdaptiveMin            = "app.worker_pool.adaptive.min"              // int
+	AdaptiveMax            = "app.worker_pool.adaptive.max"              // int, workers_limit if 0
+	AdaptiveInitial        = "app.worker_pool.adaptive.initial"          // int, halfway between min and max if 0
+	AdaptiveInterval       = "app.worker_pool.adaptive.interval"         // time.Duration, how often the limit is reconsidered
+	AdaptiveTargetLatency  = "app.worker_pool.adaptive.target_latency"   // time.Duration, average latency above which the limit shrinks
+	AdaptiveMaxTimeoutRate = "app.worker_pool.adaptive.max_timeout_rate" // float64, share of timed out checks above which the limit shrinks
+
 	RecheckStatusesWhenPrinting = "app.links.recheck_statuses_on_print" // bool
+
+	WebhookSecret         = "app.webhooks.secret"          // string
+	WebhookOutboxPath     = "app.webhooks.outbox_path"     // string
+	WebhookLogPath        = "app.webhooks.log_path"        // string
+	WebhookTimeout        = "app.webhooks.timeout"         // time.Duration
+	WebhookMaxAttempts    = "app.webhooks.max_attempts"    // int
+	WebhookInitialBackoff = "app.webhooks.initial_backoff" // time.Duration
+	WebhookMaxBackoff     = "app.webhooks.max_backoff"     // time.Duration
+	WebhookConcurrency    = "app.webhooks.concurrency"     // int, callbacks sent at once, each endpoint gets them one at a time
+	WebhookAllowPrivate   = "app.webhooks.allow_private"   // bool, allow callbacks to loopback, private and link-local addresses
+
+	SchedulerPath        = "app.scheduler.path"         // string
+	SchedulerRunsPath    = "app.scheduler.runs_path"    // string
+	SchedulerMinInterval = "app.scheduler.min_interval" // time.Duration
+
+	IncidentFailureThreshold = "app.incidents.failure_threshold" // int
+	IncidentStatePath        = "app.incidents.state_path"        // string
+	IncidentLogPath          = "app.incidents.log_path"          // string
+	IncidentReportWindow     = "app.incidents.report_window"     // time.Duration
+	IncidentPendingWindow    = "app.incidents.pending_window"    // time.Duration, failures further apart aren't consecutive
+	IncidentPendingDomains   = "app.incidents.pending_domains"   // int, domains with failures below threshold tracked at once
+
+	AlertTimeout   = "app.alerts.timeout"   // time.Duration
+	AlertNotifiers = "app.alerts.notifiers" // []AlertNotifier
+
+	LeaseToken       = "app.remote_workers.token"          // string, remote workers are disabled if empty
+	LeaseDuration    = "app.remote_workers.lease_duration" // time.Duration
+	LeasePollTimeout = "app.remote_workers.poll_timeout"   // time.Duration
+
+	WorkerCoordinator = "app.worker.coordinator" // string, URL of coordinator API including base path
+	WorkerToken       = "app.worker.token"       // string
+	WorkerID          = "app.worker.id"          // string, host name and PID if empty
+	WorkerConcurrency = "app.worker.concurrency" // int, tasks leased at once
+
+	ProbeToken       = "app.probes.token"        // string, probe agents are disabled if empty
+	ProbeQuorum      = "app.probes.quorum"       // int, vantage points that must see a domain down, majority if 0
+	ProbeLocation    = "app.probes.location"     // string, location of the server itself
+	ProbeTimeout     = "app.probes.timeout"      // time.Duration
+	ProbePollTimeout = "app.probes.poll_timeout" // time.Duration
+	ProbeAgentTTL    = "app.probes.agent_ttl"    // time.Duration
+
+	ProbeAgentCoordinator = "app.probe.coordinator" // string, URL of coordinator API including base path
+	ProbeAgentToken       = "app.probe.token"       // string
+	ProbeAgentID          = "app.probe.id"          // string, host name and PID if empty
+	ProbeAgentLocation    = "app.probe.location"    // string
 )
 
+func setDefaults() {
+	viper.SetDefault(HealthQueueThreshold, 0.9)
+	viper.SetDefault(HealthResolverDomain, "example.com")
+	viper.SetDefault(HealthMinFreeSpace, 100)
+
+	viper.SetDefault(TracingExporter, "none")
+	viper.SetDefault(TracingEndpoint, "localhost:4318")
+	viper.SetDefault(TracingSampleRatio, 1.0)
+	viper.SetDefault(TracingServiceName, "link-availability-checker")
+
+	viper.SetDefault(ApiMaxSetSize, 10000)
+	viper.SetDefault(RateLimitDefaultTier, "default")
+
+	viper.SetDefault(StorageBackend, "file")
+	viper.SetDefault(BoltPath, "./links.db")
+	viper.SetDefault(HistoryPath, "./history")
+	viper.SetDefault(HistoryDomains, 10000)
+	viper.SetDefault(HistoryKeep, 30*24*time.Hour)
+	viper.SetDefault(QuarantinePath, "./quarantine")
+	viper.SetDefault(SegmentCompressAfter, time.Hour)
+	viper.SetDefault(SegmentMaintenance, time.Minute)
+
+	viper.SetDefault(QueueCompactThreshold, 1000)
+	viper.SetDefault(QueueLimit, 1000)
+	viper.SetDefault(QueueWaitTimeout, 2*time.Second)
+	viper.SetDefault(QueueRetryAfter, 5*time.Second)
+	viper.SetDefault(QueueSpillPath, "./queue.spill")
+	viper.SetDefault(QueueSmallSetSize, 10)
+	viper.SetDefault(QueueAbandonPolicy, "cancel")
+	viper.SetDefault(QueueJobRetention, time.Hour)
+
+	viper.SetDefault(IdempotencyPath, "./idempotency.journal")
+	viper.SetDefault(IdempotencyRetention, 24*time.Hour)
+
+	viper.SetDefault(AdaptiveMin, 4)
+	viper.SetDefault(AdaptiveInterval, 5*time.Second)
+	viper.SetDefault(AdaptiveTargetLatency, 2*time.Second)
+	viper.SetDefault(AdaptiveMaxTimeoutRate, 0.1)
+
+	viper.SetDefault(WebhookOutboxPath, "./webhooks.outbox")
+	viper.SetDefault(WebhookLogPath, "./webhooks.log")
+	viper.SetDefault(WebhookTimeout, 10*time.Second)
+	viper.SetDefault(WebhookMaxAttempts, 8)
+	viper.SetDefault(WebhookInitialBackoff, 5*time.Second)
+	viper.SetDefault(WebhookMaxBackoff, 10*time.Minute)
+	viper.SetDefault(WebhookConcurrency, 8)
+
+	viper.SetDefault(SchedulerPath, "./schedules.json")
+	viper.SetDefault(SchedulerRunsPath, "./schedule_runs.log")
+	viper.SetDefault(SchedulerMinInterval, time.Minute)
+
+	viper.SetDefault(IncidentFailureThreshold, 3)
+	viper.SetDefault(IncidentStatePath, "./incidents.json")
+	viper.SetDefault(IncidentLogPath, "./incidents.log")
+	viper.SetDefault(IncidentReportWindow, 30*24*time.Hour)
+	viper.SetDefault(IncidentPendingWindow, 6*time.Hour)
+	viper.SetDefault(IncidentPendingDomains, 10000)
+
+	viper.SetDefault(AlertTimeout, 10*time.Second)
+
+	viper.SetDefault(LeaseDuration, 30*time.Second)
+	viper.SetDefault(LeasePollTimeout, 20*time.Second)
+
+	viper.SetDefault(WorkerConcurrency, 1)
+
+	viper.SetDefault(ProbeLocation, "local")
+	viper.SetDefault(ProbeTimeout, 4*time.Second)
+	viper.SetDefault(ProbePollTimeout, 20*time.Second)
+	viper.SetDefault(ProbeAgentTTL, time.Minute)
+}
+
 func ValidateConfigFields() error {
-	required := []string{ApiPort, LogFilePath, LinksFilePath, QueueFilePath, QueueWorkers, WorkersRatio, MaxWorkers}
+	if err := checkRequired(ApiPort, LogFilePath, LinksFilePath, QueueFilePath, QueueWorkers, WorkersRatio, MaxWorkers); err != nil {
+		return err
+	}
+
+	switch viper.GetString(StorageBackend) {
+	case "file", "bolt":
+	default:
+		return fmt.Errorf("key \"%s\" must be one of: file, bolt", StorageBackend)
+	}
+	if path := filepath.Clean(viper.GetString(BoltPath)); path == filepath.Clean(viper.GetString(LinksFilePath)) ||
+		path == filepath.Clean(viper.GetString(IndexPath)) {
+		return fmt.Errorf("key \"%s\" must differ from \"%s\" and \"%s\"", BoltPath, LinksFilePath, IndexPath)
+	}
+
+	if viper.GetDuration(LockWait) < 0 {
+		return fmt.Errorf("key \"%s\" must not be negative", LockWait)
+	}
+	if viper.GetInt(HistoryDomains) < 0 || viper.GetDuration(HistoryKeep) < 0 {
+		return fmt.Errorf("keys \"%s\" and \"%s\" must not be negative", HistoryDomains, HistoryKeep)
+	}
+
+	for _, key := range []string{SegmentMaxAge, SegmentCompressAfter, SegmentRetention} {
+		if viper.GetDuration(key) < 0 {
+			return fmt.Errorf("key \"%s\" must not be negative", key)
+		}
+	}
+	if viper.GetInt(SegmentMaxSize) < 0 {
+		return fmt.Errorf("key \"%s\" must not be negative", SegmentMaxSize)
+	}
+	if viper.GetDuration(SegmentMaintenance) <= 0 {
+		return fmt.Errorf("key \"%s\" must be greater than 0", SegmentMaintenance)
+	}
+
+	if path := viper.GetString(IndexPath); path != "" && filepath.Clean(path) == filepath.Clean(viper.GetString(LinksFilePath)) {
+		return fmt.Errorf("key \"%s\" must differ from \"%s\"", IndexPath, LinksFilePath)
+	}
+
+	if viper.GetInt(ApiMaxSetSize) <= 0 {
+		return fmt.Errorf("key \"%s\" must be greater than 0", ApiMaxSetSize)
+	}
+
+	if viper.GetInt(QueueLimit) <= 0 {
+		return fmt.Errorf("key \"%s\" must be greater than 0", QueueLimit)
+	}
+
+	if threshold := viper.GetFloat64(HealthQueueThreshold); threshold <= 0 || threshold > 1 {
+		return fmt.Errorf("key \"%s\" must be greater than 0 and at most 1", HealthQueueThreshold)
+	}
+
+	switch viper.GetString(TracingExporter) {
+	case "none", "stdout", "otlp":
+	default:
+		return fmt.Errorf("key \"%s\" must be one of: none, stdout, otlp", TracingExporter)
+	}
+
+	if ratio := viper.GetFloat64(TracingSampleRatio); ratio < 0 || ratio > 1 {
+		return fmt.Errorf("key \"%s\" must be between 0 and 1", TracingSampleRatio)
+	}
+
+	switch viper.GetString(QueueAbandonPolicy) {
+	case "continue", "cancel", "downgrade":
+	default:
+		return fmt.Errorf("key \"%s\" must be one of: continue, cancel, downgrade", QueueAbandonPolicy)
+	}
+
+	if viper.GetInt(WebhookConcurrency) <= 0 {
+		return fmt.Errorf("key \"%s\" must be greater than 0", WebhookConcurrency)
+	}
+
+	if viper.GetInt(IncidentFailureThreshold) <= 0 {
+		return fmt.Errorf("key \"%s\" must be greater than 0", IncidentFailureThreshold)
+	}
+	if viper.GetDuration(IncidentPendingWindow) <= 0 || viper.GetInt(IncidentPendingDomains) <= 0 {
+		return fmt.Errorf("keys \"%s\" and \"%s\" must be greater than 0", IncidentPendingWindow, IncidentPendingDomains)
+	}
+
+	if viper.GetDuration(LeaseDuration) <= 0 {
+		return fmt.Errorf("key \"%s\" must be greater than 0", LeaseDuration)
+	}
+
+	if viper.GetInt(ProbeQuorum) < 0 {
+		return fmt.Errorf("key \"%s\" must not be negative", ProbeQuorum)
+	}
+
+	if viper.GetInt(WorkersRatio) == 0 {
+		return fmt.Errorf("key \"%s\" must not be 0", WorkersRatio)
+	} // Division by zero prevention
+
+	return validateAdaptive()
+}
+
+func ValidateWorkerConfigFields() error {
+	if err := checkRequired(LogFilePath, WorkerCoordinator, WorkerToken, WorkersRatio, MaxWorkers); err != nil {
+		return err
+	}
+
+	if viper.GetInt(WorkerConcurrency) <= 0 {
+		return fmt.Errorf("key \"%s\" must be greater than 0", WorkerConcurrency)
+	}
+
+	if viper.GetInt(WorkersRatio) == 0 {
+		return fmt.Errorf("key \"%s\" must not be 0", WorkersRatio)
+	} // Division by zero prevention
+
+	return validateAdaptive()
+}
+
+func ValidateProbeConfigFields() error {
+	if err := checkRequired(LogFilePath, ProbeAgentCoordinator, ProbeAgentToken, ProbeAgentLocation, WorkersRatio, MaxWorkers); err != nil {
+		return err
+	}
+
+	if viper.GetInt(WorkersRatio) == 0 {
+		return fmt.Errorf("key \"%s\" must not be 0", WorkersRatio)
+	} // Division by zero prevention
+
+	return validateAdaptive()
+}
+
+// validateAdaptive checks bounds of adaptive checker concurrency, it's used by checks of every process
+func validateAdaptive() error {
+	if !viper.GetBool(AdaptiveEnabled) {
+		return nil
+	}
+
+	minLimit, maxLimit := viper.GetInt(AdaptiveMin), viper.GetInt(AdaptiveMax)
+	if maxLimit == 0 {
+		maxLimit = viper.GetInt(MaxWorkers)
+	}
+	if minLimit <= 0 || maxLimit < minLimit {
+		return fmt.Errorf("keys \"%s\" and \"%s\" must satisfy 0 < min <= max", AdaptiveMin, AdaptiveMax)
+	}
+
+	if viper.GetDuration(AdaptiveInterval) <= 0 || viper.GetDuration(AdaptiveTargetLatency) <= 0 {
+		return fmt.Errorf("keys \"%s\" and \"%s\" must be greater than 0", AdaptiveInterval, AdaptiveTargetLatency)
+	}
+
+	if rate := viper.GetFloat64(AdaptiveMaxTimeoutRate); rate < 0 || rate >= 1 {
+		return fmt.Errorf("key \"%s\" must be at least 0 and less than 1", AdaptiveMaxTimeoutRate)
+	}
+
+	return nil
+}
+
+func checkRequired(required ...string) error {
 	var missing []string
 
 	for _, key := range required {
@@ -61,13 +406,74 @@ func ValidateConfigFields() error {
 		}
 	}
 
-	if viper.GetInt(WorkersRatio) == 0 {
-		return fmt.Errorf("key \"%s\" must not be 0", WorkersRatio)
-	} // Division by zero prevention
-
 	return nil
 }
 
+// SetsPath returns path of the file link sets are stored in by the configured backend
+func SetsPath() string {
+	if viper.GetString(StorageBackend) == "bolt" {
+		return viper.GetString(BoltPath)
+	}
+	return viper.GetString(LinksFilePath)
+}
+
+// APIKey describes a known API client
+type APIKey struct {
+	Name     string `mapstructure:"name"`
+	Priority string `mapstructure:"priority"` // low, normal or high
+	Weight   int    `mapstructure:"weight"`
+	Tier     string `mapstructure:"tier"` // Rate limit tier, default tier is used if empty
+}
+
+// GetAPIKeys returns known API keys, malformed section is treated as empty
+func GetAPIKeys() map[string]APIKey {
+	keys := make(map[string]APIKey)
+	if err := viper.UnmarshalKey(ApiKeys, &keys); err != nil {
+		log.Printf("Failed to parse \"%s\": %v", ApiKeys, err)
+	}
+	return keys
+}
+
+// RateLimitTier describes limits of a group of clients, zero means no limit
+type RateLimitTier struct {
+	RequestsPerMinute int `mapstructure:"requests_per_minute"`
+	RequestsBurst     int `mapstructure:"requests_burst"`     // Requests allowed at once, requests_per_minute if not set
+	DomainsPerMinute  int `mapstructure:"domains_per_minute"` // Links submitted for checking, up to a minute's worth at once
+	MaxSetSize        int `mapstructure:"max_set_size"`
+}
+
+// GetRateLimitTiers returns configured tiers, malformed section is treated as empty
+func GetRateLimitTiers() map[string]RateLimitTier {
+	tiers := make(map[string]RateLimitTier)
+	if err := viper.UnmarshalKey(RateLimitTiers, &tiers); err != nil {
+		log.Printf("Failed to parse \"%s\": %v", RateLimitTiers, err)
+	}
+	return tiers
+}
+
+// AlertNotifier describes where status change alerts are sent, fields used depend on Type
+type AlertNotifier struct {
+	Type     string   `mapstructure:"type"`     // webhook, smtp, file or exec
+	URL      string   `mapstructure:"url"`      // webhook
+	Secret   string   `mapstructure:"secret"`   // webhook, optional
+	Addr     string   `mapstructure:"addr"`     // smtp, host:port
+	Username string   `mapstructure:"username"` // smtp, optional
+	Password string   `mapstructure:"password"` // smtp
+	From     string   `mapstructure:"from"`     // smtp
+	To       []string `mapstructure:"to"`       // smtp
+	Path     string   `mapstructure:"path"`     // file
+	Command  []string `mapstructure:"command"`  // exec
+}
+
+// GetAlertNotifiers returns configured notifiers, malformed section is treated as empty
+func GetAlertNotifiers() []AlertNotifier {
+	var notifiers []AlertNotifier
+	if err := viper.UnmarshalKey(AlertNotifiers, &notifiers); err != nil {
+		log.Printf("Failed to parse \"%s\": %v", AlertNotifiers, err)
+	}
+	return notifiers
+}
+
 func MuteFxLog() fx.Option {
 	if yaml.GetBool(DefaultConfigLocation, MuteFx) {
 		return fx.Options(fx.NopLogger)
@@ -7,9 +7,13 @@ import (
 	"link-availability-checker/internal/api/controllers"
 	"link-availability-checker/internal/config"
 	"link-availability-checker/internal/logger"
+	"link-availability-checker/internal/probe"
 	"link-availability-checker/internal/services"
 	"link-availability-checker/internal/storage"
+	"link-availability-checker/internal/tracing"
+	"link-availability-checker/internal/worker"
 	"link-availability-checker/pkg/filestore"
+	"link-availability-checker/pkg/journal"
 )
 
 func Load() *fx.App {
@@ -18,14 +22,30 @@ func Load() *fx.App {
 		fx.Invoke(
 			config.LoadConfig,
 			logger.SetupLogging,
+			filestore.LockDataDir,
+			tracing.Setup,
 		),
 		fx.Provide(
-			filestore.NewFileStorer,
+			filestore.NewHistoryStore,
 			storage.NewLinkStorage,
+			storage.NewHistoryStorage,
+			journal.NewJournal,
 			services.NewAvailabilityService,
+			services.NewAlertService,
+			services.NewIncidentService,
+			services.NewHistoryService,
+			services.NewProbeService,
+			services.NewWebhookService,
 			services.NewLinkService,
+			services.NewSchedulerService,
+			services.NewHealthService,
 			controllers.NewLinkController,
 			controllers.NewSystemController,
+			controllers.NewMonitoringController,
+			controllers.NewWorkerController,
+			controllers.NewProbeController,
+			controllers.NewMetricsController,
+			controllers.NewHealthController,
 			api.NewEngine,
 		),
 		fx.Invoke(
@@ -34,3 +54,48 @@ func Load() *fx.App {
 		),
 	)
 }
+
+// LoadMigration builds a one-off process, which copies link sets of links file into bbolt database and exits
+func LoadMigration() *fx.App {
+	return fx.New(
+		config.MuteFxLog(),
+		fx.Invoke(
+			config.LoadConfig,
+			logger.SetupLogging,
+			filestore.LockDataDir,
+			storage.MigrateToBolt,
+		),
+	)
+}
+
+// LoadWorker builds a worker process, which checks tasks leased from the coordinator instead of serving the API
+func LoadWorker() *fx.App {
+	return fx.New(
+		config.MuteFxLog(),
+		fx.Invoke(
+			config.LoadWorkerConfig,
+			logger.SetupLogging,
+		),
+		fx.Provide(
+			services.NewAvailabilityService,
+			worker.New,
+		),
+		fx.Invoke(worker.Run),
+	)
+}
+
+// LoadProbe builds a probe agent, which checks domains the coordinator asks for from the agent's location
+func LoadProbe() *fx.App {
+	return fx.New(
+		config.MuteFxLog(),
+		fx.Invoke(
+			config.LoadProbeConfig,
+			logger.SetupLogging,
+		),
+		fx.Provide(
+			services.NewAvailabilityService,
+			probe.New,
+		),
+		fx.Invoke(probe.Run),
+	)
+}
@@ -0,0 +1,43 @@
+package models
+
+import "strings"
+
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+func ParsePriority(s string) (Priority, bool) {
+	switch strings.ToLower(s) {
+	case "low":
+		return PriorityLow, true
+	case "normal", "":
+		return PriorityNormal, true
+	case "high":
+		return PriorityHigh, true
+	default:
+		return PriorityNormal, false
+	}
+}
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// Client is whoever submitted a task, identified by API key or IP address
+type Client struct {
+	ID       string   `json:"id"`
+	Priority Priority `json:"priority"`       // Highest priority client is allowed to request
+	Weight   int      `json:"weight"`         // Share of queue throughput relative to other clients of the same priority
+	Tier     string   `json:"tier,omitempty"` // Rate limit tier
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// CheckResult is an outcome of a single domain availability check
+type CheckResult struct {
+	Available bool
+	Reason    string // "ok" or what made the domain unavailable: HTTP status, DNS or connection error
+	Latency   time.Duration
+	Verdicts  []Verdict // Set if the result was decided by quorum of vantage points
+}
+
+// CheckRecord is a check result stored in domain history
+type CheckRecord struct {
+	Domain    string        `json:"domain"`
+	Time      time.Time     `json:"time"`
+	Available bool          `json:"available"`
+	Reason    string        `json:"reason"`
+	Latency   time.Duration `json:"latency"`
+}
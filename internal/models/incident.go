@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Incident is an outage of a domain, it's open from the first failed check until the domain recovers
+type Incident struct {
+	ID          string     `json:"id"`
+	Domain      string     `json:"domain"`
+	Start       time.Time  `json:"start"` // Time of the first failed check
+	End         *time.Time `json:"end,omitempty"`
+	FirstReason string     `json:"first_reason"`
+	LastReason  string     `json:"last_reason"`
+	Checks      int        `json:"checks"`            // Failed checks made during the incident
+	Alerted     bool       `json:"alerted,omitempty"` // Opening was alerted, so recovery is alerted too
+}
+
+func (i *Incident) Open() bool { return i.End == nil }
+
+// Duration returns how long the incident lasted, open incidents are measured until now
+func (i *Incident) Duration(now time.Time) time.Duration {
+	if i.End != nil {
+		return i.End.Sub(i.Start)
+	}
+	return now.Sub(i.Start)
+}
@@ -1,13 +1,37 @@
 package models
 
+import "time"
+
 type Link struct {
-	Domain string
-	Status bool
+	Domain   string
+	Status   bool
+	Skipped  bool      `json:",omitempty"` // Link was not checked because the check was canceled
+	Verdicts []Verdict `json:",omitempty"` // Results of every vantage point the status was decided from
+}
+
+// Verdict is a result of a link seen from one vantage point, i.e. the server itself or a probe agent
+type Verdict struct {
+	Agent    string
+	Location string `json:",omitempty"`
+	Status   bool
+	Reason   string `json:",omitempty"`
 }
 
 type Set struct {
-	Number int
-	Links  []Link
+	Number   int
+	Links    []Link
+	Canceled bool `json:",omitempty"` // Check was canceled, set contains partial results
+	Deleted  bool `json:",omitempty"` // Tombstone of a deleted set, it's never returned by storage
+}
+
+// MaintenanceReport describes what a maintenance run of links file segments did
+type MaintenanceReport struct {
+	Sealed      bool  // Active segment was sealed by age
+	Expired     int   // Segments removed by retention
+	ExpiredSets int   // Sets dropped with them
+	Compacted   int   // Segments rewritten without deleted and duplicate records
+	Reclaimed   int64 // Bytes freed by compaction
+	Compressed  int
 }
 
 func (s *Set) ConvertLinksToStrMap() map[string]string {
@@ -18,11 +42,18 @@ func (s *Set) ConvertLinksToStrMap() map[string]string {
 		//} else {
 		//	result[link.Domain] = "not available"
 		//}
-		result[link.Domain] = ConvertStatusToString(link.Status)
+		result[link.Domain] = link.StatusString()
 	}
 	return result
 }
 
+func (l Link) StatusString() string {
+	if l.Skipped {
+		return "not checked"
+	}
+	return ConvertStatusToString(l.Status)
+}
+
 func ConvertStatusToString(status bool) string {
 	if status {
 		return "available"
@@ -30,3 +61,14 @@ func ConvertStatusToString(status bool) string {
 		return "not available"
 	}
 }
+
+// QuarantinedRecord is a damaged record found in links file, its bytes are kept aside for inspection
+type QuarantinedRecord struct {
+	ID      string
+	Segment string // File the record was found in
+	Offset  int64
+	Length  int64
+	Reason  string
+	Number  int // Set number salvaged from the bytes, 0 if unknown
+	Time    time.Time
+}
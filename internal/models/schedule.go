@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Watchlist is a named list of domains that can be checked on schedule
+type Watchlist struct {
+	Name    string   `json:"name"`
+	Domains []string `json:"domains"`
+}
+
+// Schedule re-checks a stored set or a watchlist either every Interval or by Cron expression
+type Schedule struct {
+	ID        string        `json:"id"`
+	SetNumber int           `json:"set_number,omitempty"`
+	Watchlist string        `json:"watchlist,omitempty"`
+	Interval  time.Duration `json:"interval,omitempty"`
+	Cron      string        `json:"cron,omitempty"`
+	Priority  Priority      `json:"priority"`
+	CreatedAt time.Time     `json:"created_at"`
+	LastRun   time.Time     `json:"last_run,omitempty"`
+	NextRun   time.Time     `json:"next_run"`
+}
+
+// ScheduleRun is a single execution of a schedule, its result is stored as a new set. Set number is reserved only when
+// the job is started, so it's logged once the job finishes as a separate entry without schedule ID.
+type ScheduleRun struct {
+	ScheduleID string    `json:"schedule_id,omitempty"`
+	JobID      string    `json:"job_id,omitempty"`
+	SetNumber  int       `json:"set_number,omitempty"`
+	Time       time.Time `json:"time"`
+	Error      string    `json:"error,omitempty"`
+}
@@ -0,0 +1,181 @@
+package probe
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/api/middlewares"
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/services"
+	"link-availability-checker/internal/utils/apiclient"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+// Agent checks domains the coordinator asks for from its own location, so that the coordinator can tell a real outage
+// from a problem of its own network
+type Agent struct {
+	as       services.AvailabilityService
+	client   *apiclient.Client
+	id       string
+	location string
+
+	stop    chan struct{}
+	ctx     context.Context // Canceled on stop, interrupts polls and checks in progress
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	checkWg sync.WaitGroup
+}
+
+func New(as services.AvailabilityService) *Agent {
+	id := viper.GetString(config.ProbeAgentID)
+	if id == "" {
+		host, _ := os.Hostname()
+		id = host + "-" + strconv.Itoa(os.Getpid())
+	}
+
+	a := &Agent{
+		as:       as,
+		client:   apiclient.New(viper.GetString(config.ProbeAgentCoordinator), middlewares.ProbeTokenHeader, viper.GetString(config.ProbeAgentToken)),
+		id:       id,
+		location: viper.GetString(config.ProbeAgentLocation),
+		stop:     make(chan struct{}),
+	}
+	a.ctx, a.cancel = context.WithCancel(context.Background())
+	return a
+}
+
+func Run(lc fx.Lifecycle, a *Agent) {
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			log.Printf("[PROBE] Agent %s (%s) is probing for %s", a.id, a.location, a.client.BaseURL())
+			a.wg.Add(1)
+			go a.loop()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			log.Println("[PROBE] Stopping...")
+			close(a.stop)
+			a.cancel() // Coordinator decides without results that didn't make it
+			a.wg.Wait()
+			a.checkWg.Wait()
+			return nil
+		},
+	})
+}
+
+func (a *Agent) loop() {
+	defer a.wg.Done()
+
+	registered := false
+	backoff := time.Second
+	for {
+		select {
+		case <-a.stop:
+			return
+		default:
+		}
+
+		var err error
+		if !registered {
+			err = a.register()
+			registered = err == nil
+		}
+		if err == nil {
+			var requests []apiModels.ProbeRequest
+			requests, registered, err = a.poll()
+			for _, r := range requests {
+				a.checkWg.Add(1)
+				go a.check(r)
+			}
+		}
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+
+		if a.ctx.Err() != nil {
+			return
+		}
+		log.Printf("[PROBE] Failed to reach coordinator, retrying in %s: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-a.stop:
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (a *Agent) register() error {
+	ctx, cancel := context.WithTimeout(a.ctx, requestTimeout)
+	defer cancel()
+
+	_, err := a.client.Post(ctx, "/probes/register", apiModels.ProbeRegisterRequest{AgentID: a.id, Location: a.location}, nil)
+	if err == nil {
+		log.Printf("[PROBE] Registered with coordinator")
+	}
+	return err
+}
+
+// poll waits for probe requests, registered is false if the coordinator doesn't know the agent, e.g. after restart
+func (a *Agent) poll() (requests []apiModels.ProbeRequest, registered bool, err error) {
+	var resp apiModels.ProbePollResponse
+	status, err := a.client.Post(a.ctx, "/probes/poll", apiModels.ProbePollRequest{AgentID: a.id}, &resp, http.StatusNotFound)
+	if err != nil {
+		return nil, true, err
+	}
+	if status == http.StatusNotFound {
+		return nil, false, nil
+	}
+	return resp.Requests, true, nil
+}
+
+// check checks domains of the request and reports results, domains not checked by deadline are left out
+func (a *Agent) check(r apiModels.ProbeRequest) {
+	defer a.checkWg.Done()
+
+	// Clocks of the agent and the coordinator may differ, so the deadline is only trusted as far as check timeout
+	timeout := min(time.Until(r.Deadline), services.SetCheckTimeout)
+	if timeout <= 0 {
+		timeout = services.SetCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(a.ctx, timeout)
+	defer cancel()
+
+	var mutex sync.Mutex
+	results := make([]apiModels.ProbeResult, 0, len(r.Domains))
+	_, _ = services.CheckDomains(ctx, a.as, r.Domains, func(i int, res models.CheckResult) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		results = append(results, apiModels.ProbeResult{Index: i, Status: res.Available, Reason: res.Reason})
+	})
+	if a.ctx.Err() != nil {
+		return
+	}
+
+	reportCtx, reportCancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer reportCancel()
+
+	status, err := a.client.Post(reportCtx, "/probes/requests/"+r.RequestID+"/results",
+		apiModels.ProbeResultsRequest{AgentID: a.id, Results: results}, nil, http.StatusGone)
+	switch {
+	case err != nil:
+		log.Printf("[PROBE] Failed to report results of request %s: %v", r.RequestID, err)
+	case status == http.StatusGone:
+		log.Printf("[PROBE] Results of request %s came too late", r.RequestID)
+	}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/pkg/notify"
+)
+
+// AlertService notifies about domains going down and coming back, i.e. incidents being opened and closed
+type AlertService interface {
+	// Notify sends alert about incident opened or closed by check made at the given time
+	Notify(incident models.Incident, at time.Time)
+}
+
+type AlertServiceImpl struct {
+	notifiers []notify.Notifier
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewAlertService(lc fx.Lifecycle) AlertService {
+	svc := &AlertServiceImpl{stop: make(chan struct{})}
+
+	for _, n := range config.GetAlertNotifiers() {
+		switch n.Type {
+		case "webhook":
+			svc.notifiers = append(svc.notifiers, &notify.Webhook{URL: n.URL, Secret: n.Secret, Client: &http.Client{}})
+		case "smtp":
+			svc.notifiers = append(svc.notifiers, &notify.SMTP{Addr: n.Addr, Username: n.Username, Password: n.Password, From: n.From, To: n.To})
+		case "file":
+			svc.notifiers = append(svc.notifiers, &notify.File{Path: n.Path})
+		case "exec":
+			svc.notifiers = append(svc.notifiers, &notify.Exec{Command: n.Command})
+		default:
+			log.Printf("[ALERTS] Skipping notifier of unknown type %q", n.Type)
+		}
+	}
+
+	lc.Append(fx.Hook{OnStop: svc.shutdown})
+	return svc
+}
+
+func (svc *AlertServiceImpl) Notify(incident models.Incident, at time.Time) {
+	alert := notify.Alert{
+		Domain:    incident.Domain,
+		Event:     notify.EventDown,
+		Reason:    incident.LastReason,
+		Failures:  incident.Checks,
+		DownSince: incident.Start,
+		Duration:  incident.Duration(at),
+		Time:      at,
+	}
+	if !incident.Open() {
+		alert.Event = notify.EventUp
+	}
+	svc.send(alert)
+}
+
+// send delivers alert to every notifier in background, failed deliveries are only logged
+func (svc *AlertServiceImpl) send(alert notify.Alert) {
+	log.Printf("[ALERTS] %s", alert.Subject())
+
+	for _, n := range svc.notifiers {
+		svc.wg.Add(1)
+		go func() {
+			defer svc.wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration(config.AlertTimeout))
+			defer cancel()
+			go func() {
+				select {
+				case <-svc.stop:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			if err := n.Notify(ctx, alert); err != nil {
+				log.Printf("[ALERTS] Failed to send alert about %s via %s: %v", alert.Domain, n.Name(), err)
+			}
+		}()
+	}
+}
+
+func (svc *AlertServiceImpl) shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		svc.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		close(svc.stop) // Interrupt deliveries still in progress
+		<-done
+	}
+	return nil
+}
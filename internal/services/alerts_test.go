@@ -0,0 +1,273 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/pkg/notify"
+)
+
+// recordingAlerts remembers incidents AlertService is asked to notify about
+type recordingAlerts struct {
+	mutex     sync.Mutex
+	incidents []models.Incident
+}
+
+func (a *recordingAlerts) Notify(incident models.Incident, _ time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.incidents = append(a.incidents, incident)
+}
+
+func (a *recordingAlerts) take() []models.Incident {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	incidents := a.incidents
+	a.incidents = nil
+	return incidents
+}
+
+// newTestIncidentService creates incident service monitoring example.com, a.example and b.example
+func newTestIncidentService(t *testing.T, threshold int) (IncidentService, *recordingAlerts) {
+	t.Helper()
+	dir := t.TempDir()
+	viper.Set(config.IncidentFailureThreshold, threshold)
+	viper.Set(config.IncidentPendingWindow, time.Hour)
+	viper.Set(config.IncidentPendingDomains, 3)
+	viper.Set(config.IncidentStatePath, filepath.Join(dir, "incidents.json"))
+	viper.Set(config.IncidentLogPath, filepath.Join(dir, "incidents.log"))
+	t.Cleanup(viper.Reset)
+
+	alerts := &recordingAlerts{}
+	svc, err := NewIncidentService(alerts)
+	if err != nil {
+		t.Fatalf("NewIncidentService: %v", err)
+	}
+	svc.Monitor([]string{"example.com", "a.example", "b.example"})
+	return svc, alerts
+}
+
+func checkRecord(domain string, available bool, at time.Time) []models.CheckRecord {
+	r := models.CheckRecord{Domain: domain, Available: available, Time: at}
+	if !available {
+		r.Reason = "timeout"
+	}
+	return []models.CheckRecord{r}
+}
+
+func TestAlertAfterThresholdOfConsecutiveFailures(t *testing.T) {
+	svc, alerts := newTestIncidentService(t, 3)
+	start := time.Now()
+
+	for i := 0; i < 2; i++ {
+		svc.Observe(checkRecord("example.com", false, start.Add(time.Duration(i)*time.Minute)))
+	}
+	if got := alerts.take(); len(got) != 0 {
+		t.Fatalf("alert fired before threshold: %+v", got)
+	}
+
+	svc.Observe(checkRecord("example.com", false, start.Add(2*time.Minute)))
+	got := alerts.take()
+	if len(got) != 1 || !got[0].Open() {
+		t.Fatalf("got %+v, want one opened incident", got)
+	}
+	if !got[0].Start.Equal(start) || got[0].Checks != 3 {
+		t.Errorf("incident starts at %s after %d checks, want %s after 3", got[0].Start, got[0].Checks, start)
+	}
+}
+
+func TestSuccessResetsFailureCount(t *testing.T) {
+	svc, alerts := newTestIncidentService(t, 3)
+	start := time.Now()
+
+	for i, available := range []bool{false, false, true, false, false} {
+		svc.Observe(checkRecord("example.com", available, start.Add(time.Duration(i)*time.Minute)))
+	}
+	if got := alerts.take(); len(got) != 0 {
+		t.Fatalf("interrupted failures fired alert: %+v", got)
+	}
+}
+
+func TestAlertsOnlyOnTransitions(t *testing.T) {
+	svc, alerts := newTestIncidentService(t, 2)
+	at := time.Now()
+	next := func() time.Time { at = at.Add(time.Minute); return at }
+
+	for i := 0; i < 2; i++ {
+		svc.Observe(checkRecord("example.com", false, next()))
+	}
+	if got := alerts.take(); len(got) != 1 || !got[0].Open() {
+		t.Fatalf("got %+v, want one opened incident", got)
+	}
+
+	for i := 0; i < 5; i++ {
+		svc.Observe(checkRecord("example.com", false, next()))
+	}
+	if got := alerts.take(); len(got) != 0 {
+		t.Fatalf("ongoing outage fired alerts again: %+v", got)
+	}
+
+	svc.Observe(checkRecord("example.com", true, next()))
+	got := alerts.take()
+	if len(got) != 1 || got[0].Open() {
+		t.Fatalf("got %+v, want one closed incident", got)
+	}
+	if got[0].Checks != 7 {
+		t.Errorf("closed incident has %d failed checks, want 7", got[0].Checks)
+	}
+
+	for i := 0; i < 3; i++ {
+		svc.Observe(checkRecord("example.com", true, next()))
+	}
+	if got = alerts.take(); len(got) != 0 {
+		t.Fatalf("available domain fired alerts: %+v", got)
+	}
+}
+
+func TestAlertsAreTrackedPerDomain(t *testing.T) {
+	svc, alerts := newTestIncidentService(t, 2)
+	at := time.Now()
+
+	svc.Observe(append(checkRecord("a.example", false, at), checkRecord("B.example ", false, at)...))
+	svc.Observe(append(checkRecord("a.example", false, at.Add(time.Minute)), checkRecord("b.example", true, at.Add(time.Minute))...))
+
+	got := alerts.take()
+	if len(got) != 1 || got[0].Domain != "a.example" {
+		t.Fatalf("got %+v, want incident of a.example only", got)
+	}
+}
+
+func TestNoAlertsForUnmonitoredDomains(t *testing.T) {
+	svc, alerts := newTestIncidentService(t, 2)
+	at := time.Now()
+	next := func() time.Time { at = at.Add(time.Minute); return at }
+
+	for i := 0; i < 3; i++ {
+		svc.Observe(checkRecord("submitted.example", false, next()))
+	}
+	if got := alerts.take(); len(got) != 0 {
+		t.Fatalf("unmonitored domain fired alerts: %+v", got)
+	}
+	open, err := svc.GetIncidents(IncidentFilter{Domain: "submitted.example", State: "open"})
+	if err != nil || len(open) != 1 {
+		t.Fatalf("got incidents %+v (%v), want one open incident of unmonitored domain", open, err)
+	}
+
+	// Recovery isn't alerted without alerted outage, even if the domain became monitored in between
+	svc.Monitor([]string{"submitted.example"})
+	svc.Observe(checkRecord("submitted.example", true, next()))
+	if got := alerts.take(); len(got) != 0 {
+		t.Fatalf("recovery of outage that wasn't alerted fired alerts: %+v", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		svc.Observe(checkRecord("Submitted.example", false, next()))
+	}
+	if got := alerts.take(); len(got) != 1 || got[0].Domain != "submitted.example" {
+		t.Fatalf("got %+v, want incident of newly monitored domain", got)
+	}
+	svc.Monitor(nil)
+	svc.Observe(checkRecord("submitted.example", true, next()))
+	if got := alerts.take(); len(got) != 1 || got[0].Open() {
+		t.Fatalf("got %+v, want recovery of alerted outage", got)
+	}
+}
+
+func TestOldFailuresAreNotConsecutive(t *testing.T) {
+	svc, alerts := newTestIncidentService(t, 2)
+	start := time.Now()
+
+	svc.Observe(checkRecord("example.com", false, start.Add(-2*time.Hour)))
+	svc.Observe(checkRecord("example.com", false, start))
+	if got := alerts.take(); len(got) != 0 {
+		t.Fatalf("failures further apart than pending window fired alert: %+v", got)
+	}
+
+	svc.Observe(checkRecord("example.com", false, start.Add(time.Minute)))
+	got := alerts.take()
+	if len(got) != 1 || !got[0].Start.Equal(start) {
+		t.Fatalf("got %+v, want incident starting at %s", got, start)
+	}
+}
+
+func TestPendingFailuresAreCappedAndExpire(t *testing.T) {
+	svc, _ := newTestIncidentService(t, 5)
+	impl := svc.(*IncidentServiceImpl)
+	start := time.Now()
+
+	svc.Observe(checkRecord("old.example", false, start.Add(-2*time.Hour)))
+	for i, domain := range []string{"a.example", "b.example", "c.example", "d.example"} {
+		svc.Observe(checkRecord(domain, false, start.Add(time.Duration(i)*time.Second)))
+	}
+
+	impl.mutex.Lock()
+	defer impl.mutex.Unlock()
+	if _, ok := impl.state.Pending["old.example"]; ok {
+		t.Error("failure older than pending window is still tracked")
+	}
+	if len(impl.state.Pending) != 3 {
+		t.Errorf("tracking failures of %d domains, want limit of 3", len(impl.state.Pending))
+	}
+	if _, ok := impl.state.Pending["d.example"]; ok {
+		t.Error("failure of a domain over the limit is tracked")
+	}
+}
+
+// recordingNotifier remembers alerts it delivered, failing with err if set
+type recordingNotifier struct {
+	mutex  sync.Mutex
+	alerts []notify.Alert
+	err    error
+}
+
+func (n *recordingNotifier) Name() string { return "recording" }
+
+func (n *recordingNotifier) Notify(_ context.Context, alert notify.Alert) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.alerts = append(n.alerts, alert)
+	return n.err
+}
+
+func TestAlertServiceSendsToEveryNotifier(t *testing.T) {
+	viper.Set(config.AlertTimeout, time.Second)
+	t.Cleanup(viper.Reset)
+
+	failing := &recordingNotifier{err: errors.New("unreachable")}
+	working := &recordingNotifier{}
+	svc := &AlertServiceImpl{notifiers: []notify.Notifier{failing, working}, stop: make(chan struct{})}
+
+	start := time.Now().Add(-time.Hour)
+	end := time.Now()
+	incident := models.Incident{Domain: "example.com", Start: start, LastReason: "timeout", Checks: 4}
+	svc.Notify(incident, start.Add(time.Minute))
+	incident.End = &end
+	svc.Notify(incident, end)
+	if err := svc.shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	for _, n := range []*recordingNotifier{failing, working} {
+		if len(n.alerts) != 2 {
+			t.Fatalf("notifier got %d alerts, want 2", len(n.alerts))
+		}
+	}
+	events := map[notify.Event]notify.Alert{}
+	for _, a := range working.alerts {
+		events[a.Event] = a
+	}
+	if down := events[notify.EventDown]; down.Duration != time.Minute || down.Failures != 4 || down.Reason != "timeout" {
+		t.Errorf("unexpected down alert %+v", down)
+	}
+	if up := events[notify.EventUp]; up.Duration != end.Sub(start) || !up.DownSince.Equal(start) {
+		t.Errorf("unexpected up alert %+v", up)
+	}
+}
@@ -6,18 +6,30 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"link-availability-checker/internal/models"
 	"link-availability-checker/internal/utils/closer"
 )
 
 type AvailabilityService interface {
-	CheckDomainAvailability(ctx context.Context, domain string) (bool, error)
+	// CheckDomainAvailability returns error only if ctx is done, unavailability reason is reported in the result
+	CheckDomainAvailability(ctx context.Context, domain string) (models.CheckResult, error)
+	// CheckResolver resolves domain with the resolver used by checks, to tell failing domains from failing resolver
+	CheckResolver(ctx context.Context, domain string) error
+	// PoolSize returns number of goroutines checking a set of n domains
+	PoolSize(n int) int
+	ConcurrencyState() ConcurrencyState
 }
 
 type AvailabilityServiceImpl struct {
 	httpClient  *http.Client
 	dnsResolver *net.Resolver
+	concurrency *concurrencyController
 }
 
 func NewAvailabilityService() AvailabilityService {
@@ -35,26 +47,64 @@ func NewAvailabilityService() AvailabilityService {
 			d := net.Dialer{Timeout: time.Second * 4}
 			return d.DialContext(ctx, "udp", "1.1.1.1:53")
 		},
-	}}
+	}, concurrency: newConcurrencyController()}
 }
 
-func (svc *AvailabilityServiceImpl) CheckDomainAvailability(ctx context.Context, domain string) (bool, error) {
-	// Try to resolve DNS first and skip HTTP request if domain does not exist
+func (svc *AvailabilityServiceImpl) CheckDomainAvailability(ctx context.Context, domain string) (models.CheckResult, error) {
+	ctx, span := tracer.Start(ctx, "CheckDomainAvailability", trace.WithAttributes(attribute.String("domain", domain)))
+	if err := svc.concurrency.acquire(ctx); err != nil {
+		endSpan(span, err)
+		return models.CheckResult{}, err
+	}
+
+	start := time.Now()
+	available, reason, err := svc.check(ctx, domain)
+	latency := time.Since(start)
+	svc.concurrency.release(reason, latency, err)
+
+	span.SetAttributes(attribute.Bool("domain.available", available), attribute.String("check.reason", reason))
+	endSpan(span, err)
+	return models.CheckResult{Available: available, Reason: reason, Latency: latency}, err
+}
+
+func (svc *AvailabilityServiceImpl) PoolSize(n int) int {
+	return svc.concurrency.poolSize(n)
+}
+
+func (svc *AvailabilityServiceImpl) ConcurrencyState() ConcurrencyState {
+	return svc.concurrency.state()
+}
+
+func (svc *AvailabilityServiceImpl) CheckResolver(ctx context.Context, domain string) error {
 	_, err := svc.dnsResolver.LookupIPAddr(ctx, domain)
+	return err
+}
+
+func (svc *AvailabilityServiceImpl) check(ctx context.Context, domain string) (bool, string, error) {
+	// Try to resolve DNS first and skip HTTP request if domain does not exist
+	dnsCtx, step := startProbe(ctx, "dns")
+	_, err := svc.dnsResolver.LookupIPAddr(dnsCtx, domain)
 	if err != nil {
+		if ctx.Err() != nil {
+			step.abort(ctx.Err())
+			return false, "", ctx.Err() // Checked before DNS error since canceled lookups are reported as DNS errors too
+		}
 		var dnsErr *net.DNSError
 		if errors.As(err, &dnsErr) {
-			return false, nil // Domain does not exist
-		}
-		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-			return false, err
+			step.end("dns: " + dnsErr.Err)
+			return false, "dns: " + dnsErr.Err, nil // Domain does not exist
 		}
+		step.end("dns: " + err.Error()) // Failure of the lookup itself, HTTP request still decides
+	} else {
+		step.end("ok")
 	}
 
 	// Send HEAD request to check domain availability without downloading body
-	req, err := http.NewRequestWithContext(ctx, http.MethodHead, fmt.Sprintf("https://%s", domain), nil)
+	headCtx, step := startProbe(ctx, "head")
+	req, err := http.NewRequestWithContext(headCtx, http.MethodHead, fmt.Sprintf("https://%s", domain), nil)
 	if err != nil {
-		return false, nil
+		step.end("invalid domain")
+		return false, "invalid domain", nil
 	}
 
 	resp, err := svc.httpClient.Do(req)
@@ -72,31 +122,53 @@ func (svc *AvailabilityServiceImpl) CheckDomainAvailability(ctx context.Context,
 		//default:
 		//	return false, fmt.Errorf("failed to send GET request: %w", err)
 		//} // Treating all errors as domain not available for now
-		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-			return false, err
+		if ctx.Err() != nil {
+			step.abort(ctx.Err()) // Set deadline or cancellation, timeout of the request itself is a result
+			return false, "", ctx.Err()
 		}
-		return false, nil
+		step.end(requestErrorReason(err))
+		return false, requestErrorReason(err), nil
 	}
 	defer closer.Close(resp.Body)
+	step.end(statusReason(resp.StatusCode))
 
 	// Some servers don't support HEAD requests, fallback to GET
 	if resp.StatusCode == http.StatusMethodNotAllowed {
-		req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s", domain), nil)
+		getCtx, step := startProbe(ctx, "get")
+		req, err = http.NewRequestWithContext(getCtx, http.MethodGet, fmt.Sprintf("https://%s", domain), nil)
 		if err != nil {
-			return false, nil
+			step.end("invalid domain")
+			return false, "invalid domain", nil
 		}
 		resp, err = svc.httpClient.Do(req)
 		if err != nil {
-			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
-				return false, err
+			if ctx.Err() != nil {
+				step.abort(ctx.Err())
+				return false, "", ctx.Err()
 			}
-			return false, nil
+			step.end(requestErrorReason(err))
+			return false, requestErrorReason(err), nil
 		}
+		defer closer.Close(resp.Body)
+		step.end(statusReason(resp.StatusCode))
 	}
 
-	if resp.StatusCode == 200 {
-		return true, nil
-	} else {
-		return false, nil
+	reason := statusReason(resp.StatusCode)
+	return reason == "ok", reason, nil
+}
+
+func statusReason(code int) string {
+	if code == http.StatusOK {
+		return "ok"
+	}
+	return fmt.Sprintf("http %d", code)
+}
+
+// requestErrorReason strips request method and URL from the error, they are the same for every check
+func requestErrorReason(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
 	}
+	return err.Error()
 }
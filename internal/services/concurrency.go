@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+)
+
+// ConcurrencyState describes limit of checks running at once and recent decisions of the controller
+type ConcurrencyState struct {
+	Adaptive  bool
+	Limit     int
+	InFlight  int
+	Min       int
+	Max       int
+	Decisions []ConcurrencyDecision // Newest first
+}
+
+type ConcurrencyDecision struct {
+	Time        time.Time
+	Action      string // grow, shrink or hold
+	Reason      string
+	From        int
+	To          int
+	Samples     int
+	TimeoutRate float64
+	AvgLatency  time.Duration
+}
+
+const (
+	minWindowSamples = 10 // Fewer results say nothing about the uplink
+	keptDecisions    = 20
+)
+
+var concurrencyDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "link_checker_concurrency_decisions_total",
+	Help: "Decisions of adaptive concurrency controller",
+}, []string{"action"})
+
+// concurrencyController limits checks running at once across all sets. In adaptive mode the limit grows while checks
+// are fast and the limit is reached, and shrinks when checks time out or slow down, which usually means the uplink of
+// the server is saturated rather than that the domains are down. Otherwise only workers_ratio and workers_limit apply.
+type concurrencyController struct {
+	adaptive bool
+
+	mutex    sync.Mutex
+	limit    int
+	inFlight int
+	waiters  []chan struct{} // Handed a slot in order of arrival
+
+	windowStart time.Time
+	samples     int
+	timeouts    int
+	latencySum  time.Duration
+	latencyN    int
+	saturated   bool // Limit was reached during the window, growing makes no sense otherwise
+
+	decisions []ConcurrencyDecision
+}
+
+func newConcurrencyController() *concurrencyController {
+	c := &concurrencyController{adaptive: viper.GetBool(config.AdaptiveEnabled), windowStart: time.Now()}
+	if c.adaptive {
+		minLimit, maxLimit := adaptiveBounds()
+		c.limit = viper.GetInt(config.AdaptiveInitial)
+		if c.limit == 0 {
+			c.limit = (minLimit + maxLimit) / 2
+		}
+		c.limit = min(max(c.limit, minLimit), maxLimit)
+		log.Printf("[CHECKER] Adaptive concurrency enabled, starting with %d checks at once (%d-%d)", c.limit, minLimit, maxLimit)
+	}
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "link_checker_concurrency_limit",
+		Help: "Checks allowed to run at once",
+	}, func() float64 { return float64(c.state().Limit) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "link_checker_concurrency_in_flight",
+		Help: "Checks running at the moment",
+	}, func() float64 { return float64(c.state().InFlight) })
+	return c
+}
+
+func adaptiveBounds() (int, int) {
+	maxLimit := viper.GetInt(config.AdaptiveMax)
+	if maxLimit == 0 {
+		maxLimit = viper.GetInt(config.MaxWorkers)
+	}
+	return viper.GetInt(config.AdaptiveMin), maxLimit
+}
+
+// poolSize returns number of goroutines checking a set of n domains
+func (c *concurrencyController) poolSize(n int) int {
+	var size int
+	if c.adaptive {
+		size = min(n, c.state().Limit) // Slots are shared with other sets, extra goroutines would only wait
+	} else {
+		size = min(n/viper.GetInt(config.WorkersRatio), viper.GetInt(config.MaxWorkers)) // Validation enforces WorkersRatio > 0
+	}
+	return max(size, 1) // Sets smaller than WorkersRatio still need a worker
+}
+
+// acquire waits for a slot, it's only bounded in adaptive mode. No slot is taken once ctx is done, checks started
+// after set deadline would fail at once and look like timeouts.
+func (c *concurrencyController) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	if !c.adaptive || c.inFlight < c.limit {
+		c.inFlight++
+		if c.adaptive && c.inFlight >= c.limit {
+			c.saturated = true
+		}
+		c.mutex.Unlock()
+		return nil
+	}
+	slot := make(chan struct{})
+	c.waiters = append(c.waiters, slot)
+	c.saturated = true
+	c.mutex.Unlock()
+
+	select {
+	case <-slot:
+		if ctx.Err() == nil {
+			return nil
+		}
+	case <-ctx.Done():
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, w := range c.waiters {
+		if w == slot {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return ctx.Err()
+		}
+	}
+	c.inFlight-- // Slot was handed over in the meantime, pass it on
+	c.wake()
+	return ctx.Err()
+}
+
+// release frees the slot, result of the check feeds the controller. Only timeouts of the check's own DNS and HTTP
+// requests count as timeouts, checks interrupted by set deadline or cancellation (err is set) say nothing about the
+// uplink and are left out.
+func (c *concurrencyController) release(reason string, latency time.Duration, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.inFlight--
+	if c.adaptive && err == nil {
+		c.samples++
+		if strings.Contains(reason, "timeout") || strings.Contains(reason, "deadline exceeded") {
+			c.timeouts++
+		} else {
+			c.latencySum += latency
+			c.latencyN++
+		}
+		c.adjust()
+	}
+	c.wake()
+}
+
+// wake hands free slots to waiting checks, caller must hold the mutex
+func (c *concurrencyController) wake() {
+	for c.inFlight < c.limit && len(c.waiters) > 0 {
+		close(c.waiters[0])
+		c.waiters = c.waiters[1:]
+		c.inFlight++
+	}
+}
+
+// adjust decides on the limit once the window is over, caller must hold the mutex
+func (c *concurrencyController) adjust() {
+	if time.Since(c.windowStart) < viper.GetDuration(config.AdaptiveInterval) || c.samples < minWindowSamples {
+		return
+	}
+
+	d := ConcurrencyDecision{Time: time.Now(), Action: "hold", From: c.limit, To: c.limit, Samples: c.samples}
+	d.TimeoutRate = float64(c.timeouts) / float64(c.samples)
+	if c.latencyN > 0 {
+		d.AvgLatency = c.latencySum / time.Duration(c.latencyN)
+	}
+
+	minLimit, maxLimit := adaptiveBounds()
+	maxTimeoutRate := viper.GetFloat64(config.AdaptiveMaxTimeoutRate)
+	target := viper.GetDuration(config.AdaptiveTargetLatency)
+	switch {
+	case d.TimeoutRate > maxTimeoutRate:
+		d.Action, d.To = "shrink", c.limit*3/4 // Multiplicative decrease backs off quickly when uplink is saturated
+		d.Reason = fmt.Sprintf("%.0f%% of checks timed out, at most %.0f%% allowed", d.TimeoutRate*100, maxTimeoutRate*100)
+	case d.AvgLatency > target:
+		d.Action, d.To = "shrink", c.limit*3/4
+		d.Reason = fmt.Sprintf("average latency %s is above target %s", d.AvgLatency.Round(time.Millisecond), target)
+	case c.saturated:
+		d.Action, d.To = "grow", c.limit+max(c.limit/8, 1)
+		d.Reason = "checks are healthy and the limit was reached"
+	default:
+		d.Reason = "checks are healthy, the limit wasn't reached"
+	}
+	d.To = min(max(d.To, minLimit), maxLimit)
+	if d.To == d.From && d.Action != "hold" {
+		d.Reason += fmt.Sprintf(", limit is already at bound %d", d.To)
+		d.Action = "hold"
+	}
+
+	if d.Action != "hold" {
+		log.Printf("[CHECKER] Concurrency %d -> %d: %s", d.From, d.To, d.Reason)
+	}
+	concurrencyDecisions.WithLabelValues(d.Action).Inc()
+	c.limit = d.To
+	c.decisions = append([]ConcurrencyDecision{d}, c.decisions[:min(len(c.decisions), keptDecisions-1)]...)
+
+	c.windowStart = time.Now()
+	c.samples, c.timeouts, c.latencySum, c.latencyN = 0, 0, 0, 0
+	c.saturated = c.inFlight >= c.limit
+}
+
+func (c *concurrencyController) state() ConcurrencyState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	s := ConcurrencyState{Adaptive: c.adaptive, Limit: c.limit, InFlight: c.inFlight, Decisions: append([]ConcurrencyDecision(nil), c.decisions...)}
+	if c.adaptive {
+		s.Min, s.Max = adaptiveBounds()
+	} else {
+		s.Limit, s.Max = viper.GetInt(config.MaxWorkers), viper.GetInt(config.MaxWorkers) // Per set, not overall
+	}
+	return s
+}
@@ -0,0 +1,7 @@
+//go:build !(darwin || dragonfly || freebsd || linux || windows)
+
+package services
+
+func freeDiskSpace(string) (uint64, error) {
+	return 0, errDiskSpaceUnsupported
+}
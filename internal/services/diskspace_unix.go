@@ -0,0 +1,14 @@
+//go:build darwin || dragonfly || freebsd || linux
+
+package services
+
+import "syscall"
+
+// freeDiskSpace returns bytes available to the app on the disk of dir
+func freeDiskSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/storage"
+)
+
+// HealthService tells load balancers whether the service should get traffic. It turns not ready as soon as shutdown
+// begins, so that the balancer stops sending requests while queued tasks are drained.
+type HealthService interface {
+	BeginShutdown()
+	// Readiness runs the checks, deep checks also probe the resolver and free disk space
+	Readiness(ctx context.Context, deep bool) Readiness
+}
+
+type Readiness struct {
+	Ready  bool
+	Checks []HealthCheck
+}
+
+type HealthCheck struct {
+	Name string
+	Err  error // nil if the check passed
+}
+
+var errShuttingDown = errors.New("service is shutting down")
+
+type HealthServiceImpl struct {
+	ls       storage.LinkStorage
+	lsv      LinkService
+	as       AvailabilityService
+	stopping atomic.Bool
+}
+
+func NewHealthService(ls storage.LinkStorage, lsv LinkService, as AvailabilityService) HealthService {
+	return &HealthServiceImpl{ls: ls, lsv: lsv, as: as}
+}
+
+func (svc *HealthServiceImpl) BeginShutdown() {
+	if !svc.stopping.Swap(true) {
+		log.Println("[HEALTH] Shutdown began, reporting not ready")
+	}
+}
+
+func (svc *HealthServiceImpl) Readiness(ctx context.Context, deep bool) Readiness {
+	var shutdownErr error
+	if svc.stopping.Load() {
+		shutdownErr = errShuttingDown
+	}
+
+	checks := []HealthCheck{
+		{Name: "shutdown", Err: shutdownErr},
+		{Name: "queue", Err: svc.checkQueue()},
+		{Name: "spill", Err: svc.checkSpill()},
+		{Name: "filestore", Err: svc.checkWritable()},
+	}
+	if deep {
+		checks = append(checks,
+			HealthCheck{Name: "resolver", Err: svc.checkResolver(ctx)},
+			HealthCheck{Name: "disk", Err: checkDiskSpace()},
+		)
+	}
+
+	r := Readiness{Ready: true, Checks: checks}
+	for _, c := range checks {
+		if c.Err != nil {
+			r.Ready = false
+		}
+	}
+	return r
+}
+
+// checkQueue fails when waiting tasks fill the queue above threshold, new requests would only be rejected or spilled
+func (svc *HealthServiceImpl) checkQueue() error {
+	stats := svc.lsv.QueueStats()
+	limit := viper.GetFloat64(config.HealthQueueThreshold) * float64(stats.Capacity)
+	if waiting := stats.Depth + stats.Spilled; float64(waiting) > limit {
+		return fmt.Errorf("%d tasks waiting, threshold is %.0f", waiting, limit)
+	}
+	return nil
+}
+
+// checkSpill fails while spill queue can't be read or after spilled tasks were skipped, they only get checked after
+// restart restores them from journal
+func (svc *HealthServiceImpl) checkSpill() error {
+	stats := svc.lsv.QueueStats()
+	if stats.SpillError != nil {
+		return fmt.Errorf("spill queue can't be read: %w", stats.SpillError)
+	}
+	if stats.SpillSkipped > 0 {
+		return fmt.Errorf("%d spilled tasks couldn't be read, restart to restore them from journal", stats.SpillSkipped)
+	}
+	return nil
+}
+
+// checkWritable probes the storage backend, backends that can't tell pass
+func (svc *HealthServiceImpl) checkWritable() error {
+	if inspector, ok := svc.ls.(storage.Inspector); ok {
+		return inspector.CheckWritable()
+	}
+	return nil
+}
+
+func (svc *HealthServiceImpl) checkResolver(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+	return svc.as.CheckResolver(ctx, viper.GetString(config.HealthResolverDomain))
+}
+
+// errDiskSpaceUnsupported is returned by freeDiskSpace on platforms it can't query, the check passes there
+var errDiskSpaceUnsupported = errors.New("free disk space can't be queried on this platform")
+
+// checkDiskSpace fails if the disk of link sets has less than configured free space
+func checkDiskSpace() error {
+	available, err := freeDiskSpace(filepath.Dir(config.SetsPath()))
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get free disk space: %w", err)
+	}
+
+	free := available / (1 << 20)
+	if minFree := viper.GetUint64(config.HealthMinFreeSpace); free < minFree {
+		return fmt.Errorf("%d MB free, at least %d MB required", free, minFree)
+	}
+	return nil
+}
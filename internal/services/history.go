@@ -0,0 +1,82 @@
+package services
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/storage"
+)
+
+type HistoryService interface {
+	// Record appends check results to history of their domains and passes them to incident tracking
+	Record(records []models.CheckRecord)
+	GetUptime(domain string, from, to time.Time) (Uptime, error)
+}
+
+// Uptime summarizes domain history over a time window
+type Uptime struct {
+	Domain     string
+	From       time.Time
+	To         time.Time
+	Checks     int
+	Available  int
+	Percent    float64 // Share of checks that found domain available, 0 if there were no checks
+	Outages    int     // Number of uninterrupted runs of failed checks
+	AvgLatency time.Duration
+	LastCheck  *models.CheckRecord
+}
+
+type HistoryServiceImpl struct {
+	hs        storage.HistoryStorage
+	incidents IncidentService
+}
+
+func NewHistoryService(hs storage.HistoryStorage, is IncidentService) HistoryService {
+	return &HistoryServiceImpl{hs: hs, incidents: is}
+}
+
+func (svc *HistoryServiceImpl) Record(records []models.CheckRecord) {
+	if len(records) == 0 {
+		return
+	}
+	if err := svc.hs.AppendChecks(records); err != nil {
+		log.Printf("[HISTORY] Failed to record %d check results: %v", len(records), err)
+	}
+	svc.incidents.Observe(records)
+}
+
+func (svc *HistoryServiceImpl) GetUptime(domain string, from, to time.Time) (Uptime, error) {
+	records, err := svc.hs.GetChecks(domain, from, to)
+	if err != nil {
+		return Uptime{}, err
+	}
+	// Concurrent checks of the same domain may be appended slightly out of order
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	uptime := Uptime{Domain: domain, From: from, To: to, Checks: len(records)}
+	var latency time.Duration
+	down := false
+	for i, r := range records {
+		if r.Available {
+			uptime.Available++
+			latency += r.Latency
+			down = false
+		} else if !down {
+			uptime.Outages++
+			down = true
+		}
+		if i == len(records)-1 {
+			uptime.LastCheck = &records[i]
+		}
+	}
+
+	if uptime.Checks > 0 {
+		uptime.Percent = float64(uptime.Available) / float64(uptime.Checks) * 100
+	}
+	if uptime.Available > 0 {
+		uptime.AvgLatency = latency / time.Duration(uptime.Available) // Failed checks mostly measure timeouts
+	}
+	return uptime, nil
+}
@@ -0,0 +1,266 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/pkg/journal"
+)
+
+var ErrIdempotencyConflict = errors.New("idempotency key was used with a different request")
+
+// idempotencyStore remembers which job was created for each client's idempotency key, records are kept in a journal
+// so that retries after restart still find the original job. Set number is only reserved when the job is started, so
+// the record is journaled again once it's known.
+type idempotencyStore struct {
+	journal *journal.Journal
+
+	mutex   sync.Mutex
+	records map[string]*idempotencyRecord
+	byJob   map[string]*idempotencyRecord // Committed records by job ID
+}
+
+type idempotencyRecord struct {
+	Client    string          `json:"client"`
+	Key       string          `json:"key"`
+	Hash      string          `json:"hash"` // Hash of the request the key was first used with
+	JobID     string          `json:"job_id"`
+	SetNumber int             `json:"set_number"` // 0 until the job is started
+	Priority  models.Priority `json:"priority"`
+	CreatedAt time.Time       `json:"created_at"`
+
+	ready  chan struct{} // Closed once the job is created or creation failed
+	failed bool
+}
+
+func openIdempotencyStore() (*idempotencyStore, error) {
+	j, err := journal.Open(viper.GetString(config.IdempotencyPath), viper.GetInt(config.QueueCompactThreshold))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &idempotencyStore{journal: j, records: make(map[string]*idempotencyRecord), byJob: make(map[string]*idempotencyRecord)}
+	for _, t := range j.Pending() {
+		var rec idempotencyRecord
+		if err = json.Unmarshal(t.Payload, &rec); err != nil {
+			log.Printf("[SERVICE] Skipping unreadable idempotency record %s: %v", t.ID, err)
+			continue
+		}
+		rec.ready = make(chan struct{})
+		close(rec.ready)
+		s.records[t.ID] = &rec
+		s.byJob[rec.JobID] = &rec
+	}
+	s.expire()
+	return s, nil
+}
+
+// acquire returns record of the key, owner is true if the key is new and the caller has to create the job and then
+// commit or abort the record. Other callers get the same record and wait for it to be ready.
+func (s *idempotencyStore) acquire(client, key, hash string) (rec *idempotencyRecord, owner bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+
+	id := client + " " + key
+	if rec, ok := s.records[id]; ok {
+		if rec.Hash != hash {
+			return nil, false, ErrIdempotencyConflict
+		}
+		return rec, false, nil
+	}
+
+	rec = &idempotencyRecord{Client: client, Key: key, Hash: hash, CreatedAt: time.Now(), ready: make(chan struct{})}
+	s.records[id] = rec
+	return rec, true, nil
+}
+
+// known tells if the key is in use, including keys whose job is being created
+func (s *idempotencyStore) known(client, key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expire()
+	_, ok := s.records[client+" "+key]
+	return ok
+}
+
+// commit binds the key to the created job. number returns set number of the job, it's read under the store's mutex, so
+// that the job started in between is either seen with its number or reported to started after the record is bound.
+func (s *idempotencyStore) commit(rec *idempotencyRecord, task *linkTask, number func() int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rec.JobID, rec.SetNumber, rec.Priority = task.id, number(), task.priority
+	s.byJob[rec.JobID] = rec
+	if err := s.journal.Enqueue(rec.Client+" "+rec.Key, rec); err != nil {
+		log.Printf("[SERVICE] Failed to persist idempotency key of job %s: %v", task.id, err)
+	}
+	close(rec.ready)
+}
+
+// started records set number reserved for the job, if it was created for an idempotency key
+func (s *idempotencyStore) started(jobID string, number int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rec, ok := s.byJob[jobID]
+	if !ok || rec.SetNumber == number {
+		return
+	}
+	rec.SetNumber = number
+	if err := s.journal.Enqueue(rec.Client+" "+rec.Key, rec); err != nil {
+		log.Printf("[SERVICE] Failed to persist set number of idempotency key of job %s: %v", jobID, err)
+	}
+}
+
+// setNumber returns set number of the record's job, 0 if it wasn't started yet
+func (s *idempotencyStore) setNumber(rec *idempotencyRecord) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return rec.SetNumber
+}
+
+// abort forgets the key, so that the request can be retried
+func (s *idempotencyStore) abort(rec *idempotencyRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.records, rec.Client+" "+rec.Key)
+	rec.failed = true
+	close(rec.ready)
+}
+
+// forget drops committed record whose job is gone without a stored set, so that the request can be made again
+func (s *idempotencyStore) forget(rec *idempotencyRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := rec.Client + " " + rec.Key
+	if s.records[id] != rec {
+		return // Already replaced by another retry
+	}
+	delete(s.records, id)
+	delete(s.byJob, rec.JobID)
+	if err := s.journal.Complete(id); err != nil {
+		log.Printf("[SERVICE] Failed to forget idempotency key %q: %v", id, err)
+	}
+}
+
+// expire drops records older than retention period, caller must hold the mutex
+func (s *idempotencyStore) expire() {
+	retention := viper.GetDuration(config.IdempotencyRetention)
+	for id, rec := range s.records {
+		select {
+		case <-rec.ready:
+		default:
+			continue // Job is being created
+		}
+		if time.Since(rec.CreatedAt) > retention {
+			delete(s.records, id)
+			delete(s.byJob, rec.JobID)
+			if err := s.journal.Complete(id); err != nil {
+				log.Printf("[SERVICE] Failed to expire idempotency key %q: %v", id, err)
+			}
+		}
+	}
+}
+
+func (s *idempotencyStore) Close() error {
+	return s.journal.Close()
+}
+
+func (svc *LinkServiceImpl) HasIdempotencyKey(client, key string) bool {
+	return key != "" && svc.idempotency.known(client, key)
+}
+
+// requestHash identifies request body regardless of its formatting
+func requestHash(links *apiModels.CheckLinkSetRequest) string {
+	data, _ := json.Marshal(links) // Can't fail for a struct of strings
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// submit enqueues the task, unless the request repeats an earlier one with the same idempotency key. Repeated
+// request gets the task of the original one if it's still known, otherwise job describing the stored set.
+func (svc *LinkServiceImpl) submit(ctx context.Context, links *apiModels.CheckLinkSetRequest, client models.Client, async bool) (*linkTask, Job, error) {
+	if links.IdempotencyKey == "" {
+		task, err := svc.enqueue(ctx, links, client, async)
+		return task, Job{}, err
+	}
+
+	hash := requestHash(links)
+	for {
+		rec, owner, err := svc.idempotency.acquire(client.ID, links.IdempotencyKey, hash)
+		if err != nil {
+			return nil, Job{}, err
+		}
+
+		if owner {
+			task, err := svc.enqueue(ctx, links, client, async)
+			if task != nil { // Also the case for ErrServiceStopping, the task is journaled
+				svc.idempotency.commit(rec, task, func() int { return svc.jobNumber(task) })
+			} else {
+				svc.idempotency.abort(rec)
+			}
+			return task, Job{}, err
+		}
+
+		select {
+		case <-rec.ready:
+		case <-ctx.Done():
+			return nil, Job{}, ctx.Err()
+		}
+		if rec.failed {
+			continue // Original request was rejected, this one takes its place
+		}
+
+		if task := svc.lookupJob(rec.JobID); task != nil {
+			return task, Job{Replayed: true}, nil
+		}
+		number := svc.idempotency.setNumber(rec)
+		if number == 0 {
+			// Job was never started and isn't known anymore, e.g. its journal was lost, nothing to replay
+			log.Printf("[SERVICE] Job %s of idempotency key %q is gone without a set, accepting the request again", rec.JobID, rec.Key)
+			svc.idempotency.forget(rec)
+			continue
+		}
+
+		set, err := svc.ls.GetLinkSet(number)
+		if err != nil {
+			return nil, Job{}, err
+		}
+		job := Job{
+			ID:        rec.JobID,
+			State:     JobDone,
+			Client:    client.ID,
+			Priority:  rec.Priority,
+			Number:    set.Number,
+			Total:     len(set.Links),
+			Set:       set,
+			CreatedAt: rec.CreatedAt,
+			Replayed:  true,
+		}
+		for _, link := range set.Links {
+			if !link.Skipped {
+				job.Checked++
+			}
+		}
+		if set.Canceled {
+			job.State = JobCanceled
+		}
+		return nil, job, nil
+	}
+}
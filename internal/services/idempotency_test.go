@@ -0,0 +1,81 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/models"
+)
+
+// finishKeyedSet submits a set with the idempotency key and completes it through a lease
+func finishKeyedSet(t *testing.T, svc *LinkServiceImpl, key string) (Job, *apiModels.CheckLinkSetRequest) {
+	t.Helper()
+	req := &apiModels.CheckLinkSetRequest{Links: []string{"a.example", "b.example"}, IdempotencyKey: key}
+	job, err := svc.SubmitLinkSet(context.Background(), req, models.Client{ID: "test"})
+	if err != nil {
+		t.Fatalf("SubmitLinkSet: %v", err)
+	}
+	l := leaseTestTask(t, svc, "worker-a")
+	if err = svc.CompleteLease(l.ID, []LinkResult{available(0), available(1)}); err != nil {
+		t.Fatalf("CompleteLease: %v", err)
+	}
+	if job, err = svc.GetJob(job.ID); err != nil || job.State != JobDone {
+		t.Fatalf("job is %+v (%v), want done", job, err)
+	}
+	return job, req
+}
+
+func evictJobs(svc *LinkServiceImpl) {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+	clear(svc.jobs)
+}
+
+func TestReplayAfterJobIsEvicted(t *testing.T) {
+	svc, _ := newTestLeaseService(t, &fakeProbes{})
+	original, req := finishKeyedSet(t, svc, "key-1")
+	evictJobs(svc)
+
+	job, err := svc.SubmitLinkSet(context.Background(), req, models.Client{ID: "test"})
+	if err != nil {
+		t.Fatalf("replay of evicted job: %v", err)
+	}
+	if !job.Replayed || job.ID != original.ID || job.Number != original.Number || job.State != JobDone {
+		t.Errorf("replayed %+v, want job %s with set #%d", job, original.ID, original.Number)
+	}
+	if job.Set == nil || !job.Set.Links[0].Status || !job.Set.Links[1].Status {
+		t.Errorf("replayed set %+v, want the stored result", job.Set)
+	}
+	if svc.queue.Len() != 0 {
+		t.Error("replay queued a new check")
+	}
+}
+
+func TestReplayAfterRestart(t *testing.T) {
+	svc, _ := newTestLeaseService(t, &fakeProbes{})
+	original, req := finishKeyedSet(t, svc, "key-1")
+	evictJobs(svc)
+
+	// Records are restored from the journal, as on the next start
+	if err := svc.idempotency.Close(); err != nil {
+		t.Fatalf("close idempotency store: %v", err)
+	}
+	idempotency, err := openIdempotencyStore()
+	if err != nil {
+		t.Fatalf("reopen idempotency store: %v", err)
+	}
+	svc.idempotency = idempotency
+	t.Cleanup(func() { _ = idempotency.Close() })
+
+	job, err := svc.CheckLinkSet(context.Background(), req, models.Client{ID: "test"})
+	if err != nil {
+		t.Fatalf("replay after restart: %v", err)
+	}
+	if !job.Replayed || job.Number != original.Number {
+		t.Errorf("replayed %+v, want set #%d", job, original.Number)
+	}
+	if !svc.HasIdempotencyKey("test", "key-1") || svc.HasIdempotencyKey("other", "key-1") {
+		t.Error("key is not known to its client only")
+	}
+}
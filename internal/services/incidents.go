@@ -0,0 +1,388 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/utils/closer"
+	"link-availability-checker/internal/utils/ids"
+)
+
+// IncidentService derives incidents from check results
+//
+// An incident opens once a domain fails IncidentFailureThreshold checks in a row, starting at the first of them, so a
+// single failed check doesn't count as an outage. It closes on the first successful check after that. Incidents are
+// tracked for every checked domain, but only opening and closing incidents of monitored domains triggers alerts, so
+// that clients can't make the service send alerts about domains they submit.
+type IncidentService interface {
+	Observe(records []models.CheckRecord)
+	// Monitor replaces the list of monitored domains
+	Monitor(domains []string)
+	GetIncidents(filter IncidentFilter) ([]models.Incident, error)
+	Summarize(domains []string, since time.Time) (IncidentSummary, error)
+}
+
+type IncidentFilter struct {
+	Domain string    // All domains if empty
+	State  string    // "open", "closed" or empty for both
+	Since  time.Time // Incidents that ended before are skipped
+}
+
+// IncidentSummary describes incidents of a group of domains, e.g. a set
+type IncidentSummary struct {
+	Incidents []models.Incident
+	Open      int
+	Downtime  time.Duration // Total duration of all incidents, open ones are counted until now
+	MTTR      time.Duration // Mean time to recovery of closed incidents
+}
+
+// pendingFailures are consecutive failed checks of a domain that didn't reach incident threshold yet, they are forgotten
+// once the last of them is older than IncidentPendingWindow
+type pendingFailures struct {
+	Failures    int       `json:"failures"`
+	First       time.Time `json:"first"`
+	Last        time.Time `json:"last"`
+	FirstReason string    `json:"first_reason"`
+	LastReason  string    `json:"last_reason"`
+}
+
+// incidentState is what has to survive restart, closed incidents are kept in a separate append-only log
+type incidentState struct {
+	Pending map[string]*pendingFailures `json:"pending"`
+	Open    map[string]*models.Incident `json:"open"`
+}
+
+type IncidentServiceImpl struct {
+	alerts AlertService
+
+	mutex     sync.Mutex
+	state     incidentState
+	monitored map[string]bool
+	capLogged bool // Reaching the limit of pending domains was logged since it was last below it
+
+	logMutex sync.Mutex
+}
+
+func NewIncidentService(as AlertService) (IncidentService, error) {
+	svc := &IncidentServiceImpl{
+		alerts:    as,
+		monitored: make(map[string]bool),
+		state:     incidentState{Pending: make(map[string]*pendingFailures), Open: make(map[string]*models.Incident)},
+	}
+
+	data, err := os.ReadFile(viper.GetString(config.IncidentStatePath))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err = json.Unmarshal(data, &svc.state); err != nil {
+			log.Printf("[INCIDENTS] Failed to read incident state, starting from scratch: %v", err)
+		}
+		if svc.state.Pending == nil {
+			svc.state.Pending = make(map[string]*pendingFailures)
+		}
+		for _, p := range svc.state.Pending {
+			if p.Last.IsZero() {
+				p.Last = p.First // Saved before the time of the last failure was kept
+			}
+		}
+		if svc.state.Open == nil {
+			svc.state.Open = make(map[string]*models.Incident)
+		}
+	}
+	svc.expirePending(time.Now())
+	if len(svc.state.Open) > 0 {
+		log.Printf("[INCIDENTS] %d incidents are open", len(svc.state.Open))
+	}
+
+	return svc, nil
+}
+
+func (svc *IncidentServiceImpl) Observe(records []models.CheckRecord) {
+	threshold := viper.GetInt(config.IncidentFailureThreshold)
+	window := viper.GetDuration(config.IncidentPendingWindow)
+	limit := viper.GetInt(config.IncidentPendingDomains)
+
+	type transition struct {
+		incident models.Incident
+		at       time.Time
+	}
+	var transitions []transition
+	var closed []models.Incident
+	changed := false
+	dropped := 0
+
+	svc.mutex.Lock()
+	for _, r := range records {
+		domain := normalizeDomain(r.Domain)
+		incident := svc.state.Open[domain]
+		pending := svc.state.Pending[domain]
+
+		if r.Available {
+			if incident != nil {
+				end := r.Time
+				incident.End = &end
+				closed = append(closed, *incident)
+				if incident.Alerted {
+					transitions = append(transitions, transition{incident: *incident, at: r.Time})
+				}
+				delete(svc.state.Open, domain)
+				changed = true
+			}
+			if pending != nil {
+				delete(svc.state.Pending, domain)
+				changed = true
+			}
+			continue
+		}
+
+		if incident != nil {
+			incident.Checks++
+			incident.LastReason = r.Reason
+			changed = true
+			continue
+		}
+
+		if pending != nil && r.Time.Sub(pending.Last) > window {
+			pending = nil // Too long since the previous failure, counting starts over
+		}
+		if pending == nil {
+			if _, ok := svc.state.Pending[domain]; !ok && len(svc.state.Pending) >= limit {
+				dropped++
+				continue
+			}
+			pending = &pendingFailures{First: r.Time, FirstReason: r.Reason}
+			svc.state.Pending[domain] = pending
+		}
+		changed = true
+		pending.Failures++
+		pending.Last = r.Time
+		pending.LastReason = r.Reason
+		if pending.Failures < threshold {
+			continue
+		}
+
+		incident = &models.Incident{
+			ID:          ids.New(),
+			Domain:      domain,
+			Start:       pending.First,
+			FirstReason: pending.FirstReason,
+			LastReason:  pending.LastReason,
+			Checks:      pending.Failures,
+			Alerted:     svc.monitored[domain],
+		}
+		svc.state.Open[domain] = incident
+		delete(svc.state.Pending, domain)
+		if incident.Alerted {
+			transitions = append(transitions, transition{incident: *incident, at: r.Time})
+		}
+	}
+
+	// Closed incidents are logged before they leave the state, after a crash in between they are logged twice and
+	// deduplicated when read
+	if len(closed) > 0 {
+		svc.appendClosed(closed)
+	}
+	if changed {
+		svc.expirePending(time.Now())
+		svc.save()
+	}
+	if dropped > 0 && !svc.capLogged {
+		log.Printf("[INCIDENTS] %d domains with failures reached the limit, failures of %d new domains are ignored until older ones expire",
+			len(svc.state.Pending), dropped)
+		svc.capLogged = true
+	}
+	svc.mutex.Unlock()
+
+	for _, t := range transitions {
+		svc.alerts.Notify(t.incident, t.at)
+	}
+}
+
+// expirePending forgets failures whose last check is older than pending window, caller must hold the mutex
+func (svc *IncidentServiceImpl) expirePending(now time.Time) {
+	cutoff := now.Add(-viper.GetDuration(config.IncidentPendingWindow))
+	for domain, p := range svc.state.Pending {
+		if p.Last.Before(cutoff) {
+			delete(svc.state.Pending, domain)
+		}
+	}
+	if len(svc.state.Pending) < viper.GetInt(config.IncidentPendingDomains) {
+		svc.capLogged = false
+	}
+}
+
+func (svc *IncidentServiceImpl) Monitor(domains []string) {
+	monitored := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		monitored[normalizeDomain(d)] = true
+	}
+
+	svc.mutex.Lock()
+	svc.monitored = monitored
+	svc.mutex.Unlock()
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSpace(domain))
+}
+
+func (svc *IncidentServiceImpl) GetIncidents(filter IncidentFilter) ([]models.Incident, error) {
+	filter.Domain = normalizeDomain(filter.Domain)
+	match := func(i *models.Incident) bool {
+		return (filter.Domain == "" || i.Domain == filter.Domain) && (i.Open() || !i.End.Before(filter.Since))
+	}
+
+	incidents := make([]models.Incident, 0)
+	if filter.State != "open" {
+		closed, err := svc.readClosed()
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range closed {
+			if match(&i) {
+				incidents = append(incidents, i)
+			}
+		}
+	}
+	if filter.State != "closed" {
+		svc.mutex.Lock()
+		for _, i := range svc.state.Open {
+			if match(i) {
+				incidents = append(incidents, *i)
+			}
+		}
+		svc.mutex.Unlock()
+	}
+
+	sort.Slice(incidents, func(i, j int) bool { return incidents[i].Start.Before(incidents[j].Start) })
+	return incidents, nil
+}
+
+func (svc *IncidentServiceImpl) Summarize(domains []string, since time.Time) (IncidentSummary, error) {
+	all, err := svc.GetIncidents(IncidentFilter{Since: since})
+	if err != nil {
+		return IncidentSummary{}, err
+	}
+
+	wanted := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		wanted[normalizeDomain(d)] = true
+	}
+
+	var summary IncidentSummary
+	var recovery time.Duration
+	now := time.Now()
+	for _, i := range all {
+		if !wanted[i.Domain] {
+			continue
+		}
+		summary.Incidents = append(summary.Incidents, i)
+		summary.Downtime += i.Duration(now)
+		if i.Open() {
+			summary.Open++
+		} else {
+			recovery += i.Duration(now)
+		}
+	}
+	if closedNum := len(summary.Incidents) - summary.Open; closedNum > 0 {
+		summary.MTTR = recovery / time.Duration(closedNum)
+	}
+	return summary, nil
+}
+
+func (svc *IncidentServiceImpl) appendClosed(incidents []models.Incident) {
+	var data []byte
+	for _, i := range incidents {
+		line, err := json.Marshal(i)
+		if err != nil {
+			continue
+		}
+		data = append(append(data, line...), '\n')
+	}
+
+	svc.logMutex.Lock()
+	defer svc.logMutex.Unlock()
+
+	file, err := os.OpenFile(viper.GetString(config.IncidentLogPath), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("[INCIDENTS] Failed to open incident log: %v", err)
+		return
+	}
+	defer closer.Close(file)
+
+	if _, err = file.Write(data); err != nil {
+		log.Printf("[INCIDENTS] Failed to write incident log: %v", err)
+		return
+	}
+	if err = file.Sync(); err != nil {
+		log.Printf("[INCIDENTS] Failed to sync incident log: %v", err)
+	}
+}
+
+// readClosed returns closed incidents in the order they were closed
+func (svc *IncidentServiceImpl) readClosed() ([]models.Incident, error) {
+	svc.logMutex.Lock()
+	defer svc.logMutex.Unlock()
+
+	file, err := os.Open(viper.GetString(config.IncidentLogPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer closer.Close(file)
+
+	var incidents []models.Incident
+	seen := make(map[string]int)
+	reader := bufio.NewReader(file)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			var i models.Incident
+			if json.Unmarshal(data, &i) == nil && i.End != nil {
+				if n, ok := seen[i.ID]; ok {
+					incidents[n] = i
+				} else {
+					seen[i.ID] = len(incidents)
+					incidents = append(incidents, i)
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return incidents, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// save atomically rewrites incident state file, caller must hold the mutex
+func (svc *IncidentServiceImpl) save() {
+	data, err := json.Marshal(svc.state)
+	if err != nil {
+		return
+	}
+
+	path := viper.GetString(config.IncidentStatePath)
+	if err = os.WriteFile(path+".tmp", data, 0644); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Printf("[INCIDENTS] Failed to save incident state: %v", err)
+	}
+}
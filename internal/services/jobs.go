@@ -0,0 +1,399 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+)
+
+type JobState string
+
+const (
+	JobQueued   JobState = "queued"
+	JobRunning  JobState = "running"
+	JobDone     JobState = "done"
+	JobCanceled JobState = "canceled"
+	JobFailed   JobState = "failed"
+)
+
+func (s JobState) Final() bool { return s == JobDone || s == JobCanceled || s == JobFailed }
+
+// Abandon policies applied when a client waiting for the result disconnects
+const (
+	AbandonContinue  = "continue"  // Keep checking and store the result
+	AbandonCancel    = "cancel"    // Cancel the job keeping partial results
+	AbandonDowngrade = "downgrade" // Move queued job to low priority, running job continues
+)
+
+// Job is a snapshot of a link set check
+type Job struct {
+	ID         string
+	State      JobState
+	Client     string
+	Priority   models.Priority
+	Number     int
+	Total      int
+	Checked    int
+	Set        *models.Set // Result, only set for finished jobs
+	CreatedAt  time.Time
+	FinishedAt time.Time
+	Replayed   bool   // Returned for a repeated request with the same idempotency key
+	Worker     string // Remote worker checking the job
+}
+
+type JobEventType string
+
+const (
+	JobEventLink JobEventType = "link" // Result of a single link
+	JobEventDone JobEventType = "done" // Job reached final state, always the last event
+)
+
+type JobEvent struct {
+	Type   JobEventType
+	Index  int
+	Link   models.Link
+	State  JobState
+	Number int
+}
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobFinished = errors.New("job is already finished")
+
+	errJobCanceled = errors.New("job canceled")
+)
+
+func (svc *LinkServiceImpl) GetJob(id string) (Job, error) {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+
+	task, ok := svc.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return task.snapshot(), nil
+}
+
+// CancelJob cancels queued or running job, links checked so far are stored as partial result
+func (svc *LinkServiceImpl) CancelJob(id string) (Job, error) {
+	svc.jobsMutex.Lock()
+	task, ok := svc.jobs[id]
+	if !ok {
+		svc.jobsMutex.Unlock()
+		return Job{}, ErrJobNotFound
+	}
+	if task.state.Final() {
+		defer svc.jobsMutex.Unlock()
+		return task.snapshot(), ErrJobFinished
+	}
+
+	task.cancel(errJobCanceled)
+	// Running job is finished by its worker, spilled one - by the worker that eventually picks it up. Remote workers
+	// only learn about it from the next heartbeat, so leased job is finished right away.
+	removed := task.state == JobQueued && svc.queue.Remove(task.id)
+	running := task.state == JobRunning
+	svc.jobsMutex.Unlock()
+
+	if removed || running && svc.revokeLease(task.id) {
+		svc.finishCanceled(task)
+	}
+
+	log.Printf("[SERVICE] Job %s canceled", id)
+	return svc.GetJob(id)
+}
+
+// registerJob adds task to the job registry, dropping finished jobs older than retention period
+func (svc *LinkServiceImpl) registerJob(task *linkTask) {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+
+	retention := viper.GetDuration(config.QueueJobRetention)
+	for id, t := range svc.jobs {
+		if t.state.Final() && time.Since(t.finishedAt) > retention {
+			delete(svc.jobs, id)
+		}
+	}
+
+	svc.jobs[task.id] = task
+}
+
+func (svc *LinkServiceImpl) countJobs(state JobState) int {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+
+	n := 0
+	for _, t := range svc.jobs {
+		if t.state == state {
+			n++
+		}
+	}
+	return n
+}
+
+func (svc *LinkServiceImpl) lookupJob(id string) *linkTask {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+	return svc.jobs[id]
+}
+
+// startJob marks job as running and journals the start with set number reserved for it, returns false if it must not
+// be processed
+func (svc *LinkServiceImpl) startJob(task *linkTask) bool {
+	svc.jobsMutex.Lock()
+	if task.state != JobQueued {
+		svc.jobsMutex.Unlock()
+		return false
+	}
+	if errors.Is(context.Cause(task.ctx), errJobCanceled) {
+		svc.jobsMutex.Unlock()
+		svc.finishCanceled(task) // Canceled after it was taken from the queue
+		return false
+	}
+	task.state = JobRunning
+	if task.set.Number == 0 {
+		task.set.Number = svc.ls.ReserveSetNumber() // Only tasks accepted by the queue take a number
+	}
+	number := task.set.Number
+	svc.jobsMutex.Unlock()
+
+	if err := svc.journal.Start(task.id, taskStart{Number: number}); err != nil {
+		log.Printf("[SERVICE] Failed to journal start of task %s: %v", task.id, err)
+	}
+	svc.idempotency.started(task.id, number)
+	return true
+}
+
+// jobNumber returns set number of the job, 0 until the job is started
+func (svc *LinkServiceImpl) jobNumber(task *linkTask) int {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+	return task.set.Number
+}
+
+// OnJobFinished registers fn to be called once a job reaches final state, when its set number is known. It's also
+// called right away for finished jobs still kept in the registry, e.g. restored ones that finished before fn was
+// registered.
+func (svc *LinkServiceImpl) OnJobFinished(fn func(job Job)) {
+	svc.jobsMutex.Lock()
+	svc.finishListeners = append(svc.finishListeners, fn)
+	var finished []Job
+	for _, t := range svc.jobs {
+		if t.state.Final() {
+			finished = append(finished, t.snapshot())
+		}
+	}
+	svc.jobsMutex.Unlock()
+
+	for _, job := range finished {
+		fn(job)
+	}
+}
+
+func (svc *LinkServiceImpl) setJobState(task *linkTask, state JobState) {
+	svc.jobsMutex.Lock()
+	if task.state.Final() {
+		svc.jobsMutex.Unlock()
+		return
+	}
+	task.state = state
+	if !state.Final() {
+		svc.jobsMutex.Unlock()
+		return
+	}
+
+	task.finishedAt = time.Now()
+	close(task.done)
+	task.publish(JobEvent{Type: JobEventDone, State: state, Number: task.set.Number})
+	for ch := range task.subscribers {
+		close(ch)
+	}
+	task.subscribers = nil
+	job, listeners := task.snapshot(), svc.finishListeners
+	svc.jobsMutex.Unlock()
+
+	for _, fn := range listeners {
+		fn(job)
+	}
+}
+
+// recordResult stores result of a single link and publishes it to job subscribers
+func (svc *LinkServiceImpl) recordResult(task *linkTask, index int, res models.CheckResult) {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+
+	task.set.Links[index].Status = res.Available
+	task.set.Links[index].Verdicts = res.Verdicts
+	task.checked[index] = true
+	task.checkedCount.Add(1)
+	task.publish(JobEvent{Type: JobEventLink, Index: index, Link: task.set.Links[index]})
+}
+
+// SubscribeJob returns events that already happened and a channel of further events, which is closed after JobEventDone
+// or on shutdown. unsubscribe must be called once the caller stops reading.
+func (svc *LinkServiceImpl) SubscribeJob(id string) (past []JobEvent, events <-chan JobEvent, unsubscribe func(), err error) {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+
+	task, ok := svc.jobs[id]
+	if !ok {
+		return nil, nil, nil, ErrJobNotFound
+	}
+
+	for i, link := range task.set.Links {
+		if task.checked[i] || link.Skipped {
+			past = append(past, JobEvent{Type: JobEventLink, Index: i, Link: link})
+		}
+	}
+
+	// Buffer fits every remaining event, so publishing never blocks or drops events
+	ch := make(chan JobEvent, len(task.set.Links)-len(past)+1)
+	if task.state.Final() {
+		past = append(past, JobEvent{Type: JobEventDone, State: task.state, Number: task.set.Number})
+		close(ch)
+		return past, ch, func() {}, nil
+	}
+
+	if task.subscribers == nil {
+		task.subscribers = make(map[chan JobEvent]struct{})
+	}
+	task.subscribers[ch] = struct{}{}
+
+	unsubscribe = func() {
+		svc.jobsMutex.Lock()
+		defer svc.jobsMutex.Unlock()
+		if _, ok := task.subscribers[ch]; ok {
+			delete(task.subscribers, ch)
+			close(ch)
+		}
+	}
+	return past, ch, unsubscribe, nil
+}
+
+// closeSubscribers ends all event streams, used on shutdown
+func (svc *LinkServiceImpl) closeSubscribers() {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+
+	for _, task := range svc.jobs {
+		for ch := range task.subscribers {
+			close(ch)
+		}
+		task.subscribers = nil
+	}
+}
+
+// finishCanceled stores partial result of canceled job, unchecked links are marked as skipped
+func (svc *LinkServiceImpl) finishCanceled(task *linkTask) {
+	svc.jobsMutex.Lock()
+	for i := range task.set.Links {
+		if !task.checked[i] {
+			task.set.Links[i].Skipped = true
+		}
+	}
+	task.set.Canceled = true
+	svc.jobsMutex.Unlock()
+
+	if _, err := svc.ls.SaveLinkSet(task.traceContext(context.Background()), task.set); err != nil {
+		log.Printf("[SERVICE] Failed to save partial result of canceled job %s: %v", task.id, err)
+		svc.setJobState(task, JobFailed)
+		return
+	}
+	svc.notifyCallback(task, JobCanceled)
+	if err := svc.journal.Complete(task.id); err != nil {
+		log.Printf("[SERVICE] Failed to journal cancellation of job %s: %v", task.id, err)
+	}
+	svc.setJobState(task, JobCanceled)
+}
+
+// waitJob waits for job to finish, applying abandon policy if ctx is done and nobody else waits for the job
+func (svc *LinkServiceImpl) waitJob(ctx context.Context, task *linkTask) (Job, error) {
+	svc.jobsMutex.Lock()
+	task.waiters++
+	svc.jobsMutex.Unlock()
+	left := false
+	defer func() {
+		if !left {
+			svc.jobsMutex.Lock()
+			task.waiters--
+			svc.jobsMutex.Unlock()
+		}
+	}()
+
+	select {
+	case <-task.done:
+		return svc.GetJob(task.id)
+	case <-svc.shutdownCtx.Done():
+		return svc.GetJob(task.id)
+	case <-ctx.Done():
+	}
+
+	svc.jobsMutex.Lock()
+	task.waiters--
+	left = true
+	abandoned := task.waiters == 0 && !task.async && !task.state.Final()
+	svc.jobsMutex.Unlock()
+
+	if abandoned {
+		svc.abandonJob(task)
+	}
+	return svc.GetJob(task.id)
+}
+
+func (svc *LinkServiceImpl) abandonJob(task *linkTask) {
+	switch viper.GetString(config.QueueAbandonPolicy) {
+	case AbandonCancel:
+		log.Printf("[SERVICE] Client left, canceling job %s", task.id)
+		_, _ = svc.CancelJob(task.id)
+	case AbandonDowngrade:
+		svc.jobsMutex.Lock()
+		defer svc.jobsMutex.Unlock()
+		if task.state != JobQueued || task.priority == models.PriorityLow || !svc.queue.Remove(task.id) {
+			return // Running job continues as is
+		}
+		log.Printf("[SERVICE] Client left, moving job %s to low priority", task.id)
+		task.priority = models.PriorityLow
+		if !svc.queue.TryPush(task) {
+			if err := svc.spill.Push(task.spilled()); err != nil {
+				log.Printf("[SERVICE] Failed to spill job %s, it will be retried on next start: %v", task.id, err)
+				return
+			}
+			svc.notifySpilled()
+		}
+	}
+}
+
+// publish sends event to job subscribers, caller must hold jobsMutex
+func (task *linkTask) publish(e JobEvent) {
+	for ch := range task.subscribers {
+		select {
+		case ch <- e:
+		default: // Can't happen since buffer fits all events, but never block workers
+		}
+	}
+}
+
+// snapshot returns current state of the job, caller must hold jobsMutex
+func (task *linkTask) snapshot() Job {
+	job := Job{
+		ID:         task.id,
+		State:      task.state,
+		Client:     task.client.ID,
+		Priority:   task.priority,
+		Number:     task.set.Number,
+		Total:      len(task.set.Links),
+		Checked:    int(task.checkedCount.Load()),
+		CreatedAt:  task.createdAt,
+		FinishedAt: task.finishedAt,
+		Worker:     task.worker,
+	}
+	if task.state.Final() {
+		job.Set = task.set // Workers don't touch the set after the job is finished
+	}
+	return job
+}
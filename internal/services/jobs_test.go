@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/models"
+)
+
+func TestSetNumberIsKnownOnceJobStarts(t *testing.T) {
+	svc, _ := newTestLeaseService(t, &fakeProbes{})
+	finished := make(chan Job, 1)
+	svc.OnJobFinished(func(job Job) { finished <- job })
+
+	req := &apiModels.CheckLinkSetRequest{Links: []string{"a.example"}, IdempotencyKey: "key-1"}
+	job, err := svc.SubmitLinkSet(context.Background(), req, models.Client{ID: "test"})
+	if err != nil {
+		t.Fatalf("SubmitLinkSet: %v", err)
+	}
+	if job.Number != 0 {
+		t.Fatalf("queued job has set number %d before it's started", job.Number)
+	}
+
+	l := leaseTestTask(t, svc, "worker-a")
+	if l.SetNumber == 0 {
+		t.Fatal("started job has no set number")
+	}
+	rec, _, err := svc.idempotency.acquire("test", "key-1", requestHash(req))
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if n := svc.idempotency.setNumber(rec); n != l.SetNumber {
+		t.Errorf("idempotency key points to set #%d, want #%d", n, l.SetNumber)
+	}
+
+	if err = svc.CompleteLease(l.ID, []LinkResult{available(0)}); err != nil {
+		t.Fatalf("CompleteLease: %v", err)
+	}
+	done := <-finished
+	if done.ID != job.ID || done.Number != l.SetNumber || done.State != JobDone {
+		t.Errorf("finished job %s #%d (%s), want %s #%d (done)", done.ID, done.Number, done.State, job.ID, l.SetNumber)
+	}
+}
+
+func TestOnJobFinishedReplaysFinishedJobs(t *testing.T) {
+	svc, _ := newTestLeaseService(t, &fakeProbes{})
+	task := submitTestSet(t, svc, "a.example")
+	l := leaseTestTask(t, svc, "worker-a")
+	if err := svc.CompleteLease(l.ID, []LinkResult{available(0)}); err != nil {
+		t.Fatalf("CompleteLease: %v", err)
+	}
+
+	var got []Job
+	svc.OnJobFinished(func(job Job) { got = append(got, job) })
+	if len(got) != 1 || got[0].ID != task.id || got[0].Number != l.SetNumber {
+		t.Errorf("got %+v, want job %s finished before registering", got, task.id)
+	}
+}
+
+func TestWaitJobStopsWaitingOnShutdown(t *testing.T) {
+	svc, _ := newTestLeaseService(t, &fakeProbes{})
+	task := submitTestSet(t, svc, "a.example")
+
+	svc.shutdownCancel()
+	if _, err := svc.waitJob(context.Background(), task); err != nil {
+		t.Fatalf("waitJob: %v", err)
+	}
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+	if task.waiters != 0 {
+		t.Errorf("job still has %d waiters after shutdown", task.waiters)
+	}
+}
@@ -0,0 +1,391 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/utils/ids"
+)
+
+// Lease gives a queued task to a remote worker process for a limited time. The worker extends it with heartbeats,
+// which also carry results checked so far, so a task of expired lease returns to the queue and only links without
+// reported result are checked again. If probe agents are connected, they check leased links at the same time and the
+// worker's results are decided by quorum with their verdicts, as results of local workers are.
+type Lease struct {
+	ID        string
+	JobID     string
+	Worker    string
+	SetNumber int
+	Links     []LeasedLink // Links left to check
+	ExpiresAt time.Time
+}
+
+type LeasedLink struct {
+	Index  int
+	Domain string
+}
+
+// LinkResult is a result of a leased link reported by a worker
+type LinkResult struct {
+	Index  int
+	Result models.CheckResult
+	Time   time.Time // Clamped to the lease period, as worker's clock may be off
+}
+
+var ErrLeaseNotFound = errors.New("lease not found or expired")
+
+// lease is guarded by LinkServiceImpl.leasesMutex
+type lease struct {
+	id      string
+	task    *linkTask
+	worker  string
+	started time.Time
+	expires time.Time
+
+	positions map[int]int   // Position of each leased link among domains sent to probe agents
+	probing   chan struct{} // Closed once verdicts of probe agents are known, nil if no agents were asked
+	verdicts  [][]models.Verdict
+	held      []LinkResult // Results reported before the verdicts, applied once they come
+}
+
+// LeaseTask waits up to poll timeout for a queued task and leases it to the worker, false is returned if there was
+// none
+func (svc *LinkServiceImpl) LeaseTask(ctx context.Context, worker string) (Lease, bool, error) {
+	if !svc.beginLeaseOp() {
+		return Lease{}, false, ErrServiceStopping
+	}
+	defer svc.leaseOps.Done()
+
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration(config.LeasePollTimeout))
+	defer cancel()
+
+	for {
+		select {
+		case <-svc.stopping:
+			return Lease{}, false, nil // Remaining tasks are left to local workers or journal
+		default:
+		}
+
+		task, ok := svc.queue.PopContext(ctx)
+		if !ok {
+			return Lease{}, false, nil
+		}
+		if !svc.startJob(task) {
+			continue // Canceled while queued
+		}
+
+		domains, indexes := svc.uncheckedLinks(task)
+		now := time.Now()
+		l := &lease{id: ids.New(), task: task, worker: worker, started: now, expires: now.Add(viper.GetDuration(config.LeaseDuration))}
+		l.positions = make(map[int]int, len(indexes))
+		for i, index := range indexes {
+			l.positions[index] = i
+		}
+		if probed, ok := svc.probes.Probe(task.ctx, domains); ok {
+			l.probing = make(chan struct{})
+			go svc.awaitVerdicts(l, probed)
+		}
+
+		svc.jobsMutex.Lock()
+		task.worker = worker
+		svc.jobsMutex.Unlock()
+
+		svc.leasesMutex.Lock()
+		svc.leases[l.id] = l
+		svc.leasesMutex.Unlock()
+
+		log.Printf("[SERVICE] Job %s leased to worker %s (%d links)", task.id, worker, len(domains))
+
+		links := make([]LeasedLink, len(domains))
+		for i := range domains {
+			links[i] = LeasedLink{Index: indexes[i], Domain: domains[i]}
+		}
+		return Lease{ID: l.id, JobID: task.id, Worker: worker, SetNumber: task.set.Number, Links: links, ExpiresAt: l.expires}, true, nil
+	}
+}
+
+// HeartbeatLease records results reported so far and extends the lease
+func (svc *LinkServiceImpl) HeartbeatLease(id string, results []LinkResult) (time.Time, error) {
+	if !svc.beginLeaseOp() {
+		return time.Time{}, ErrServiceStopping
+	}
+	defer svc.leaseOps.Done()
+
+	svc.leasesMutex.Lock()
+	defer svc.leasesMutex.Unlock()
+
+	l, ok := svc.leases[id]
+	if !ok {
+		return time.Time{}, ErrLeaseNotFound
+	}
+	svc.applyResults(l, results)
+	l.expires = time.Now().Add(viper.GetDuration(config.LeaseDuration))
+	return l.expires, nil
+}
+
+// CompleteLease records remaining results and finishes the task, links without result are stored as unavailable
+func (svc *LinkServiceImpl) CompleteLease(id string, results []LinkResult) error {
+	if !svc.beginLeaseOp() {
+		return ErrServiceStopping
+	}
+	defer svc.leaseOps.Done()
+
+	l, err := svc.takeLease(id, results)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[SERVICE] Job %s completed by worker %s", l.task.id, l.worker)
+	svc.finishTask(l.task.traceContext(context.Background()), l.task)
+	return nil
+}
+
+// ReleaseLease records results checked so far and returns the task to the queue, e.g. when the worker stops
+func (svc *LinkServiceImpl) ReleaseLease(id string, results []LinkResult) error {
+	if !svc.beginLeaseOp() {
+		return ErrServiceStopping
+	}
+	defer svc.leaseOps.Done()
+
+	l, err := svc.takeLease(id, results)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[SERVICE] Worker %s released job %s, returning it to the queue", l.worker, l.task.id)
+	svc.requeue(l.task)
+	return nil
+}
+
+// takeLease records results and removes the lease, waiting for verdicts of probe agents if results are held for them
+func (svc *LinkServiceImpl) takeLease(id string, results []LinkResult) (*lease, error) {
+	svc.leasesMutex.Lock()
+	l, ok := svc.leases[id]
+	if !ok {
+		svc.leasesMutex.Unlock()
+		return nil, ErrLeaseNotFound
+	}
+	svc.applyResults(l, results)
+	delete(svc.leases, id)
+	svc.leasesMutex.Unlock()
+
+	if l.probing != nil {
+		<-l.probing // Bounded by probe timeout
+
+		svc.leasesMutex.Lock()
+		held := l.held
+		l.held = nil
+		svc.applyResults(l, held)
+		svc.leasesMutex.Unlock()
+	}
+	return l, nil
+}
+
+// awaitVerdicts applies results held for verdicts of probe agents once they come. Results of a lease that is gone by
+// then are applied by whoever took it, or dropped if it expired or was revoked.
+func (svc *LinkServiceImpl) awaitVerdicts(l *lease, probed <-chan [][]models.Verdict) {
+	verdicts := <-probed
+
+	svc.leasesMutex.Lock()
+	defer svc.leasesMutex.Unlock()
+
+	l.verdicts = verdicts
+	close(l.probing)
+	if _, ok := svc.leases[l.id]; ok && !svc.leasesClosed {
+		held := l.held
+		l.held = nil
+		svc.applyResults(l, held)
+	}
+}
+
+func (l *lease) awaitingVerdicts() bool {
+	if l.probing == nil {
+		return false
+	}
+	select {
+	case <-l.probing:
+		return false
+	default:
+		return true
+	}
+}
+
+// decide combines result reported by the worker with verdicts of probe agents, the worker takes place of the server
+func (l *lease) decide(index int, res models.CheckResult) models.CheckResult {
+	position, ok := l.positions[index]
+	if l.verdicts == nil || !ok {
+		return res
+	}
+	res = decideQuorum(res, l.verdicts[position])
+	res.Verdicts[0].Agent = l.worker
+	res.Verdicts[0].Location = ""
+	return res
+}
+
+// applyResults checkpoints reported results and adds them to domain history, caller must hold leasesMutex so that
+// results never arrive after the lease is gone. While probe agents are checking, results are held for their verdicts.
+func (svc *LinkServiceImpl) applyResults(l *lease, results []LinkResult) {
+	if l.awaitingVerdicts() {
+		l.held = append(l.held, results...)
+		return
+	}
+
+	now := time.Now()
+	records := make([]models.CheckRecord, 0, len(results))
+	for _, r := range results {
+		svc.jobsMutex.Lock()
+		valid := r.Index >= 0 && r.Index < len(l.task.checked) && !l.task.checked[r.Index]
+		var domain string
+		if valid {
+			domain = l.task.set.Links[r.Index].Domain
+		}
+		svc.jobsMutex.Unlock()
+		if !valid {
+			continue // Repeated by a retried request or out of range
+		}
+
+		// History and incidents expect check times in order, so skewed or replayed times are kept within the lease
+		at := r.Time
+		if at.Before(l.started) {
+			at = l.started
+		}
+		if at.After(now) {
+			at = now
+		}
+
+		res := l.decide(r.Index, r.Result)
+		svc.checkpoint(l.task, r.Index, res)
+		records = append(records, models.CheckRecord{
+			Domain:    domain,
+			Time:      at,
+			Available: res.Available,
+			Reason:    res.Reason,
+			Latency:   res.Latency,
+		})
+	}
+	svc.history.Record(records)
+}
+
+// revokeLease removes lease of the task, returns false if the task isn't leased
+func (svc *LinkServiceImpl) revokeLease(taskID string) bool {
+	svc.leasesMutex.Lock()
+	defer svc.leasesMutex.Unlock()
+
+	for id, l := range svc.leases {
+		if l.task.id == taskID {
+			delete(svc.leases, id)
+			return true
+		}
+	}
+	return false
+}
+
+// requeue returns task of a lost lease to the queue, during shutdown it's only left in journal
+func (svc *LinkServiceImpl) requeue(task *linkTask) {
+	if errors.Is(context.Cause(task.ctx), errJobCanceled) {
+		svc.finishCanceled(task)
+		return
+	}
+
+	svc.jobsMutex.Lock()
+	task.worker = ""
+	svc.jobsMutex.Unlock()
+	svc.setJobState(task, JobQueued)
+
+	select {
+	case <-svc.stopping:
+		return
+	default:
+	}
+
+	if !svc.queue.TryPush(task) {
+		if err := svc.spill.Push(task.spilled()); err != nil {
+			log.Printf("[SERVICE] Failed to spill job %s, it will be retried on next start: %v", task.id, err)
+			return
+		}
+		svc.notifySpilled()
+	}
+}
+
+// expireLeases returns tasks of leases that weren't extended in time to the queue
+func (svc *LinkServiceImpl) expireLeases() {
+	now := time.Now()
+	var expired []*lease
+
+	svc.leasesMutex.Lock()
+	for id, l := range svc.leases {
+		if now.After(l.expires) {
+			expired = append(expired, l)
+			delete(svc.leases, id)
+		}
+	}
+	svc.leasesMutex.Unlock()
+
+	for _, l := range expired {
+		log.Printf("[SERVICE] Lease of job %s by worker %s expired, returning it to the queue", l.task.id, l.worker)
+		svc.requeue(l.task)
+	}
+}
+
+func (svc *LinkServiceImpl) watchLeases() {
+	defer svc.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			svc.expireLeases()
+		case <-svc.stopping:
+			return
+		}
+	}
+}
+
+// beginLeaseOp registers a call of a worker, journal stays open until all of them return
+func (svc *LinkServiceImpl) beginLeaseOp() bool {
+	svc.leasesMutex.Lock()
+	defer svc.leasesMutex.Unlock()
+
+	if svc.leasesClosed {
+		return false
+	}
+	svc.leaseOps.Add(1)
+	return true
+}
+
+func (svc *LinkServiceImpl) countLeases() int {
+	svc.leasesMutex.Lock()
+	defer svc.leasesMutex.Unlock()
+	return len(svc.leases)
+}
+
+// closeLeases gives leased tasks until ctx is done to finish, then stops accepting calls of workers. Unfinished
+// leased tasks are resumed after restart from their checkpoints.
+func (svc *LinkServiceImpl) closeLeases(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+wait:
+	for svc.countLeases() > 0 {
+		select {
+		case <-ticker.C:
+			svc.expireLeases()
+		case <-ctx.Done():
+			log.Printf("[SERVICE] %d leased tasks didn't finish before Fx deadline, they will be resumed after restart", svc.countLeases())
+			break wait
+		}
+	}
+
+	svc.leasesMutex.Lock()
+	svc.leasesClosed = true
+	svc.leasesMutex.Unlock()
+	svc.leaseOps.Wait()
+}
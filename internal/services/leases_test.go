@@ -0,0 +1,316 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/storage"
+	"link-availability-checker/pkg/boltstore"
+	"link-availability-checker/pkg/diskqueue"
+	"link-availability-checker/pkg/journal"
+)
+
+// recordingHistory remembers check records instead of storing them
+type recordingHistory struct {
+	mutex   sync.Mutex
+	records []models.CheckRecord
+}
+
+func (h *recordingHistory) Record(records []models.CheckRecord) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records = append(h.records, records...)
+}
+
+func (h *recordingHistory) GetUptime(string, time.Time, time.Time) (Uptime, error) {
+	return Uptime{}, nil
+}
+
+func (h *recordingHistory) count() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.records)
+}
+
+// fakeProbes answers probes with verdicts sent to its channel, no agents are live if it's nil
+type fakeProbes struct {
+	ProbeService
+	verdicts chan [][]models.Verdict
+}
+
+func (p *fakeProbes) Probe(context.Context, []string) (<-chan [][]models.Verdict, bool) {
+	return p.verdicts, p.verdicts != nil
+}
+
+// newTestLeaseService creates link service without local workers, so that queued tasks are only taken by leases
+func newTestLeaseService(t *testing.T, probes ProbeService) (*LinkServiceImpl, *recordingHistory) {
+	t.Helper()
+	dir := t.TempDir()
+	viper.Set(config.LeaseDuration, time.Hour)
+	viper.Set(config.LeasePollTimeout, 100*time.Millisecond)
+	viper.Set(config.QueueWaitTimeout, time.Second)
+	viper.Set(config.QueueJobRetention, time.Hour)
+	viper.Set(config.IdempotencyPath, filepath.Join(dir, "idempotency.journal"))
+	viper.Set(config.IdempotencyRetention, time.Hour)
+	t.Cleanup(viper.Reset)
+
+	j, err := journal.Open(filepath.Join(dir, "queue.journal"), 0)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	bs, err := boltstore.Open(filepath.Join(dir, "links.db"))
+	if err != nil {
+		t.Fatalf("open bolt store: %v", err)
+	}
+	spill, err := diskqueue.Open(filepath.Join(dir, "queue.spill"))
+	if err != nil {
+		t.Fatalf("open spill queue: %v", err)
+	}
+	idempotency, err := openIdempotencyStore()
+	if err != nil {
+		t.Fatalf("open idempotency store: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	history := &recordingHistory{}
+	svc := &LinkServiceImpl{
+		ls:             storage.NewBoltLinkStorage(bs),
+		history:        history,
+		probes:         probes,
+		journal:        j,
+		jobs:           make(map[string]*linkTask),
+		leases:         make(map[string]*lease),
+		queue:          newTaskQueue(10),
+		stopping:       make(chan struct{}),
+		spill:          spill,
+		spillSignal:    make(chan struct{}, 1),
+		idempotency:    idempotency,
+		shutdownCtx:    ctx,
+		shutdownCancel: cancel,
+	}
+	t.Cleanup(func() {
+		cancel()
+		_ = j.Close()
+		_ = bs.Close()
+		_ = spill.Close()
+		_ = idempotency.Close()
+	})
+	return svc, history
+}
+
+func submitTestSet(t *testing.T, svc *LinkServiceImpl, links ...string) *linkTask {
+	t.Helper()
+	task, err := svc.enqueue(context.Background(), &apiModels.CheckLinkSetRequest{Links: links}, models.Client{ID: "test"}, true)
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	return task
+}
+
+func leaseTestTask(t *testing.T, svc *LinkServiceImpl, worker string) Lease {
+	t.Helper()
+	l, ok, err := svc.LeaseTask(context.Background(), worker)
+	if err != nil || !ok {
+		t.Fatalf("LeaseTask: ok %v, err %v", ok, err)
+	}
+	return l
+}
+
+func jobState(t *testing.T, svc *LinkServiceImpl, id string) JobState {
+	t.Helper()
+	job, err := svc.GetJob(id)
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	return job.State
+}
+
+func available(index int) LinkResult {
+	return LinkResult{Index: index, Result: models.CheckResult{Available: true}, Time: time.Now()}
+}
+
+// expireNow makes every lease overdue and expires it
+func expireNow(svc *LinkServiceImpl) {
+	svc.leasesMutex.Lock()
+	for _, l := range svc.leases {
+		l.expires = time.Now().Add(-time.Second)
+	}
+	svc.leasesMutex.Unlock()
+	svc.expireLeases()
+}
+
+func TestExpiredLeaseIsRequeuedWithUncheckedLinksOnly(t *testing.T) {
+	svc, _ := newTestLeaseService(t, &fakeProbes{})
+	task := submitTestSet(t, svc, "a.example", "b.example")
+
+	first := leaseTestTask(t, svc, "worker-a")
+	if len(first.Links) != 2 {
+		t.Fatalf("leased %d links, want 2", len(first.Links))
+	}
+	if _, err := svc.HeartbeatLease(first.ID, []LinkResult{available(0)}); err != nil {
+		t.Fatalf("HeartbeatLease: %v", err)
+	}
+
+	expireNow(svc)
+	if state := jobState(t, svc, task.id); state != JobQueued {
+		t.Fatalf("job of expired lease is %s, want queued", state)
+	}
+	if _, err := svc.HeartbeatLease(first.ID, nil); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("heartbeat of expired lease returned %v, want ErrLeaseNotFound", err)
+	}
+
+	second := leaseTestTask(t, svc, "worker-b")
+	if second.JobID != task.id || second.SetNumber != first.SetNumber {
+		t.Errorf("requeued job %s #%d, want %s #%d", second.JobID, second.SetNumber, task.id, first.SetNumber)
+	}
+	if len(second.Links) != 1 || second.Links[0].Index != 1 {
+		t.Errorf("requeued lease has links %+v, want only the unchecked one", second.Links)
+	}
+}
+
+func TestHeartbeatAfterRevokeIsRejected(t *testing.T) {
+	svc, history := newTestLeaseService(t, &fakeProbes{})
+	task := submitTestSet(t, svc, "a.example")
+	l := leaseTestTask(t, svc, "worker-a")
+
+	if _, err := svc.CancelJob(task.id); err != nil {
+		t.Fatalf("CancelJob: %v", err)
+	}
+	if state := jobState(t, svc, task.id); state != JobCanceled {
+		t.Fatalf("job of revoked lease is %s, want canceled", state)
+	}
+
+	if _, err := svc.HeartbeatLease(l.ID, []LinkResult{available(0)}); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("heartbeat of revoked lease returned %v, want ErrLeaseNotFound", err)
+	}
+	if err := svc.CompleteLease(l.ID, []LinkResult{available(0)}); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("complete of revoked lease returned %v, want ErrLeaseNotFound", err)
+	}
+	if task.checked[0] || history.count() != 0 {
+		t.Errorf("result reported after revoke was applied")
+	}
+	if pending := svc.journal.Pending(); len(pending) != 0 {
+		t.Errorf("canceled job is still in journal: %+v", pending)
+	}
+}
+
+func TestDuplicateCompleteAfterRequeue(t *testing.T) {
+	svc, _ := newTestLeaseService(t, &fakeProbes{})
+	task := submitTestSet(t, svc, "a.example", "b.example")
+
+	stale := leaseTestTask(t, svc, "worker-a")
+	expireNow(svc)
+	current := leaseTestTask(t, svc, "worker-b")
+
+	if err := svc.CompleteLease(stale.ID, []LinkResult{available(0)}); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("complete of expired lease returned %v, want ErrLeaseNotFound", err)
+	}
+	if state := jobState(t, svc, task.id); state != JobRunning {
+		t.Fatalf("complete of expired lease moved job to %s", state)
+	}
+
+	if err := svc.CompleteLease(current.ID, []LinkResult{available(0), available(1)}); err != nil {
+		t.Fatalf("CompleteLease: %v", err)
+	}
+	if err := svc.CompleteLease(current.ID, nil); !errors.Is(err, ErrLeaseNotFound) {
+		t.Fatalf("repeated complete returned %v, want ErrLeaseNotFound", err)
+	}
+	if state := jobState(t, svc, task.id); state != JobDone {
+		t.Fatalf("job is %s, want done", state)
+	}
+
+	set, err := svc.ls.GetLinkSet(current.SetNumber)
+	if err != nil {
+		t.Fatalf("GetLinkSet: %v", err)
+	}
+	if !set.Links[0].Status || !set.Links[1].Status {
+		t.Errorf("stored set %+v, want both links available", set.Links)
+	}
+	if n := svc.ls.(storage.Inspector).CountLinkSets(); n != 1 {
+		t.Errorf("set stored %d times", n)
+	}
+}
+
+func TestLeaseResultsAreDecidedByQuorum(t *testing.T) {
+	probes := &fakeProbes{verdicts: make(chan [][]models.Verdict, 1)}
+	svc, history := newTestLeaseService(t, probes)
+	task := submitTestSet(t, svc, "a.example", "b.example")
+	l := leaseTestTask(t, svc, "worker-a")
+
+	// Results wait for verdicts of probe agents
+	if _, err := svc.HeartbeatLease(l.ID, []LinkResult{available(0)}); err != nil {
+		t.Fatalf("HeartbeatLease: %v", err)
+	}
+	if task.checked[0] || history.count() != 0 {
+		t.Fatal("result was applied before verdicts of probe agents")
+	}
+
+	down := []models.Verdict{{Agent: "probe-1", Reason: "timeout"}, {Agent: "probe-2", Reason: "timeout"}}
+	up := []models.Verdict{{Agent: "probe-1", Status: true}, {Agent: "probe-2", Status: true}}
+	probes.verdicts <- [][]models.Verdict{down, up}
+
+	if err := svc.CompleteLease(l.ID, []LinkResult{available(1)}); err != nil {
+		t.Fatalf("CompleteLease: %v", err)
+	}
+
+	set, err := svc.ls.GetLinkSet(l.SetNumber)
+	if err != nil {
+		t.Fatalf("GetLinkSet: %v", err)
+	}
+	if set.Links[0].Status {
+		t.Errorf("link seen down by quorum of probe agents is stored available")
+	}
+	if !set.Links[1].Status {
+		t.Errorf("link seen up everywhere is stored unavailable")
+	}
+	verdicts := set.Links[0].Verdicts
+	if len(verdicts) != 3 || verdicts[0].Agent != "worker-a" || !verdicts[0].Status {
+		t.Errorf("got verdicts %+v, want the worker's followed by both agents", verdicts)
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if len(history.records) != 2 {
+		t.Fatalf("got %d history records, want 2", len(history.records))
+	}
+	for _, r := range history.records {
+		if r.Domain == "a.example" && (r.Available || r.Reason != "timeout") {
+			t.Errorf("history has worker's result %+v instead of quorum", r)
+		}
+	}
+}
+
+func TestResultTimesAreClampedToLease(t *testing.T) {
+	svc, history := newTestLeaseService(t, &fakeProbes{})
+	submitTestSet(t, svc, "a.example", "b.example")
+	before := time.Now()
+	l := leaseTestTask(t, svc, "worker-a")
+
+	skewed := []LinkResult{available(0), available(1)}
+	skewed[0].Time = before.Add(-24 * time.Hour)
+	skewed[1].Time = before.Add(24 * time.Hour)
+	if err := svc.CompleteLease(l.ID, skewed); err != nil {
+		t.Fatalf("CompleteLease: %v", err)
+	}
+	after := time.Now()
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+	if len(history.records) != 2 {
+		t.Fatalf("got %d history records, want 2", len(history.records))
+	}
+	for _, r := range history.records {
+		if r.Time.Before(before) || r.Time.After(after) {
+			t.Errorf("record of %s has time %s outside of the lease [%s, %s]", r.Domain, r.Time, before, after)
+		}
+	}
+}
@@ -6,102 +6,341 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
 	apiModels "link-availability-checker/internal/api/models"
 	"link-availability-checker/internal/config"
 	"link-availability-checker/internal/models"
 	"link-availability-checker/internal/storage"
-	"link-availability-checker/internal/utils/files"
+	"link-availability-checker/internal/utils/ids"
+	"link-availability-checker/pkg/diskqueue"
+	"link-availability-checker/pkg/journal"
 	"link-availability-checker/pkg/pdf"
 )
 
 type LinkService interface {
-	CheckLinkSet(links *apiModels.CheckLinkSetRequest) (*models.Set, error)
+	SubmitLinkSet(ctx context.Context, links *apiModels.CheckLinkSetRequest, client models.Client) (Job, error)
+	CheckLinkSet(ctx context.Context, links *apiModels.CheckLinkSetRequest, client models.Client) (Job, error)
+	GetJob(id string) (Job, error)
+	CancelJob(id string) (Job, error)
+	SubscribeJob(id string) (past []JobEvent, events <-chan JobEvent, unsubscribe func(), err error)
+	// OnJobFinished registers fn to be called with every job reaching final state, set number of a job is only known
+	// once it's started, so callers needing it can't take it from the job returned on submit
+	OnJobFinished(fn func(job Job))
 	GetLinkSetAsPDF(ctx context.Context, set []int) (string, error)
+	// DeleteLinkSet removes a stored set, its number is never handed out again
+	DeleteLinkSet(number int) error
+	QueueStats() QueueStats
+	// HasIdempotencyKey tells if the client already used the idempotency key, so the request is a retry
+	HasIdempotencyKey(client, key string) bool
+
+	LeaseTask(ctx context.Context, worker string) (Lease, bool, error)
+	HeartbeatLease(id string, results []LinkResult) (time.Time, error)
+	CompleteLease(id string, results []LinkResult) error
+	ReleaseLease(id string, results []LinkResult) error
+
 	Shutdown(ctx context.Context) error
 }
 
+type QueueStats struct {
+	Depth    int // Tasks waiting in memory
+	Capacity int
+	Spilled  int // Tasks waiting in disk-backed overflow queue
+	// Spilled tasks that couldn't be decoded and were skipped, they are restored from journal on next start
+	SpillSkipped int
+	SpillError   error // Error reading spill queue, nil once a read succeeds
+	InFlight     int
+	Leased       int // In-flight tasks leased to remote workers
+	Workers      int
+	Busy         int // Local workers checking a set
+	Levels       []QueueLevelStats
+}
+
+// linkTask is a job checking one link set, its state fields are guarded by LinkServiceImpl.jobsMutex
 type linkTask struct {
-	set        *models.Set
-	resultChan chan *models.Set
+	id           string
+	client       models.Client
+	priority     models.Priority
+	callbackURL  string
+	set          *models.Set
+	checked      []bool // Links that already have a result, including ones restored from journal checkpoints
+	checkedCount atomic.Int64
+
+	ctx    context.Context // Canceled on shutdown or when the job is canceled
+	cancel context.CancelCauseFunc
+	async  bool                   // Submitted without waiting for result, abandon policy doesn't apply
+	worker string                 // Remote worker holding the lease, empty if the task isn't leased
+	trace  propagation.MapCarrier // Trace context of the request that submitted the task, kept across restarts
+
+	state       JobState
+	waiters     int
+	done        chan struct{} // Closed when job reaches final state
+	subscribers map[chan JobEvent]struct{}
+	createdAt   time.Time
+	finishedAt  time.Time
 }
 
 type fileTask struct {
-	Set *models.Set `json:"set"`
+	Client      models.Client     `json:"client"`
+	Priority    models.Priority   `json:"priority"`
+	CallbackURL string            `json:"callback_url,omitempty"`
+	Set         *models.Set       `json:"set"`
+	Trace       map[string]string `json:"trace,omitempty"`
 }
 
-var ErrServiceStopping = errors.New("service is shutting down, task queued for restart")
+// spilledTask is a restored task that didn't fit into in-memory queue
+type spilledTask struct {
+	ID          string            `json:"id"`
+	Client      models.Client     `json:"client"`
+	Priority    models.Priority   `json:"priority"`
+	CallbackURL string            `json:"callback_url,omitempty"`
+	Set         *models.Set       `json:"set"`
+	Checked     []bool            `json:"checked"`
+	Trace       map[string]string `json:"trace,omitempty"`
+}
+
+// taskStart is payload of journal start record, the set number is reserved when a worker picks the task up, so tasks
+// rejected by the queue don't leave gaps in numbering
+type taskStart struct {
+	Number int `json:"number"`
+}
+
+type linkProgress struct {
+	Index    int              `json:"index"`
+	Status   bool             `json:"status"`
+	Verdicts []models.Verdict `json:"verdicts,omitempty"`
+}
+
+// SetCheckTimeout limits time spent on checking a single set, links left unchecked are stored as unavailable
+const SetCheckTimeout = 5 * time.Second
+
+var (
+	ErrServiceStopping = errors.New("service is shutting down, task queued for restart")
+	ErrQueueFull       = errors.New("queue is full")
+)
 
 type LinkServiceImpl struct {
-	ls storage.LinkStorage
-	as AvailabilityService
+	ls        storage.LinkStorage
+	as        AvailabilityService
+	history   HistoryService
+	incidents IncidentService
+	probes    ProbeService
+	webhooks  WebhookService
+	journal   *journal.Journal
+
+	wg       sync.WaitGroup
+	queue    *taskQueue
+	stopping chan struct{}
+	stopOnce sync.Once
+
+	spill        *diskqueue.Queue
+	spillSignal  chan struct{}
+	spillSkipped atomic.Int64
+	spillError   atomic.Pointer[error] // Last error reading spill queue, nil once a read succeeds
+
+	idempotency *idempotencyStore
+
+	jobs            map[string]*linkTask
+	jobsMutex       sync.Mutex
+	finishListeners []func(job Job)
 
-	wg          sync.WaitGroup
-	queue       chan *linkTask
-	queueMutex  sync.Mutex
-	queueClosed bool
+	leases       map[string]*lease
+	leasesMutex  sync.Mutex
+	leasesClosed bool
+	leaseOps     sync.WaitGroup
+
+	busyWorkers atomic.Int64 // Local queue workers checking a set
 
 	shutdownCtx    context.Context
 	shutdownCancel context.CancelFunc
 }
 
-func NewLinkService(ls storage.LinkStorage, as AvailabilityService) LinkService {
+func NewLinkService(ls storage.LinkStorage, as AvailabilityService, hs HistoryService, is IncidentService, ps ProbeService, ws WebhookService, j *journal.Journal) (LinkService, error) {
+	spill, err := diskqueue.Open(viper.GetString(config.QueueSpillPath))
+	if err != nil {
+		return nil, err
+	}
+
+	idempotency, err := openIdempotencyStore()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open idempotency keys journal: %w", err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	svc := &LinkServiceImpl{
 		ls:             ls,
 		as:             as,
-		queue:          make(chan *linkTask, 1000),
+		history:        hs,
+		incidents:      is,
+		probes:         ps,
+		webhooks:       ws,
+		journal:        j,
+		jobs:           make(map[string]*linkTask),
+		leases:         make(map[string]*lease),
+		queue:          newTaskQueue(viper.GetInt(config.QueueLimit)),
+		stopping:       make(chan struct{}),
+		spill:          spill,
+		spillSignal:    make(chan struct{}, 1),
+		idempotency:    idempotency,
 		shutdownCtx:    ctx,
 		shutdownCancel: cancel,
 	}
 
-	if err := svc.LoadQueueFromFile(); err != nil {
-		log.Printf("Warning: failed to load queue from file: %v", err)
-	}
+	svc.restoreQueue()
 
 	for i := 0; i < viper.GetInt(config.QueueWorkers); i++ {
 		svc.wg.Add(1)
 		go svc.worker()
 	}
 
-	return svc
+	svc.wg.Add(1)
+	go svc.feedSpilled()
+
+	svc.wg.Add(1)
+	go svc.watchLeases()
+
+	registerQueueMetrics(svc)
+	return svc, nil
+}
+
+// SubmitLinkSet enqueues link set check without waiting for result, ctx only carries trace of the request
+func (svc *LinkServiceImpl) SubmitLinkSet(ctx context.Context, links *apiModels.CheckLinkSetRequest, client models.Client) (Job, error) {
+	task, replayed, err := svc.submit(context.WithoutCancel(ctx), links, client, true)
+	if err != nil {
+		if errors.Is(err, ErrServiceStopping) {
+			return Job{ID: task.id}, err
+		}
+		return Job{}, err
+	}
+	if task == nil {
+		return replayed, nil // Set of repeated request is already stored
+	}
+
+	job, err := svc.GetJob(task.id)
+	job.Replayed = replayed.Replayed
+	return job, err
+}
+
+// CheckLinkSet enqueues link set check and waits for result, abandon policy is applied if ctx is done before that
+func (svc *LinkServiceImpl) CheckLinkSet(ctx context.Context, links *apiModels.CheckLinkSetRequest, client models.Client) (Job, error) {
+	task, replayed, err := svc.submit(ctx, links, client, false)
+	if err != nil {
+		if errors.Is(err, ErrServiceStopping) {
+			return Job{ID: task.id}, err
+		}
+		return Job{}, err
+	}
+	if task == nil {
+		return replayed, nil
+	}
+
+	job, err := svc.waitJob(ctx, task)
+	job.Replayed = replayed.Replayed
+	if err != nil {
+		return job, err
+	}
+	if !job.State.Final() {
+		if svc.shutdownCtx.Err() != nil {
+			return job, ErrServiceStopping // Canceled by shutdown, task stays in journal
+		}
+		return job, ctx.Err()
+	}
+	if job.State == JobFailed {
+		return job, fmt.Errorf("job %s failed, it will be retried on next start", task.id)
+	}
+	return job, nil
 }
 
-func (svc *LinkServiceImpl) CheckLinkSet(links *apiModels.CheckLinkSetRequest) (*models.Set, error) {
+// enqueue journals the task and puts it into the queue, task is returned with ErrServiceStopping for reference
+func (svc *LinkServiceImpl) enqueue(ctx context.Context, links *apiModels.CheckLinkSetRequest, client models.Client, async bool) (task *linkTask, err error) {
+	ctx, span := tracer.Start(ctx, "LinkService.enqueue", trace.WithAttributes(
+		attribute.Int("links.count", len(links.Links)),
+		attribute.Bool("job.async", async),
+	))
+	defer func() { endSpan(span, err) }()
+
 	set := models.Set{Links: links.ConvertLinksToModel()}
+	task = svc.newTask(ids.New(), client, taskPriority(links, client), &set, make([]bool, len(set.Links)))
+	task.async = async
+	task.callbackURL = links.CallbackURL
+	task.trace = propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, task.trace)
+	span.SetAttributes(attribute.String("job.id", task.id), attribute.String("job.priority", task.priority.String()))
+
+	ft := fileTask{Client: task.client, Priority: task.priority, CallbackURL: task.callbackURL, Set: task.set, Trace: task.trace}
+	if err := svc.journal.Enqueue(task.id, ft); err != nil {
+		return nil, fmt.Errorf("failed to journal task: %w", err)
+	}
+	svc.registerJob(task)
 
-	resultChan := make(chan *models.Set)
-	task := &linkTask{set: &set, resultChan: resultChan}
+	pushCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration(config.QueueWaitTimeout))
+	err = svc.queue.Push(pushCtx, task)
+	cancel()
+	if errors.Is(err, errQueueClosed) {
+		return task, ErrServiceStopping // Task is already in journal and will be processed after restart
+	}
+	if err != nil {
+		if err = svc.journal.Complete(task.id); err != nil { // Rejected task must not be replayed
+			log.Printf("[SERVICE] Failed to journal rejection of task %s: %v", task.id, err)
+		}
+		svc.jobsMutex.Lock()
+		delete(svc.jobs, task.id)
+		svc.jobsMutex.Unlock()
+		return nil, ErrQueueFull
+	}
 
-	svc.queueMutex.Lock()
-	if svc.queueClosed {
-		defer svc.queueMutex.Unlock()
-		err := svc.appendTaskToFile(task)
-		if err != nil {
-			return nil, fmt.Errorf("service is shutting down and failed to save task: %w", err)
+	return task, nil
+}
+
+func (svc *LinkServiceImpl) newTask(id string, client models.Client, priority models.Priority, set *models.Set, checked []bool) *linkTask {
+	ctx, cancel := context.WithCancelCause(svc.shutdownCtx)
+	task := &linkTask{
+		id:        id,
+		client:    client,
+		priority:  priority,
+		set:       set,
+		checked:   checked,
+		ctx:       ctx,
+		cancel:    cancel,
+		state:     JobQueued,
+		done:      make(chan struct{}),
+		createdAt: time.Now(),
+	}
+	for _, c := range checked {
+		if c {
+			task.checkedCount.Add(1)
 		}
-		return nil, ErrServiceStopping
 	}
-	svc.queue <- task
-	svc.queueMutex.Unlock()
+	return task
+}
 
-	return <-resultChan, nil
+func (svc *LinkServiceImpl) DeleteLinkSet(number int) error {
+	if err := svc.ls.DeleteLinkSet(number); err != nil {
+		return err
+	}
+	log.Printf("[SERVICE] Deleted set #%d", number)
+	return nil
 }
 
 func (svc *LinkServiceImpl) GetLinkSetAsPDF(ctx context.Context, nums []int) (string, error) {
-	sets := make([]models.Set, 0, len(nums))
+	stored, err := svc.ls.GetLinkSets(nums)
+	if err != nil {
+		return "", fmt.Errorf("failed to get link sets: %w", err)
+	}
 
-	for _, num := range nums {
-		set, err := svc.ls.GetLinkSet(num)
-		if err != nil {
-			return "", fmt.Errorf("failed to get link set %d: %w", num, err) //TODO: Check custom error not lost here
-		}
+	sets := make([]models.Set, 0, len(nums))
+	for i, set := range stored {
+		num := nums[i]
 
 		if viper.GetBool(config.RecheckStatusesWhenPrinting) {
 			domains := make([]string, len(set.Links))
@@ -109,8 +348,8 @@ func (svc *LinkServiceImpl) GetLinkSetAsPDF(ctx context.Context, nums []int) (st
 				domains[i] = link.Domain
 			}
 
-			var statuses []bool
-			statuses, err = svc.checkDomainsAvailability(ctx, domains)
+			var results []models.CheckResult
+			results, err = svc.checkDomainsAvailability(ctx, domains, nil)
 			if err != nil {
 				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 					return "", err
@@ -118,8 +357,10 @@ func (svc *LinkServiceImpl) GetLinkSetAsPDF(ctx context.Context, nums []int) (st
 				return "", fmt.Errorf("failed to check domains for set %d: %w", num, err)
 			}
 
-			for i, status := range statuses {
-				set.Links[i].Status = status
+			for i, res := range results {
+				set.Links[i].Status = res.Available
+				set.Links[i].Skipped = false
+				set.Links[i].Verdicts = res.Verdicts
 			}
 		}
 
@@ -127,14 +368,29 @@ func (svc *LinkServiceImpl) GetLinkSetAsPDF(ctx context.Context, nums []int) (st
 	}
 
 	text := make([][]string, len(sets))
+	incidents := make([][]string, len(sets))
 	for i, set := range sets {
+		domains := make([]string, len(set.Links))
 		for j, link := range set.Links {
-			statusStr := models.ConvertStatusToString(link.Status)
+			statusStr := link.StatusString()
 			text[i] = append(text[i], fmt.Sprintf("%d. %-42s - %s\n", j+1, link.Domain, statusStr))
+			if len(link.Verdicts) > 0 {
+				text[i] = append(text[i], "    "+verdictsLine(link.Verdicts))
+			}
+			domains[j] = link.Domain
 		}
+
+		summary, err := svc.incidents.Summarize(domains, time.Now().Add(-viper.GetDuration(config.IncidentReportWindow)))
+		if err != nil {
+			log.Printf("[SERVICE] Failed to summarize incidents of set %d: %v", set.Number, err)
+			continue
+		}
+		incidents[i] = incidentLines(summary)
 	}
 
-	filePath, err := pdf.GeneratePDF(nums, text)
+	start := time.Now()
+	filePath, err := pdf.GeneratePDF(nums, text, incidents)
+	pdfDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
 		return "", fmt.Errorf("failed to generate PDF: %w", err)
 	}
@@ -142,65 +398,211 @@ func (svc *LinkServiceImpl) GetLinkSetAsPDF(ctx context.Context, nums []int) (st
 	return filePath, nil
 }
 
+// verdictsLine renders statuses of a link seen from every vantage point for the report
+func verdictsLine(verdicts []models.Verdict) string {
+	parts := make([]string, len(verdicts))
+	for i, v := range verdicts {
+		parts[i] = fmt.Sprintf("%s (%s): %s", v.Agent, v.Location, models.ConvertStatusToString(v.Status))
+		if !v.Status && v.Reason != "" {
+			parts[i] += ", " + v.Reason
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// incidentLines renders incident summary of a set for the report
+func incidentLines(summary IncidentSummary) []string {
+	lines := []string{
+		fmt.Sprintf("Total: %d, open: %d", len(summary.Incidents), summary.Open),
+		fmt.Sprintf("Total downtime: %s", summary.Downtime.Round(time.Second)),
+	}
+	if summary.MTTR > 0 {
+		lines = append(lines, fmt.Sprintf("MTTR: %s", summary.MTTR.Round(time.Second)))
+	}
+
+	now := time.Now()
+	for _, i := range summary.Incidents {
+		end := "ongoing"
+		if !i.Open() {
+			end = i.End.Format("2006-01-02 15:04")
+		}
+		lines = append(lines, fmt.Sprintf("%-30s %s - %-16s %10s  %s",
+			i.Domain, i.Start.Format("2006-01-02 15:04"), end, i.Duration(now).Round(time.Second), i.FirstReason))
+	}
+	return lines
+}
+
 func (svc *LinkServiceImpl) worker() {
 	defer svc.wg.Done()
 
-	for task := range svc.queue {
-		domains := make([]string, len(task.set.Links))
-		for i, link := range task.set.Links {
-			domains[i] = link.Domain
+	for {
+		task, ok := svc.queue.Pop()
+		if !ok {
+			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		statuses, err := svc.checkDomainsAvailability(ctx, domains)
-		cancel()
-		if err != nil && errors.Is(err, context.Canceled) {
-			log.Println("Worker: Task processing canceled due to shutdown.")
-			continue
+		if svc.shutdownCtx.Err() != nil {
+			continue // Shutdown deadline passed, leave remaining tasks in journal
+		}
+		if !svc.startJob(task) {
+			continue // Canceled while queued
+		}
+
+		svc.busyWorkers.Add(1)
+		svc.process(task)
+		svc.busyWorkers.Add(-1)
+	}
+}
+
+// process checks links of the task taken from the queue, span of the pickup continues trace of the request
+func (svc *LinkServiceImpl) process(task *linkTask) {
+	domains, indexes := svc.uncheckedLinks(task)
+
+	spanCtx, span := tracer.Start(task.traceContext(task.ctx), "LinkService.worker", trace.WithAttributes(
+		attribute.String("job.id", task.id),
+		attribute.Int("set.number", task.set.Number),
+		attribute.Int("links.count", len(domains)),
+		attribute.Float64("queue.wait_seconds", time.Since(task.createdAt).Seconds()),
+	))
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(spanCtx, SetCheckTimeout)
+	_, err := svc.checkDomainsAvailability(ctx, domains, func(i int, res models.CheckResult) {
+		svc.checkpoint(task, indexes[i], res)
+	})
+	cancel()
+	if err != nil && errors.Is(err, context.Canceled) {
+		if errors.Is(context.Cause(task.ctx), errJobCanceled) {
+			span.AddEvent("job canceled")
+			svc.finishCanceled(task)
+			return
 		}
+		log.Println("Worker: Task processing canceled due to shutdown.")
+		span.AddEvent("interrupted by shutdown")
+		svc.setJobState(task, JobQueued) // Will be resumed after restart
+		return
+	}
 
-		for i, status := range statuses {
-			task.set.Links[i].Status = status
+	svc.finishTask(spanCtx, task)
+}
+
+// uncheckedLinks returns links without checkpointed result, e.g. when the task was interrupted by restart, only those
+// are checked
+func (svc *LinkServiceImpl) uncheckedLinks(task *linkTask) (domains []string, indexes []int) {
+	svc.jobsMutex.Lock()
+	defer svc.jobsMutex.Unlock()
+
+	for i, link := range task.set.Links {
+		if !task.checked[i] {
+			domains = append(domains, link.Domain)
+			indexes = append(indexes, i)
 		}
+	}
+	return domains, indexes
+}
 
-		num, _ := svc.ls.SaveLinkSet(task.set)
-		task.set.Number = num
+// checkpoint records result of a link and journals it, so that it isn't checked again after restart
+func (svc *LinkServiceImpl) checkpoint(task *linkTask, index int, res models.CheckResult) {
+	svc.recordResult(task, index, res)
+	if err := svc.journal.Progress(task.id, linkProgress{Index: index, Status: res.Available, Verdicts: res.Verdicts}); err != nil {
+		log.Printf("[SERVICE] Failed to checkpoint link %d of task %s: %v", index, task.id, err)
+	}
+}
 
-		if task.resultChan != nil {
-			select {
-			case task.resultChan <- task.set:
-				// Sent
-			default:
-				// Skip
-				//log.Println("Worker: Result channel send skipped (client stopped listening).")
-			}
+// finishTask stores result of the checked set and completes the task
+func (svc *LinkServiceImpl) finishTask(ctx context.Context, task *linkTask) {
+	if _, err := svc.ls.SaveLinkSet(ctx, task.set); err != nil {
+		log.Printf("[SERVICE] Failed to save set of task %s, leaving it in journal: %v", task.id, err)
+		svc.setJobState(task, JobFailed)
+		return
+	}
+
+	// Callback is stored in outbox before the task leaves the journal, so it can't get lost in between
+	svc.notifyCallback(task, JobDone)
+	if err := svc.journal.Complete(task.id); err != nil {
+		log.Printf("[SERVICE] Failed to journal completion of task %s: %v", task.id, err)
+	}
+	svc.setJobState(task, JobDone)
+}
+
+// checkDomainsAvailability checks domains with CheckDomains, every result is added to domain history, even if the
+// check is interrupted. If probe agents are connected, the same domains are checked by them and status of each domain
+// is decided by quorum once they report, so results only come after that.
+func (svc *LinkServiceImpl) checkDomainsAvailability(ctx context.Context, domains []string, onResult func(index int, res models.CheckResult)) ([]models.CheckResult, error) {
+	var records []models.CheckRecord
+	var recordsMutex sync.Mutex
+	record := func(i int, res models.CheckResult) {
+		recordsMutex.Lock()
+		records = append(records, models.CheckRecord{
+			Domain:    domains[i],
+			Time:      time.Now(),
+			Available: res.Available,
+			Reason:    res.Reason,
+			Latency:   res.Latency,
+		})
+		recordsMutex.Unlock()
+
+		if onResult != nil {
+			onResult(i, res)
+		}
+	}
+
+	probed, ok := svc.probes.Probe(ctx, domains)
+	if !ok {
+		checked, err := CheckDomains(ctx, svc.as, domains, record)
+		svc.history.Record(records)
+		return checked, err
+	}
+
+	local := make([]*models.CheckResult, len(domains))
+	_, err := CheckDomains(ctx, svc.as, domains, func(i int, res models.CheckResult) {
+		local[i] = &res // Each index is written once
+	})
+	verdicts := <-probed
+
+	checked := make([]models.CheckResult, len(domains))
+	for i, res := range local {
+		if res == nil {
+			continue // Not checked by the server, e.g. canceled
 		}
+		checked[i] = decideQuorum(*res, verdicts[i])
+		record(i, checked[i])
 	}
+	svc.history.Record(records)
+
+	if err != nil {
+		return nil, err
+	}
+	return checked, nil
 }
 
-func (svc *LinkServiceImpl) checkDomainsAvailability(ctx context.Context, domains []string) ([]bool, error) {
+// CheckDomains checks domains using worker pool, onResult (if not nil) is called concurrently for each successfully
+// checked domain as soon as its result is known
+func CheckDomains(ctx context.Context, as AvailabilityService, domains []string, onResult func(index int, res models.CheckResult)) ([]models.CheckResult, error) {
 	type result struct {
-		index  int
-		status bool
-		err    error
+		index int
+		res   models.CheckResult
+		err   error
 	}
 
 	jobs := make(chan int, len(domains))
 	results := make(chan result, len(domains))
 
-	numWorkers := len(domains) / viper.GetInt(config.WorkersRatio) // Config validation enforces WorkersRatio > 0
-	if numWorkers > viper.GetInt(config.MaxWorkers) {
-		numWorkers = viper.GetInt(config.MaxWorkers) // Hard limit
-	}
+	numWorkers := as.PoolSize(len(domains))
 
 	var wg sync.WaitGroup
 	for w := 0; w < numWorkers; w++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+			checkersBusy.Inc()
+			defer checkersBusy.Dec()
 			for i := range jobs {
-				status, err := svc.as.CheckDomainAvailability(ctx, domains[i])
-				results <- result{index: i, status: status, err: err}
+				res, err := as.CheckDomainAvailability(ctx, domains[i])
+				if err == nil && onResult != nil {
+					onResult(i, res)
+				}
+				results <- result{index: i, res: res, err: err}
 			}
 		}()
 	}
@@ -213,101 +615,212 @@ func (svc *LinkServiceImpl) checkDomainsAvailability(ctx context.Context, domain
 	wg.Wait()
 	close(results)
 
-	statuses := make([]bool, len(domains))
-	for res := range results {
-		if res.err != nil {
-			return nil, res.err
+	checked := make([]models.CheckResult, len(domains))
+	var err error
+	for r := range results {
+		if r.err != nil {
+			err = r.err
+			continue
 		}
-		statuses[res.index] = res.status
+		checked[r.index] = r.res
 	}
 
-	return statuses, nil
+	if err != nil {
+		return nil, err
+	}
+	return checked, nil
 }
 
-func (svc *LinkServiceImpl) LoadQueueFromFile() error {
-	svc.queueMutex.Lock() //MARK: Needed?
-	defer svc.queueMutex.Unlock()
-
-	filePath := viper.GetString(config.QueueFilePath)
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil // Assume no file means no queued tasks
-		}
-		return err
+// taskPriority returns priority requested by the client capped by client's own priority, small sets are bumped one
+// level up so that they don't wait behind huge ones
+func taskPriority(links *apiModels.CheckLinkSetRequest, client models.Client) models.Priority {
+	priority := client.Priority
+	if requested, ok := models.ParsePriority(links.Priority); ok && links.Priority != "" && requested < priority {
+		priority = requested
 	}
+	if len(links.Links) <= viper.GetInt(config.QueueSmallSetSize) && priority < models.PriorityHigh {
+		priority++
+	}
+	return priority
+}
 
-	var fileTasks []fileTask
-	if err = json.Unmarshal(data, &fileTasks); err != nil {
-		return err
+func (svc *LinkServiceImpl) restoreQueue() {
+	tasks := svc.journal.Pending()
+	if len(tasks) == 0 {
+		return
 	}
 
-	log.Printf("[SERVICE] Loading remaining %d tasks from queue...", len(fileTasks))
+	log.Printf("[SERVICE] Restoring %d unfinished tasks from journal...", len(tasks))
+
+	for _, jt := range tasks {
+		var ft fileTask
+		if err := json.Unmarshal(jt.Payload, &ft); err != nil || ft.Set == nil {
+			log.Printf("[SERVICE] Skipping unreadable journal task %s: %v", jt.ID, err)
+			continue
+		}
+
+		checked := make([]bool, len(ft.Set.Links))
+		done := 0
+		for _, raw := range jt.Progress {
+			var p linkProgress
+			if err := json.Unmarshal(raw, &p); err != nil || p.Index < 0 || p.Index >= len(checked) {
+				continue
+			}
+			ft.Set.Links[p.Index].Status = p.Status
+			ft.Set.Links[p.Index].Verdicts = p.Verdicts
+			if !checked[p.Index] {
+				checked[p.Index] = true
+				done++
+			}
+		}
+		if jt.Started {
+			log.Printf("[SERVICE] Task %s (set #%d) was interrupted while processing, resuming with %d of %d links checked", jt.ID, ft.Set.Number, done, len(checked))
+		}
 
-	for _, ft := range fileTasks {
-		task := &linkTask{
-			set:        ft.Set,
-			resultChan: nil, // No need to return results for loaded tasks after restart - no clients waiting
+		// Keep number given to the set when it was started before restart, older journals have it in the enqueue
+		// record. Tasks that weren't started get a number when they are.
+		var start taskStart
+		if jt.Start != nil && json.Unmarshal(jt.Start, &start) == nil && start.Number > 0 {
+			ft.Set.Number = start.Number
 		}
-		select {
-		case svc.queue <- task:
-		default:
-			log.Println("Queue is full, skipping restored task")
+		if ft.Set.Number != 0 {
+			svc.ls.EnsureSetNumberReserved(ft.Set.Number)
+		}
+
+		// No clients wait for restored tasks, their results can be fetched by job ID
+		task := svc.newTask(jt.ID, ft.Client, ft.Priority, ft.Set, checked)
+		task.async = true
+		task.callbackURL = ft.CallbackURL
+		task.trace = ft.Trace
+		svc.registerJob(task)
+
+		if !svc.queue.TryPush(task) {
+			if err := svc.spill.Push(task.spilled()); err != nil {
+				log.Printf("[SERVICE] Failed to spill restored task %s, it will be retried on next start: %v", task.id, err)
+			}
 		}
 	}
 
-	files.Delete(filePath)
-	return nil
+	if n := svc.spill.Len(); n > 0 {
+		log.Printf("[SERVICE] Queue is full, %d restored tasks spilled to disk", n)
+		svc.notifySpilled()
+	}
 }
 
-func (svc *LinkServiceImpl) drainQueue() []*linkTask {
-	tasks := make([]*linkTask, 0, len(svc.queue))
-	for task := range svc.queue {
-		tasks = append(tasks, task)
+func (task *linkTask) spilled() spilledTask {
+	return spilledTask{
+		ID:          task.id,
+		Client:      task.client,
+		Priority:    task.priority,
+		CallbackURL: task.callbackURL,
+		Set:         task.set,
+		Checked:     task.checked,
+		Trace:       task.trace,
 	}
-	return tasks
 }
 
-func (svc *LinkServiceImpl) SaveQueueToFile(tasks []*linkTask) error {
-	fileTasks := make([]fileTask, len(tasks))
-	for i, t := range tasks {
-		fileTasks[i] = fileTask{Set: t.set}
+// notifyCallback sends result of the finished task to its callback URL, if any
+func (svc *LinkServiceImpl) notifyCallback(task *linkTask, state JobState) {
+	if task.callbackURL == "" {
+		return
 	}
 
-	data, err := json.MarshalIndent(fileTasks, "", "  ")
-	if err != nil {
-		return err
-	}
+	svc.jobsMutex.Lock()
+	job := task.snapshot()
+	svc.jobsMutex.Unlock()
+
+	job.State = state
+	job.Set = task.set
+	svc.webhooks.Notify(task.callbackURL, job)
+}
 
-	return os.WriteFile(viper.GetString(config.QueueFilePath), data, 0644)
+func (svc *LinkServiceImpl) notifySpilled() {
+	select {
+	case svc.spillSignal <- struct{}{}:
+	default: // Feeder is already notified
+	}
 }
 
-func (svc *LinkServiceImpl) appendTaskToFile(task *linkTask) error {
-	var fileTasks []fileTask
+// spillRetryDelay is how long feeding waits after spill queue fails to read
+const spillRetryDelay = 5 * time.Second
+
+// feedSpilled moves tasks from disk-backed overflow queue to in-memory queue as it frees up. Records that can't be
+// decoded are skipped, read errors are retried, both are reported by readiness check.
+func (svc *LinkServiceImpl) feedSpilled() {
+	defer svc.wg.Done()
+
+	for {
+		var st spilledTask
+		ok, err := svc.spill.Pop(&st)
+		if errors.Is(err, diskqueue.ErrMalformedRecord) {
+			n := svc.spillSkipped.Add(1)
+			log.Printf("[SERVICE] Skipped spilled task #%d that can't be read, it will be restored from journal on next start: %v", n, err)
+			continue
+		}
+		if err != nil {
+			if svc.spillError.Swap(&err) == nil {
+				log.Printf("[SERVICE] Failed to read spill queue, retrying every %s: %v", spillRetryDelay, err)
+			}
+			select {
+			case <-time.After(spillRetryDelay):
+				continue
+			case <-svc.stopping:
+				return
+			}
+		}
+		if svc.spillError.Swap(nil) != nil {
+			log.Println("[SERVICE] Spill queue is readable again")
+		}
+		if !ok {
+			select {
+			case <-svc.spillSignal:
+				continue
+			case <-svc.stopping:
+				return
+			}
+		}
 
-	data, err := os.ReadFile(viper.GetString(config.QueueFilePath))
-	if err == nil {
-		_ = json.Unmarshal(data, &fileTasks)
+		task := svc.lookupJob(st.ID) // Keep the same task, it may have been canceled while spilled
+		if task == nil {
+			task = svc.newTask(st.ID, st.Client, st.Priority, st.Set, st.Checked)
+			task.trace = st.Trace
+			task.async = true
+			task.callbackURL = st.CallbackURL
+			svc.registerJob(task)
+		}
+		if err = svc.queue.Push(context.Background(), task); err != nil {
+			return // Queue is closed, task is still in journal
+		}
 	}
+}
 
-	fileTasks = append(fileTasks, fileTask{Set: task.set})
+func (svc *LinkServiceImpl) QueueStats() QueueStats {
+	inFlight := svc.countJobs(JobRunning)
+	var spillErr error
+	if p := svc.spillError.Load(); p != nil {
+		spillErr = *p
+	}
 
-	q, err := json.MarshalIndent(fileTasks, "", "  ")
-	if err != nil {
-		return err
+	return QueueStats{
+		Depth:    svc.queue.Len(),
+		Capacity: svc.queue.Cap(),
+		Spilled:  svc.spill.Len(),
+		InFlight: inFlight,
+		Leased:   svc.countLeases(),
+		Workers:  viper.GetInt(config.QueueWorkers),
+		Busy:     int(svc.busyWorkers.Load()),
+		Levels:   svc.queue.Stats(),
+
+		SpillSkipped: int(svc.spillSkipped.Load()),
+		SpillError:   spillErr,
 	}
-	return os.WriteFile(viper.GetString(config.QueueFilePath), q, 0644)
 }
 
 func (svc *LinkServiceImpl) Shutdown(ctx context.Context) error {
 	log.Println("[SERVICE] Stopping queue...")
 
-	svc.queueMutex.Lock()
-	if !svc.queueClosed {
-		close(svc.queue)
-		svc.queueClosed = true
-	}
-	svc.queueMutex.Unlock()
+	svc.stopOnce.Do(func() { close(svc.stopping) })
+	svc.queue.Close()
 
 	log.Println("[SERVICE] Waiting for workers to finish...")
 	waitDone := make(chan struct{})
@@ -316,28 +829,32 @@ func (svc *LinkServiceImpl) Shutdown(ctx context.Context) error {
 		close(waitDone)
 	}()
 
-	var pending []*linkTask
 	select {
 	case <-waitDone:
 		log.Println("[SERVICE] Workers finished gracefully.")
 	case <-ctx.Done():
 		log.Printf("[SERVICE] Workers failed to finish before Fx deadline: %v", ctx.Err())
-		log.Println("[SERVICE] Draining in-memory queue for persistence...")
-		pending = svc.drainQueue()
+		log.Printf("[SERVICE] Canceling %d in-flight tasks, their checked links are checkpointed in journal...", svc.countJobs(JobRunning))
+		svc.shutdownCancel()
+		<-waitDone
 	}
 
+	svc.closeLeases(ctx)
 	svc.shutdownCancel()
+	svc.closeSubscribers()
+
+	if err := svc.spill.Close(); err != nil {
+		log.Printf("[SERVICE] Failed to close spill queue: %v", err)
+	}
 
-	if len(pending) == 0 {
-		log.Println("[SERVICE] No pending tasks to persist.")
-		return nil
+	if err := svc.idempotency.Close(); err != nil {
+		log.Printf("[SERVICE] Failed to close idempotency keys journal: %v", err)
 	}
 
-	log.Println("[SERVICE] Saving task queue to disk...")
-	if err := svc.SaveQueueToFile(pending); err != nil {
-		return fmt.Errorf("failed to save task queue: %w", err)
+	if err := svc.journal.Close(); err != nil {
+		return fmt.Errorf("failed to close queue journal: %w", err)
 	}
 
-	log.Println("[SERVICE] Task queue saved successfully")
+	log.Printf("[SERVICE] Queue journal closed, %d unfinished tasks will be restored on next start", len(svc.journal.Pending()))
 	return nil
 }
@@ -0,0 +1,107 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/storage"
+)
+
+var (
+	checkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "link_checker_check_duration_seconds",
+		Help:    "Duration of domain check steps by probe (dns, head, get) and result reason",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8},
+	}, []string{"probe", "reason"})
+	checkersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "link_checker_checkers_busy",
+		Help: "Checker goroutines checking domains at the moment",
+	})
+	pdfDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "link_checker_pdf_generation_duration_seconds",
+		Help:    "Duration of PDF report rendering",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	})
+)
+
+// registerQueueMetrics exposes queue state of the service, it's read on every scrape
+func registerQueueMetrics(svc *LinkServiceImpl) {
+	gauge := func(name, help string, f func() float64) {
+		promauto.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f)
+	}
+	gauge("link_checker_queue_depth", "Tasks waiting in memory queue", func() float64 {
+		return float64(svc.queue.Len())
+	})
+	gauge("link_checker_queue_capacity", "Capacity of memory queue", func() float64 {
+		return float64(svc.queue.Cap())
+	})
+	gauge("link_checker_queue_spilled", "Tasks waiting in disk-backed overflow queue", func() float64 {
+		return float64(svc.spill.Len())
+	})
+	gauge("link_checker_queue_workers_busy", "Queue workers checking a set", func() float64 {
+		return float64(svc.busyWorkers.Load())
+	})
+	gauge("link_checker_queue_workers_idle", "Queue workers waiting for a task", func() float64 {
+		return float64(int64(viper.GetInt(config.QueueWorkers)) - svc.busyWorkers.Load())
+	})
+	if inspector, ok := svc.ls.(storage.Inspector); ok {
+		gauge("link_checker_sets_stored", "Link sets stored by the storage backend", func() float64 {
+			return float64(inspector.CountLinkSets())
+		})
+	}
+}
+
+// probeStep is a step of domain check, it's traced as a child span of the check and its duration is measured
+type probeStep struct {
+	probe string
+	start time.Time
+	span  trace.Span
+}
+
+// startProbe starts a step, probe is dns, head or get
+func startProbe(ctx context.Context, probe string) (context.Context, *probeStep) {
+	ctx, span := tracer.Start(ctx, "probe "+probe)
+	return ctx, &probeStep{probe: probe, start: time.Now(), span: span}
+}
+
+// end records duration of the step that finished with reason, which is also the reason of the check if it fails
+func (p *probeStep) end(reason string) {
+	checkDuration.WithLabelValues(p.probe, reasonClass(reason)).Observe(time.Since(p.start).Seconds())
+	p.span.SetAttributes(attribute.String("check.reason", reason))
+	p.span.End()
+}
+
+// abort ends the step interrupted by ctx, interrupted steps would skew the histogram
+func (p *probeStep) abort(err error) {
+	endSpan(p.span, err)
+}
+
+// reasonClass groups unavailability reasons, raw reasons contain addresses and would make too many series
+func reasonClass(reason string) string {
+	switch {
+	case reason == "ok" || reason == "invalid domain":
+		return strings.ReplaceAll(reason, " ", "_")
+	case strings.HasPrefix(reason, "dns: "):
+		return "dns"
+	case strings.HasPrefix(reason, "http ") && len(reason) > len("http "):
+		return "http_" + reason[len("http "):len("http ")+1] + "xx"
+	case strings.Contains(reason, "timeout") || strings.Contains(reason, "deadline exceeded"):
+		return "timeout"
+	case strings.Contains(reason, "certificate") || strings.Contains(reason, "x509") || strings.Contains(reason, "tls"):
+		return "tls"
+	case strings.Contains(reason, "connection refused"):
+		return "refused"
+	case strings.Contains(reason, "connection reset") || strings.Contains(reason, "EOF"):
+		return "reset"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,299 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/utils/ids"
+)
+
+// ProbeService asks probe agents in other locations to check the same domains as the server, so that a domain that
+// is only unreachable from one place isn't reported down
+//
+// Agents register and then long-poll for probe requests. Each request is given to every agent that polled within
+// agent TTL, agents that don't report before probe timeout are left out of the decision.
+type ProbeService interface {
+	RegisterAgent(id, location string) ProbeAgent
+	// PollRequests waits for probe requests of the agent, none are returned if nothing came before poll timeout
+	PollRequests(ctx context.Context, agentID string) ([]ProbeRequest, error)
+	ReportResults(agentID, requestID string, results []ProbeResult) error
+	GetAgents() []ProbeAgent
+
+	// Probe sends domains to live agents and returns a channel receiving verdicts of each domain once all agents
+	// reported or probe timeout passed, false is returned if there are no live agents
+	Probe(ctx context.Context, domains []string) (<-chan [][]models.Verdict, bool)
+}
+
+type ProbeAgent struct {
+	ID           string
+	Location     string
+	RegisteredAt time.Time
+	LastSeen     time.Time
+}
+
+type ProbeRequest struct {
+	ID       string
+	Domains  []string
+	Deadline time.Time
+}
+
+type ProbeResult struct {
+	Index     int
+	Available bool
+	Reason    string
+}
+
+var (
+	ErrAgentNotFound        = errors.New("probe agent is not registered")
+	ErrProbeRequestNotFound = errors.New("probe request not found or expired")
+)
+
+type probeAgent struct {
+	ProbeAgent
+	inbox  []*probeRequest
+	signal chan struct{}
+}
+
+type probeRequest struct {
+	ProbeRequest
+	agents   map[string]bool // Agents the request was sent to, true once reported
+	verdicts [][]models.Verdict
+	done     chan struct{} // Closed once every agent reported
+}
+
+type ProbeServiceImpl struct {
+	mutex    sync.Mutex
+	agents   map[string]*probeAgent
+	requests map[string]*probeRequest
+
+	stop chan struct{}
+}
+
+func NewProbeService(lc fx.Lifecycle) ProbeService {
+	svc := &ProbeServiceImpl{
+		agents:   make(map[string]*probeAgent),
+		requests: make(map[string]*probeRequest),
+		stop:     make(chan struct{}),
+	}
+	lc.Append(fx.Hook{OnStop: func(context.Context) error {
+		close(svc.stop) // Release long polls, so that the web server can stop
+		return nil
+	}})
+	return svc
+}
+
+func (svc *ProbeServiceImpl) RegisterAgent(id, location string) ProbeAgent {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	now := time.Now()
+	a, ok := svc.agents[id]
+	if !ok {
+		a = &probeAgent{ProbeAgent: ProbeAgent{ID: id, RegisteredAt: now}, signal: make(chan struct{}, 1)}
+		svc.agents[id] = a
+		log.Printf("[PROBES] Agent %s registered from %s", id, location)
+	}
+	a.Location = location
+	a.LastSeen = now
+	return a.ProbeAgent
+}
+
+func (svc *ProbeServiceImpl) PollRequests(ctx context.Context, agentID string) ([]ProbeRequest, error) {
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration(config.ProbePollTimeout))
+	defer cancel()
+
+	for {
+		svc.mutex.Lock()
+		a, ok := svc.agents[agentID]
+		if !ok {
+			svc.mutex.Unlock()
+			return nil, ErrAgentNotFound
+		}
+		a.LastSeen = time.Now()
+		inbox := a.inbox
+		a.inbox = nil
+		svc.mutex.Unlock()
+
+		if len(inbox) > 0 {
+			requests := make([]ProbeRequest, len(inbox))
+			for i, r := range inbox {
+				requests[i] = r.ProbeRequest
+			}
+			return requests, nil
+		}
+
+		select {
+		case <-a.signal:
+		case <-ctx.Done():
+			return nil, nil
+		case <-svc.stop:
+			return nil, nil
+		}
+	}
+}
+
+func (svc *ProbeServiceImpl) ReportResults(agentID, requestID string, results []ProbeResult) error {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	a, ok := svc.agents[agentID]
+	if !ok {
+		return ErrAgentNotFound
+	}
+	a.LastSeen = time.Now()
+
+	r, ok := svc.requests[requestID]
+	if !ok {
+		return ErrProbeRequestNotFound
+	}
+	reported, ok := r.agents[agentID]
+	if !ok {
+		return ErrProbeRequestNotFound // Sent to other agents only
+	}
+	if reported {
+		return nil
+	}
+	r.agents[agentID] = true
+
+	for _, res := range results {
+		if res.Index < 0 || res.Index >= len(r.verdicts) {
+			continue
+		}
+		r.verdicts[res.Index] = append(r.verdicts[res.Index], models.Verdict{
+			Agent:    a.ID,
+			Location: a.Location,
+			Status:   res.Available,
+			Reason:   res.Reason,
+		})
+	}
+
+	for _, reported := range r.agents {
+		if !reported {
+			return nil
+		}
+	}
+	close(r.done)
+	return nil
+}
+
+func (svc *ProbeServiceImpl) GetAgents() []ProbeAgent {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	agents := make([]ProbeAgent, 0, len(svc.agents))
+	for _, a := range svc.agents {
+		agents = append(agents, a.ProbeAgent)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].ID < agents[j].ID })
+	return agents
+}
+
+func (svc *ProbeServiceImpl) Probe(ctx context.Context, domains []string) (<-chan [][]models.Verdict, bool) {
+	ttl := viper.GetDuration(config.ProbeAgentTTL)
+	timeout := viper.GetDuration(config.ProbeTimeout)
+
+	r := &probeRequest{
+		ProbeRequest: ProbeRequest{ID: ids.New(), Domains: domains, Deadline: time.Now().Add(timeout)},
+		agents:       make(map[string]bool),
+		verdicts:     make([][]models.Verdict, len(domains)),
+		done:         make(chan struct{}),
+	}
+
+	svc.mutex.Lock()
+	for id, a := range svc.agents {
+		if time.Since(a.LastSeen) > ttl {
+			continue
+		}
+		r.agents[id] = false
+		a.inbox = append(a.inbox, r)
+		select {
+		case a.signal <- struct{}{}:
+		default: // Agent is already notified
+		}
+	}
+	if len(r.agents) == 0 {
+		svc.mutex.Unlock()
+		return nil, false
+	}
+	svc.requests[r.ID] = r
+	svc.mutex.Unlock()
+
+	result := make(chan [][]models.Verdict, 1)
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case <-r.done:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+
+		svc.mutex.Lock()
+		delete(svc.requests, r.ID)
+		for id, reported := range r.agents {
+			if reported {
+				continue
+			}
+			log.Printf("[PROBES] Agent %s didn't report in time, probe is decided without it", id)
+			if a, ok := svc.agents[id]; ok {
+				for i, pending := range a.inbox {
+					if pending == r {
+						a.inbox = append(a.inbox[:i], a.inbox[i+1:]...)
+						break
+					}
+				}
+			}
+		}
+		verdicts := r.verdicts
+		svc.mutex.Unlock()
+
+		for _, v := range verdicts {
+			sort.Slice(v, func(i, j int) bool { return v[i].Agent < v[j].Agent }) // Same order whichever agent reported first
+		}
+
+		result <- verdicts
+	}()
+	return result, true
+}
+
+// decideQuorum combines result of the server with verdicts of probe agents. Domain is down if quorum of vantage
+// points saw it down, if fewer of them answered, only if all of them did.
+func decideQuorum(local models.CheckResult, verdicts []models.Verdict) models.CheckResult {
+	all := append([]models.Verdict{{
+		Agent:    "local",
+		Location: viper.GetString(config.ProbeLocation),
+		Status:   local.Available,
+		Reason:   local.Reason,
+	}}, verdicts...)
+
+	down := 0
+	for _, v := range all {
+		if !v.Status {
+			down++
+		}
+	}
+	quorum := viper.GetInt(config.ProbeQuorum)
+	if quorum <= 0 {
+		quorum = len(all)/2 + 1 // Majority
+	}
+	quorum = min(quorum, len(all))
+
+	result := models.CheckResult{Available: down < quorum, Latency: local.Latency, Verdicts: all}
+	for _, v := range all {
+		if v.Status == result.Available {
+			result.Reason = v.Reason // Reason of the first vantage point that agrees, the server's own if possible
+			break
+		}
+	}
+	return result
+}
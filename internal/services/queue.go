@@ -0,0 +1,251 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"link-availability-checker/internal/models"
+)
+
+var errQueueClosed = errors.New("queue is closed")
+
+// taskQueue is a bounded queue with strict priorities between levels and weighted fair queuing between clients
+// within a level
+//
+// Each task gets a virtual finish tag: max(level virtual time, client's last tag) + task cost / client weight, where
+// cost is the number of links in the set. Pop takes the task with the smallest tag among client heads of the highest
+// non-empty level, so a client with weight 2 gets twice as many links checked as a client with weight 1, and one
+// client submitting huge sets can't starve others.
+type taskQueue struct {
+	mutex    sync.Mutex
+	levels   [models.PriorityHigh + 1]*queueLevel
+	size     int
+	capacity int
+	closed   bool
+	changed  chan struct{} // Closed and replaced on every change to wake up waiters
+}
+
+type queueLevel struct {
+	clients     map[string]*clientQueue
+	virtualTime float64
+	dequeued    int
+}
+
+type clientQueue struct {
+	tasks      []*queuedTask
+	weight     int
+	lastFinish float64
+	dequeued   int
+}
+
+type queuedTask struct {
+	task   *linkTask
+	finish float64
+}
+
+type QueueLevelStats struct {
+	Priority    models.Priority
+	Depth       int
+	Dequeued    int
+	VirtualTime float64
+	Clients     []QueueClientStats
+}
+
+type QueueClientStats struct {
+	ID       string
+	Weight   int
+	Depth    int
+	Dequeued int
+}
+
+func newTaskQueue(capacity int) *taskQueue {
+	q := &taskQueue{capacity: capacity, changed: make(chan struct{})}
+	for i := range q.levels {
+		q.levels[i] = &queueLevel{clients: make(map[string]*clientQueue)}
+	}
+	return q
+}
+
+// Push adds task to the queue, waiting for free slot until ctx is done
+func (q *taskQueue) Push(ctx context.Context, task *linkTask) error {
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return errQueueClosed
+		}
+		if q.size < q.capacity {
+			q.insert(task)
+			q.mutex.Unlock()
+			return nil
+		}
+		changed := q.changed
+		q.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TryPush adds task to the queue if there is a free slot
+func (q *taskQueue) TryPush(task *linkTask) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed || q.size >= q.capacity {
+		return false
+	}
+	q.insert(task)
+	return true
+}
+
+// Pop waits for the next task, returns false once the queue is closed and empty
+func (q *taskQueue) Pop() (*linkTask, bool) {
+	return q.PopContext(context.Background())
+}
+
+// PopContext is Pop that also gives up when ctx is done
+func (q *taskQueue) PopContext(ctx context.Context) (*linkTask, bool) {
+	for {
+		q.mutex.Lock()
+		if task := q.next(); task != nil {
+			q.mutex.Unlock()
+			return task, true
+		}
+		if q.closed {
+			q.mutex.Unlock()
+			return nil, false
+		}
+		changed := q.changed
+		q.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// Remove takes task out of the queue, returns false if it isn't queued
+func (q *taskQueue) Remove(id string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, level := range q.levels {
+		for _, cq := range level.clients {
+			for i, qt := range cq.tasks {
+				if qt.task.id == id {
+					cq.tasks = append(cq.tasks[:i], cq.tasks[i+1:]...)
+					q.size--
+					q.notify()
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Close stops accepting new tasks, remaining tasks can still be popped
+func (q *taskQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		q.notify()
+	}
+}
+
+func (q *taskQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.size
+}
+
+func (q *taskQueue) Cap() int { return q.capacity }
+
+func (q *taskQueue) Stats() []QueueLevelStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := make([]QueueLevelStats, 0, len(q.levels))
+	for p := len(q.levels) - 1; p >= 0; p-- {
+		level := q.levels[p]
+		ls := QueueLevelStats{Priority: models.Priority(p), Dequeued: level.dequeued, VirtualTime: level.virtualTime}
+		for id, cq := range level.clients {
+			ls.Depth += len(cq.tasks)
+			ls.Clients = append(ls.Clients, QueueClientStats{ID: id, Weight: cq.weight, Depth: len(cq.tasks), Dequeued: cq.dequeued})
+		}
+		sort.Slice(ls.Clients, func(i, j int) bool { return ls.Clients[i].ID < ls.Clients[j].ID })
+		stats = append(stats, ls)
+	}
+	return stats
+}
+
+// insert puts task into its client queue with a virtual finish tag, caller must hold the mutex
+func (q *taskQueue) insert(task *linkTask) {
+	level := q.levels[task.priority]
+	cq, ok := level.clients[task.client.ID]
+	if !ok {
+		cq = &clientQueue{lastFinish: level.virtualTime}
+		level.clients[task.client.ID] = cq
+	}
+	cq.weight = max(task.client.Weight, 1)
+
+	start := max(level.virtualTime, cq.lastFinish)
+	cost := float64(max(len(task.set.Links), 1))
+	cq.lastFinish = start + cost/float64(cq.weight)
+	cq.tasks = append(cq.tasks, &queuedTask{task: task, finish: cq.lastFinish})
+
+	q.size++
+	q.notify()
+}
+
+// next removes and returns the task to process next or nil if queue is empty, caller must hold the mutex
+func (q *taskQueue) next() *linkTask {
+	for p := len(q.levels) - 1; p >= 0; p-- {
+		level := q.levels[p]
+
+		var bestID string
+		var best *clientQueue
+		for id, cq := range level.clients {
+			if len(cq.tasks) == 0 {
+				continue
+			}
+			if best == nil || cq.tasks[0].finish < best.tasks[0].finish || (cq.tasks[0].finish == best.tasks[0].finish && id < bestID) {
+				bestID, best = id, cq
+			}
+		}
+		if best == nil {
+			continue
+		}
+
+		qt := best.tasks[0]
+		best.tasks[0] = nil
+		best.tasks = best.tasks[1:]
+		best.dequeued++
+		level.dequeued++
+		level.virtualTime = qt.finish
+		if len(best.tasks) == 0 && best.lastFinish <= level.virtualTime {
+			delete(level.clients, bestID) // Idle client has no credit left to keep track of
+		}
+
+		q.size--
+		q.notify()
+		return qt.task
+	}
+	return nil
+}
+
+// notify wakes up everyone waiting for queue change, caller must hold the mutex
+func (q *taskQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
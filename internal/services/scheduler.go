@@ -0,0 +1,449 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/storage"
+	"link-availability-checker/internal/utils/closer"
+	"link-availability-checker/internal/utils/ids"
+)
+
+// SchedulerService periodically re-checks stored sets and watchlists through the link check queue. Domains of
+// watchlists and scheduled sets are the monitored ones, incidents only trigger alerts for them.
+type SchedulerService interface {
+	SaveWatchlist(w models.Watchlist) error
+	GetWatchlists() []models.Watchlist
+	DeleteWatchlist(name string) error
+
+	CreateSchedule(s models.Schedule) (models.Schedule, error)
+	GetSchedules() []models.Schedule
+	DeleteSchedule(id string) error
+	GetRuns(scheduleID string) ([]models.ScheduleRun, error)
+
+	Shutdown(ctx context.Context) error
+}
+
+var (
+	ErrScheduleNotFound  = errors.New("schedule not found")
+	ErrWatchlistNotFound = errors.New("watchlist not found")
+	ErrWatchlistInUse    = errors.New("watchlist is used by a schedule")
+	ErrInvalidSchedule   = errors.New("invalid schedule")
+)
+
+// schedulerClient is the client scheduled checks are submitted as, it may use any priority
+var schedulerClient = models.Client{ID: "scheduler", Priority: models.PriorityHigh, Weight: 1}
+
+type schedulerState struct {
+	Watchlists map[string]models.Watchlist `json:"watchlists"`
+	Schedules  map[string]*models.Schedule `json:"schedules"`
+}
+
+type SchedulerServiceImpl struct {
+	ls        storage.LinkStorage
+	lsv       LinkService
+	incidents IncidentService
+
+	mutex sync.Mutex
+	state schedulerState
+
+	runsMutex    sync.Mutex
+	monitorMutex sync.Mutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewSchedulerService(ls storage.LinkStorage, lsv LinkService, is IncidentService) (SchedulerService, error) {
+	svc := &SchedulerServiceImpl{
+		ls:        ls,
+		lsv:       lsv,
+		incidents: is,
+		state:     schedulerState{Watchlists: make(map[string]models.Watchlist), Schedules: make(map[string]*models.Schedule)},
+		stop:      make(chan struct{}),
+	}
+
+	if err := svc.load(); err != nil {
+		return nil, fmt.Errorf("failed to load schedules: %w", err)
+	}
+	if len(svc.state.Schedules) > 0 {
+		log.Printf("[SCHEDULER] Loaded %d schedules and %d watchlists", len(svc.state.Schedules), len(svc.state.Watchlists))
+	}
+	svc.updateMonitored()
+
+	lsv.OnJobFinished(svc.jobFinished)
+
+	svc.wg.Add(1)
+	go svc.loop()
+
+	return svc, nil
+}
+
+func (svc *SchedulerServiceImpl) SaveWatchlist(w models.Watchlist) error {
+	defer svc.updateMonitored()
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	svc.state.Watchlists[w.Name] = w
+	return svc.save()
+}
+
+func (svc *SchedulerServiceImpl) GetWatchlists() []models.Watchlist {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	result := make([]models.Watchlist, 0, len(svc.state.Watchlists))
+	for _, w := range svc.state.Watchlists {
+		result = append(result, w)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (svc *SchedulerServiceImpl) DeleteWatchlist(name string) error {
+	defer svc.updateMonitored()
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if _, ok := svc.state.Watchlists[name]; !ok {
+		return ErrWatchlistNotFound
+	}
+	for _, s := range svc.state.Schedules {
+		if s.Watchlist == name {
+			return ErrWatchlistInUse
+		}
+	}
+
+	delete(svc.state.Watchlists, name)
+	return svc.save()
+}
+
+// CreateSchedule validates the schedule and plans its first run
+func (svc *SchedulerServiceImpl) CreateSchedule(s models.Schedule) (models.Schedule, error) {
+	if (s.SetNumber == 0) == (s.Watchlist == "") {
+		return models.Schedule{}, fmt.Errorf("%w: exactly one of set number and watchlist is required", ErrInvalidSchedule)
+	}
+	if (s.Interval == 0) == (s.Cron == "") {
+		return models.Schedule{}, fmt.Errorf("%w: exactly one of interval and cron is required", ErrInvalidSchedule)
+	}
+	if s.Interval != 0 && s.Interval < viper.GetDuration(config.SchedulerMinInterval) {
+		return models.Schedule{}, fmt.Errorf("%w: interval must be at least %s", ErrInvalidSchedule, viper.GetDuration(config.SchedulerMinInterval))
+	}
+	if s.SetNumber != 0 {
+		if _, err := svc.ls.GetLinkSet(s.SetNumber); err != nil {
+			return models.Schedule{}, fmt.Errorf("%w: set #%d: %w", ErrInvalidSchedule, s.SetNumber, err)
+		}
+	}
+
+	s.ID = ids.New()
+	s.CreatedAt = time.Now()
+	next, err := nextRun(&s, s.CreatedAt)
+	if err != nil {
+		return models.Schedule{}, fmt.Errorf("%w: %w", ErrInvalidSchedule, err)
+	}
+	s.NextRun = next
+
+	defer svc.updateMonitored()
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if s.Watchlist != "" {
+		if _, ok := svc.state.Watchlists[s.Watchlist]; !ok {
+			return models.Schedule{}, ErrWatchlistNotFound
+		}
+	}
+
+	svc.state.Schedules[s.ID] = &s
+	if err = svc.save(); err != nil {
+		delete(svc.state.Schedules, s.ID)
+		return models.Schedule{}, err
+	}
+	return s, nil
+}
+
+func (svc *SchedulerServiceImpl) GetSchedules() []models.Schedule {
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	result := make([]models.Schedule, 0, len(svc.state.Schedules))
+	for _, s := range svc.state.Schedules {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return result
+}
+
+func (svc *SchedulerServiceImpl) DeleteSchedule(id string) error {
+	defer svc.updateMonitored()
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	if _, ok := svc.state.Schedules[id]; !ok {
+		return ErrScheduleNotFound
+	}
+	delete(svc.state.Schedules, id)
+	return svc.save()
+}
+
+// GetRuns returns runs of the schedule, set numbers appended to the log when their jobs finished are merged into runs
+func (svc *SchedulerServiceImpl) GetRuns(scheduleID string) ([]models.ScheduleRun, error) {
+	svc.runsMutex.Lock()
+	defer svc.runsMutex.Unlock()
+
+	runs := make([]models.ScheduleRun, 0)
+	byJob := make(map[string]int)
+	file, err := os.Open(viper.GetString(config.SchedulerRunsPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return runs, nil
+		}
+		return nil, err
+	}
+	defer closer.Close(file)
+
+	reader := bufio.NewReader(file)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			var r models.ScheduleRun
+			if json.Unmarshal(data, &r) == nil {
+				if r.ScheduleID == scheduleID {
+					byJob[r.JobID] = len(runs)
+					runs = append(runs, r)
+				} else if i, ok := byJob[r.JobID]; ok && r.ScheduleID == "" && r.JobID != "" {
+					runs[i].SetNumber = r.SetNumber
+				}
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return runs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (svc *SchedulerServiceImpl) Shutdown(_ context.Context) error {
+	log.Println("[SCHEDULER] Stopping scheduler...")
+	close(svc.stop)
+	svc.wg.Wait()
+
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+	return svc.save()
+}
+
+func (svc *SchedulerServiceImpl) loop() {
+	defer svc.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-svc.stop:
+			return
+		case now := <-ticker.C:
+			svc.runDue(now)
+		}
+	}
+}
+
+// runDue submits every schedule whose time has come, runs missed while the service was down are made once
+func (svc *SchedulerServiceImpl) runDue(now time.Time) {
+	svc.mutex.Lock()
+	var due []models.Schedule
+	for _, s := range svc.state.Schedules {
+		if !s.NextRun.After(now) {
+			next, err := nextRun(s, now)
+			if err != nil {
+				log.Printf("[SCHEDULER] Failed to plan next run of schedule %s: %v", s.ID, err)
+				continue
+			}
+			s.LastRun, s.NextRun = now, next
+			due = append(due, *s)
+		}
+	}
+	if len(due) > 0 {
+		if err := svc.save(); err != nil {
+			log.Printf("[SCHEDULER] Failed to save schedules: %v", err)
+		}
+	}
+	svc.mutex.Unlock()
+
+	for _, s := range due {
+		svc.run(s, now)
+	}
+}
+
+func (svc *SchedulerServiceImpl) run(s models.Schedule, now time.Time) {
+	run := models.ScheduleRun{ScheduleID: s.ID, Time: now}
+
+	ctx, span := tracer.Start(context.Background(), "SchedulerService.run", trace.WithAttributes(attribute.String("schedule.id", s.ID)))
+	defer span.End()
+
+	domains, err := svc.targetDomains(s)
+	if err == nil {
+		var job Job
+		job, err = svc.lsv.SubmitLinkSet(ctx, &apiModels.CheckLinkSetRequest{Links: domains, Priority: s.Priority.String()}, schedulerClient)
+		if errors.Is(err, ErrServiceStopping) {
+			err = nil // Task is journaled and will run after restart
+		}
+		run.JobID = job.ID // Set number is logged once the job finishes
+	}
+	if err != nil {
+		run.Error = err.Error()
+		log.Printf("[SCHEDULER] Run of schedule %s failed: %v", s.ID, err)
+	}
+
+	svc.appendRun(run)
+}
+
+// jobFinished appends set number of a finished scheduled job to the runs log, it's only known once the job is started
+// and the run is logged when the job is submitted
+func (svc *SchedulerServiceImpl) jobFinished(job Job) {
+	if job.Client != schedulerClient.ID || job.Number == 0 {
+		return
+	}
+	svc.appendRun(models.ScheduleRun{JobID: job.ID, SetNumber: job.Number, Time: job.FinishedAt})
+}
+
+// updateMonitored passes domains of all watchlists and scheduled sets to incident tracking, called after every change
+// once the mutex is released
+func (svc *SchedulerServiceImpl) updateMonitored() {
+	svc.monitorMutex.Lock()
+	defer svc.monitorMutex.Unlock()
+
+	var domains []string
+	var sets []int
+	svc.mutex.Lock()
+	for _, w := range svc.state.Watchlists {
+		domains = append(domains, w.Domains...)
+	}
+	for _, s := range svc.state.Schedules {
+		if s.SetNumber != 0 {
+			sets = append(sets, s.SetNumber)
+		}
+	}
+	svc.mutex.Unlock()
+
+	for _, num := range sets {
+		set, err := svc.ls.GetLinkSet(num)
+		if err != nil {
+			log.Printf("[SCHEDULER] Failed to get domains of scheduled set #%d, they aren't monitored: %v", num, err)
+			continue
+		}
+		for _, link := range set.Links {
+			domains = append(domains, link.Domain)
+		}
+	}
+	svc.incidents.Monitor(domains)
+}
+
+func (svc *SchedulerServiceImpl) targetDomains(s models.Schedule) ([]string, error) {
+	if s.Watchlist != "" {
+		svc.mutex.Lock()
+		w, ok := svc.state.Watchlists[s.Watchlist]
+		svc.mutex.Unlock()
+		if !ok {
+			return nil, ErrWatchlistNotFound
+		}
+		return w.Domains, nil
+	}
+
+	set, err := svc.ls.GetLinkSet(s.SetNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get set #%d: %w", s.SetNumber, err)
+	}
+	domains := make([]string, len(set.Links))
+	for i, link := range set.Links {
+		domains[i] = link.Domain
+	}
+	return domains, nil
+}
+
+func (svc *SchedulerServiceImpl) appendRun(run models.ScheduleRun) {
+	data, err := json.Marshal(run)
+	if err != nil {
+		return
+	}
+
+	svc.runsMutex.Lock()
+	defer svc.runsMutex.Unlock()
+
+	file, err := os.OpenFile(viper.GetString(config.SchedulerRunsPath), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("[SCHEDULER] Failed to open runs log: %v", err)
+		return
+	}
+	defer closer.Close(file)
+
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		log.Printf("[SCHEDULER] Failed to write runs log: %v", err)
+	}
+}
+
+func (svc *SchedulerServiceImpl) load() error {
+	data, err := os.ReadFile(viper.GetString(config.SchedulerPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err = json.Unmarshal(data, &svc.state); err != nil {
+		return err
+	}
+	if svc.state.Watchlists == nil {
+		svc.state.Watchlists = make(map[string]models.Watchlist)
+	}
+	if svc.state.Schedules == nil {
+		svc.state.Schedules = make(map[string]*models.Schedule)
+	}
+	return nil
+}
+
+// save atomically rewrites schedules file, caller must hold the mutex
+func (svc *SchedulerServiceImpl) save() error {
+	data, err := json.MarshalIndent(svc.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := viper.GetString(config.SchedulerPath)
+	if err = os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// nextRun returns the first run time of the schedule after t
+func nextRun(s *models.Schedule, t time.Time) (time.Time, error) {
+	if s.Interval > 0 {
+		return t.Add(s.Interval), nil
+	}
+	cronSchedule, err := cron.ParseStandard(s.Cron)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid cron expression: %w", err)
+	}
+	return cronSchedule.Next(t), nil
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+)
+
+// monitoredDomains remembers domains the scheduler asked to monitor
+type monitoredDomains struct {
+	IncidentService
+	mutex   sync.Mutex
+	domains []string
+}
+
+func (m *monitoredDomains) Monitor(domains []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.domains = domains
+}
+
+func (m *monitoredDomains) get() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	d := slices.Clone(m.domains)
+	slices.Sort(d)
+	return d
+}
+
+func newTestScheduler(t *testing.T, lsv *LinkServiceImpl, is IncidentService) SchedulerService {
+	t.Helper()
+	dir := t.TempDir()
+	viper.Set(config.SchedulerPath, filepath.Join(dir, "schedules.json"))
+	viper.Set(config.SchedulerRunsPath, filepath.Join(dir, "schedule_runs.log"))
+
+	sched, err := NewSchedulerService(lsv.ls, lsv, is)
+	if err != nil {
+		t.Fatalf("NewSchedulerService: %v", err)
+	}
+	t.Cleanup(func() { _ = sched.Shutdown(context.Background()) })
+	return sched
+}
+
+func TestScheduledRunPointsAtStoredSet(t *testing.T) {
+	lsv, _ := newTestLeaseService(t, &fakeProbes{})
+	sched := newTestScheduler(t, lsv, &monitoredDomains{})
+
+	if err := sched.SaveWatchlist(models.Watchlist{Name: "sites", Domains: []string{"a.example", "b.example"}}); err != nil {
+		t.Fatalf("SaveWatchlist: %v", err)
+	}
+	s, err := sched.CreateSchedule(models.Schedule{Watchlist: "sites", Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("CreateSchedule: %v", err)
+	}
+	sched.(*SchedulerServiceImpl).run(s, time.Now())
+
+	l := leaseTestTask(t, lsv, "worker-a")
+	if err = lsv.CompleteLease(l.ID, []LinkResult{available(0), available(1)}); err != nil {
+		t.Fatalf("CompleteLease: %v", err)
+	}
+
+	runs, err := sched.GetRuns(s.ID)
+	if err != nil {
+		t.Fatalf("GetRuns: %v", err)
+	}
+	if len(runs) != 1 {
+		t.Fatalf("got %d runs, want 1", len(runs))
+	}
+	if runs[0].JobID != l.JobID || runs[0].SetNumber == 0 || runs[0].SetNumber != l.SetNumber {
+		t.Errorf("run of job %s points at set #%d, want job %s and set #%d", runs[0].JobID, runs[0].SetNumber, l.JobID, l.SetNumber)
+	}
+	if _, err = lsv.ls.GetLinkSet(runs[0].SetNumber); err != nil {
+		t.Errorf("set of the run isn't stored: %v", err)
+	}
+}
+
+func TestWatchlistsAndScheduledSetsAreMonitored(t *testing.T) {
+	lsv, _ := newTestLeaseService(t, &fakeProbes{})
+	monitored := &monitoredDomains{}
+	sched := newTestScheduler(t, lsv, monitored)
+
+	task := submitTestSet(t, lsv, "set.example")
+	l := leaseTestTask(t, lsv, "worker-a")
+	if err := lsv.CompleteLease(l.ID, []LinkResult{available(0)}); err != nil {
+		t.Fatalf("CompleteLease: %v", err)
+	}
+	if err := sched.SaveWatchlist(models.Watchlist{Name: "sites", Domains: []string{"a.example"}}); err != nil {
+		t.Fatalf("SaveWatchlist: %v", err)
+	}
+	s, err := sched.CreateSchedule(models.Schedule{SetNumber: task.set.Number, Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("CreateSchedule: %v", err)
+	}
+	if got := monitored.get(); !slices.Equal(got, []string{"a.example", "set.example"}) {
+		t.Errorf("monitored %v, want watchlist and scheduled set domains", got)
+	}
+
+	if err = sched.DeleteSchedule(s.ID); err != nil {
+		t.Fatalf("DeleteSchedule: %v", err)
+	}
+	if got := monitored.get(); !slices.Equal(got, []string{"a.example"}) {
+		t.Errorf("monitored %v after schedule was deleted, want watchlist domains only", got)
+	}
+}
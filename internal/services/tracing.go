@@ -0,0 +1,28 @@
+package services
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("link-availability-checker/internal/services")
+
+// traceContext returns ctx continuing trace of the request that submitted the task. Trace is kept as propagation
+// carrier, so it survives the queue, spilling and restarts the same way as the rest of the task.
+func (task *linkTask) traceContext(ctx context.Context) context.Context {
+	if task.trace == nil {
+		return ctx // Journaled before tracing was added
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, task.trace)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
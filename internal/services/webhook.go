@@ -0,0 +1,511 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/utils/closer"
+	"link-availability-checker/internal/utils/ids"
+	"link-availability-checker/pkg/journal"
+)
+
+const (
+	SignatureHeader = "X-Webhook-Signature" // "sha256=" + hex(HMAC-SHA256(secret, timestamp + "." + body))
+	TimestampHeader = "X-Webhook-Timestamp" // Unix seconds, part of signed content to prevent replays
+)
+
+type WebhookService interface {
+	// Notify schedules delivery of finished job result to its callback URL
+	Notify(callbackURL string, job Job)
+	// GetDeliveries returns delivery attempts of the set's callbacks made for the client, or for any client if it's empty
+	GetDeliveries(setNumber int, client string) ([]Delivery, error)
+}
+
+var (
+	ErrForbiddenCallback = errors.New("callback address is not allowed")
+	ErrCallbacksDisabled = errors.New("callbacks are disabled, webhook secret is not configured")
+)
+
+// Delivery is a single attempt to deliver a callback
+type Delivery struct {
+	ID         string    `json:"id"`
+	JobID      string    `json:"job_id"`
+	SetNumber  int       `json:"set_number"`
+	Client     string    `json:"client,omitempty"` // Client that submitted the set
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+	GaveUp     bool      `json:"gave_up,omitempty"`
+}
+
+// outboxMessage is a callback waiting for delivery, stored in outbox journal
+type outboxMessage struct {
+	JobID     string          `json:"job_id"`
+	SetNumber int             `json:"set_number"`
+	Client    string          `json:"client,omitempty"`
+	URL       string          `json:"url"`
+	Body      json.RawMessage `json:"body"`
+
+	attempts    int
+	nextAttempt time.Time
+	inFlight    bool // Handed to endpoint worker, guarded by WebhookServiceImpl.mutex
+}
+
+// endpoint is a queue of messages to the same host, they are sent one at a time so that a slow endpoint only delays its
+// own callbacks
+type endpoint struct {
+	queue []string // Message IDs, guarded by WebhookServiceImpl.mutex
+}
+
+type outboxAttempt struct {
+	Attempt int `json:"attempt"`
+}
+
+type WebhookServiceImpl struct {
+	httpClient *http.Client
+	outbox     *journal.Journal
+
+	mutex     sync.Mutex
+	pending   map[string]*outboxMessage
+	endpoints map[string]*endpoint // Endpoints with a running worker
+	slots     chan struct{}        // Bounds callbacks sent at once
+	wakeUp    chan struct{}
+
+	logMutex sync.Mutex
+	logFile  *os.File
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewWebhookService(lc fx.Lifecycle) (WebhookService, error) {
+	outbox, err := journal.Open(viper.GetString(config.WebhookOutboxPath), viper.GetInt(config.QueueCompactThreshold))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open webhook outbox: %w", err)
+	}
+
+	logFile, err := os.OpenFile(viper.GetString(config.WebhookLogPath), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open/create webhook delivery log: %w", err)
+	}
+
+	svc := &WebhookServiceImpl{
+		httpClient: newCallbackClient(viper.GetDuration(config.WebhookTimeout), viper.GetBool(config.WebhookAllowPrivate)),
+		outbox:     outbox,
+		pending:    make(map[string]*outboxMessage),
+		endpoints:  make(map[string]*endpoint),
+		slots:      make(chan struct{}, viper.GetInt(config.WebhookConcurrency)),
+		wakeUp:     make(chan struct{}, 1),
+		logFile:    logFile,
+		stop:       make(chan struct{}),
+	}
+
+	for _, t := range outbox.Pending() {
+		var msg outboxMessage
+		if err = json.Unmarshal(t.Payload, &msg); err != nil {
+			log.Printf("[WEBHOOK] Skipping unreadable outbox message %s: %v", t.ID, err)
+			continue
+		}
+		msg.attempts = len(t.Progress)
+		msg.nextAttempt = time.Now()
+		svc.pending[t.ID] = &msg
+	}
+	if len(svc.pending) > 0 {
+		log.Printf("[WEBHOOK] Restored %d undelivered callbacks from outbox", len(svc.pending))
+	}
+
+	svc.wg.Add(1)
+	go svc.deliveryLoop()
+
+	lc.Append(fx.Hook{OnStop: svc.shutdown})
+	return svc, nil
+}
+
+func (svc *WebhookServiceImpl) Notify(callbackURL string, job Job) {
+	if job.Set == nil {
+		return
+	}
+
+	body, err := json.Marshal(apiModels.WebhookPayload{
+		JobID:    job.ID,
+		State:    string(job.State),
+		LinksNum: job.Set.Number,
+		Links:    job.Set.ConvertLinksToStrMap(),
+		Canceled: job.Set.Canceled,
+	})
+	if err != nil {
+		log.Printf("[WEBHOOK] Failed to marshal callback for job %s: %v", job.ID, err)
+		return
+	}
+
+	id := ids.New()
+	msg := &outboxMessage{JobID: job.ID, SetNumber: job.Set.Number, Client: job.Client, URL: callbackURL, Body: body, nextAttempt: time.Now()}
+	if err = svc.outbox.Enqueue(id, msg); err != nil {
+		log.Printf("[WEBHOOK] Failed to store callback for job %s in outbox: %v", job.ID, err)
+		return
+	}
+
+	svc.mutex.Lock()
+	svc.pending[id] = msg
+	svc.mutex.Unlock()
+	svc.wake()
+}
+
+func (svc *WebhookServiceImpl) wake() {
+	select {
+	case svc.wakeUp <- struct{}{}:
+	default:
+	}
+}
+
+func (svc *WebhookServiceImpl) GetDeliveries(setNumber int, client string) ([]Delivery, error) {
+	svc.logMutex.Lock()
+	defer svc.logMutex.Unlock()
+
+	file, err := os.Open(viper.GetString(config.WebhookLogPath))
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close(file)
+
+	deliveries := make([]Delivery, 0)
+	reader := bufio.NewReader(file)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			var d Delivery
+			if json.Unmarshal(data, &d) == nil && d.SetNumber == setNumber && (client == "" || d.Client == client) {
+				deliveries = append(deliveries, d)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return deliveries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (svc *WebhookServiceImpl) deliveryLoop() {
+	defer svc.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-svc.stop:
+			return
+		case <-svc.wakeUp:
+		case <-timer.C:
+		}
+
+		next := svc.deliverDue()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// deliverDue hands every due message to the worker of its endpoint, returns time of the next scheduled attempt
+func (svc *WebhookServiceImpl) deliverDue() time.Time {
+	now := time.Now()
+	next := now.Add(time.Minute)
+
+	svc.mutex.Lock()
+	defer svc.mutex.Unlock()
+
+	for id, msg := range svc.pending {
+		switch {
+		case msg.inFlight:
+		case !msg.nextAttempt.After(now):
+			svc.dispatch(id, msg)
+		case msg.nextAttempt.Before(next):
+			next = msg.nextAttempt
+		}
+	}
+	return next
+}
+
+// dispatch queues the message to the worker of its endpoint, starting one if there is none. Caller must hold the mutex.
+func (svc *WebhookServiceImpl) dispatch(id string, msg *outboxMessage) {
+	msg.inFlight = true
+	key := endpointKey(msg.URL)
+	ep, ok := svc.endpoints[key]
+	if !ok {
+		ep = &endpoint{}
+		svc.endpoints[key] = ep
+		svc.wg.Add(1)
+		go svc.endpointWorker(key, ep)
+	}
+	ep.queue = append(ep.queue, id)
+}
+
+// endpointWorker sends queued messages of an endpoint one by one and exits once the queue is empty
+func (svc *WebhookServiceImpl) endpointWorker(key string, ep *endpoint) {
+	defer svc.wg.Done()
+
+	for {
+		svc.mutex.Lock()
+		if len(ep.queue) == 0 {
+			delete(svc.endpoints, key)
+			svc.mutex.Unlock()
+			return
+		}
+		id := ep.queue[0]
+		ep.queue = ep.queue[1:]
+		msg := svc.pending[id]
+		svc.mutex.Unlock()
+		if msg == nil {
+			continue
+		}
+
+		select {
+		case svc.slots <- struct{}{}:
+		case <-svc.stop:
+			return // Message stays in outbox
+		}
+		done := svc.deliver(id, msg)
+		<-svc.slots
+
+		if !done {
+			svc.mutex.Lock()
+			msg.inFlight = false
+			svc.mutex.Unlock()
+			svc.wake() // Let the loop schedule the retry
+		}
+	}
+}
+
+// endpointKey groups callbacks by scheme and host
+func endpointKey(callbackURL string) string {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return callbackURL
+	}
+	return u.Scheme + "://" + strings.ToLower(u.Host)
+}
+
+// deliver makes one delivery attempt, returns true if the message is done with (delivered or given up). Attempt
+// interrupted by shutdown isn't counted, the message stays in outbox with attempts it had.
+func (svc *WebhookServiceImpl) deliver(id string, msg *outboxMessage) bool {
+	d := Delivery{ID: id, JobID: msg.JobID, SetNumber: msg.SetNumber, Client: msg.Client, URL: msg.URL, Time: time.Now()}
+	d.StatusCode, d.Error = svc.send(msg)
+	d.Delivered = d.Error == "" && d.StatusCode >= 200 && d.StatusCode < 300
+	if !d.Delivered && svc.stopped() {
+		return false
+	}
+
+	msg.attempts++
+	d.Attempt = msg.attempts
+	if err := svc.outbox.Progress(id, outboxAttempt{Attempt: msg.attempts}); err != nil {
+		log.Printf("[WEBHOOK] Failed to record delivery attempt of %s: %v", id, err)
+	}
+
+	maxAttempts := viper.GetInt(config.WebhookMaxAttempts)
+	if !d.Delivered && msg.attempts >= maxAttempts {
+		d.GaveUp = true
+		log.Printf("[WEBHOOK] Giving up on callback for set #%d to %s after %d attempts", msg.SetNumber, msg.URL, msg.attempts)
+	}
+	svc.appendLog(d)
+
+	if d.Delivered || d.GaveUp {
+		if err := svc.outbox.Complete(id); err != nil {
+			log.Printf("[WEBHOOK] Failed to remove %s from outbox: %v", id, err)
+		}
+		svc.mutex.Lock()
+		delete(svc.pending, id)
+		svc.mutex.Unlock()
+		return true
+	}
+
+	// Exponential backoff: initial, 2*initial, 4*initial... capped by max backoff
+	backoff := viper.GetDuration(config.WebhookInitialBackoff) << min(msg.attempts-1, 30)
+	if maxBackoff := viper.GetDuration(config.WebhookMaxBackoff); backoff <= 0 || backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	svc.mutex.Lock()
+	msg.nextAttempt = time.Now().Add(backoff)
+	svc.mutex.Unlock()
+	return false
+}
+
+func (svc *WebhookServiceImpl) stopped() bool {
+	select {
+	case <-svc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (svc *WebhookServiceImpl) send(msg *outboxMessage) (int, string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-svc.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, msg.URL, bytes.NewReader(msg.Body))
+	if err != nil {
+		return 0, err.Error()
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(viper.GetString(config.WebhookSecret), timestamp, msg.Body))
+
+	resp, err := svc.httpClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer closer.Close(resp.Body)
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // Drain to reuse connection
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, ""
+}
+
+// newCallbackClient returns HTTP client that refuses to connect to internal addresses unless allowPrivate is set. The
+// address is checked after resolving, right before connecting, so redirects and DNS names pointing inside are refused
+// too. Proxies from environment aren't used, as the check would apply to the proxy instead of the endpoint.
+func newCallbackClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if isInternalAddr(addr) {
+				return fmt.Errorf("%w: %s", ErrForbiddenCallback, addr.Unmap())
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// sharedAddressSpace is carrier-grade NAT range, not covered by netip.Addr.IsPrivate
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isInternalAddr tells if the address belongs to the host itself, a private network or cloud metadata service
+func isInternalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() || sharedAddressSpace.Contains(addr)
+}
+
+// CheckCallbackURL rejects callback URLs that aren't http(s) or whose host resolves to an internal address, unless
+// private addresses are allowed. Addresses are checked again on every delivery. ErrCallbacksDisabled is returned if
+// there is no secret to sign callbacks with.
+func CheckCallbackURL(ctx context.Context, callbackURL string) error {
+	if viper.GetString(config.WebhookSecret) == "" {
+		return ErrCallbacksDisabled
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: scheme must be http or https", ErrForbiddenCallback)
+	}
+	if viper.GetBool(config.WebhookAllowPrivate) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", u.Hostname(), err)
+	}
+	for _, addr := range addrs {
+		if isInternalAddr(addr) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrForbiddenCallback, u.Hostname(), addr.Unmap())
+		}
+	}
+	return nil
+}
+
+// Sign returns signature of the callback body as sent in SignatureHeader
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (svc *WebhookServiceImpl) appendLog(d Delivery) {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+
+	svc.logMutex.Lock()
+	defer svc.logMutex.Unlock()
+
+	if _, err = svc.logFile.Write(append(data, '\n')); err != nil {
+		log.Printf("[WEBHOOK] Failed to write delivery log: %v", err)
+	}
+}
+
+func (svc *WebhookServiceImpl) shutdown(_ context.Context) error {
+	log.Println("[WEBHOOK] Stopping delivery, undelivered callbacks stay in outbox...")
+	close(svc.stop)
+	svc.wg.Wait()
+
+	svc.logMutex.Lock()
+	closer.Close(svc.logFile, true)
+	svc.logMutex.Unlock()
+
+	return svc.outbox.Close()
+}
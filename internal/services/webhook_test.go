@@ -0,0 +1,64 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/pkg/journal"
+)
+
+func TestDeliveryCanceledByShutdownIsNotCounted(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set(config.WebhookMaxAttempts, 1)
+	viper.Set(config.WebhookSecret, "s3cret")
+	t.Cleanup(viper.Reset)
+
+	received := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	outbox, err := journal.Open(filepath.Join(dir, "webhooks.outbox"), 0)
+	if err != nil {
+		t.Fatalf("open outbox: %v", err)
+	}
+	defer func() { _ = outbox.Close() }()
+
+	svc := &WebhookServiceImpl{
+		httpClient: newCallbackClient(time.Minute, true),
+		outbox:     outbox,
+		pending:    make(map[string]*outboxMessage),
+		stop:       make(chan struct{}),
+	}
+	msg := &outboxMessage{JobID: "job", SetNumber: 1, URL: server.URL, Body: []byte("{}")}
+	if err = outbox.Enqueue("msg", msg); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	svc.pending["msg"] = msg
+
+	done := make(chan bool)
+	go func() { done <- svc.deliver("msg", msg) }()
+	<-received
+	close(svc.stop)
+
+	if <-done {
+		t.Fatal("delivery canceled by shutdown gave up on the message")
+	}
+	if msg.attempts != 0 {
+		t.Errorf("canceled delivery counted as attempt %d", msg.attempts)
+	}
+	pending := outbox.Pending()
+	if len(pending) != 1 || len(pending[0].Progress) != 0 {
+		t.Errorf("outbox has %+v, want the message without attempts", pending)
+	}
+}
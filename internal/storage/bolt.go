@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+
+	"link-availability-checker/internal/models"
+	"link-availability-checker/pkg/boltstore"
+)
+
+// BoltLinkStorage keeps sets in bbolt database. It isn't a Maintainer or Quarantine: it has no segments to maintain and
+// no damaged records to quarantine, bbolt rolls back torn transactions itself.
+type BoltLinkStorage struct{ bs *boltstore.BoltStore }
+
+func NewBoltLinkStorage(bs *boltstore.BoltStore) LinkStorage { return &BoltLinkStorage{bs: bs} }
+
+func (s *BoltLinkStorage) SaveLinkSet(ctx context.Context, set *models.Set) (int, error) {
+	return s.bs.AppendSet(ctx, set)
+}
+
+func (s *BoltLinkStorage) GetLinkSet(number int) (*models.Set, error) {
+	set, err := s.bs.FindSet(number)
+	return set, translate(err)
+}
+
+func (s *BoltLinkStorage) GetLinkSets(numbers []int) ([]*models.Set, error) {
+	sets, err := s.bs.FindSets(numbers)
+	return sets, translate(err)
+}
+
+func (s *BoltLinkStorage) DeleteLinkSet(number int) error {
+	return translate(s.bs.DeleteSet(number))
+}
+
+func (s *BoltLinkStorage) ReserveSetNumber() int {
+	return s.bs.ReserveSetNumber()
+}
+
+func (s *BoltLinkStorage) EnsureSetNumberReserved(number int) {
+	s.bs.EnsureSetNumberReserved(number)
+}
+
+func (s *BoltLinkStorage) CountLinkSets() int {
+	return s.bs.CountSets()
+}
+
+func (s *BoltLinkStorage) CheckWritable() error {
+	return s.bs.CheckWritable()
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"errors"
+
+	"link-availability-checker/pkg/boltstore"
+	"link-availability-checker/pkg/filestore"
+)
+
+// Errors returned by every backend, callers check them with errors.Is instead of errors of the backend packages
+var (
+	ErrSetNotFound         = errors.New("set not found")
+	ErrQuarantinedNotFound = errors.New("quarantined record not found")
+)
+
+// backendError keeps the message of an error of a backend and matches both it and the sentinel error of this package
+type backendError struct {
+	err      error
+	sentinel error
+}
+
+func (e *backendError) Error() string   { return e.err.Error() }
+func (e *backendError) Unwrap() []error { return []error{e.sentinel, e.err} }
+
+// translate maps errors of backend packages to sentinel errors of this package
+func translate(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, filestore.ErrSetNotFound), errors.Is(err, boltstore.ErrSetNotFound):
+		return &backendError{err: err, sentinel: ErrSetNotFound}
+	case errors.Is(err, filestore.ErrQuarantinedNotFound):
+		return &backendError{err: err, sentinel: ErrQuarantinedNotFound}
+	}
+	return err
+}
@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"time"
+
+	"link-availability-checker/internal/models"
+	"link-availability-checker/pkg/filestore"
+)
+
+type HistoryStorage interface {
+	AppendChecks(records []models.CheckRecord) error
+	GetChecks(domain string, from, to time.Time) ([]models.CheckRecord, error)
+}
+
+type HistoryStorageImpl struct{ hs *filestore.HistoryStore }
+
+func NewHistoryStorage(hs *filestore.HistoryStore) HistoryStorage { return &HistoryStorageImpl{hs: hs} }
+
+func (s *HistoryStorageImpl) AppendChecks(records []models.CheckRecord) error {
+	return s.hs.AppendChecks(records)
+}
+
+func (s *HistoryStorageImpl) GetChecks(domain string, from, to time.Time) ([]models.CheckRecord, error) {
+	return s.hs.ReadChecks(domain, from, to)
+}
@@ -1,23 +1,118 @@
 package storage
 
 import (
+	"context"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/config"
 	"link-availability-checker/internal/models"
+	"link-availability-checker/pkg/boltstore"
 	"link-availability-checker/pkg/filestore"
 )
 
+// LinkStorage keeps link sets. Errors are matched against ErrSetNotFound and ErrQuarantinedNotFound whatever the
+// backend is. Operations only some backends have are in Inspector, Maintainer and Quarantine, callers check for them
+// with type assertion.
 type LinkStorage interface {
-	SaveLinkSet(set *models.Set) (int, error)
+	SaveLinkSet(ctx context.Context, set *models.Set) (int, error)
 	GetLinkSet(number int) (*models.Set, error)
+	// GetLinkSets reads sets in a single pass, result follows order of numbers
+	GetLinkSets(numbers []int) ([]*models.Set, error)
+	DeleteLinkSet(number int) error
+	ReserveSetNumber() int
+	EnsureSetNumberReserved(number int)
+}
+
+// Inspector reports state of the backend to health checks and metrics
+type Inspector interface {
+	CountLinkSets() int
+	CheckWritable() error
+}
+
+// Maintainer is a backend that keeps sets in segments of links file
+type Maintainer interface {
+	// MaintainLinkSets seals, expires, compacts and compresses segments of links file right away
+	MaintainLinkSets() (models.MaintenanceReport, error)
+}
+
+// Quarantine is a backend that keeps damaged records aside for inspection
+type Quarantine interface {
+	QuarantinedRecords() ([]models.QuarantinedRecord, error)
+	ReadQuarantined(id string) ([]byte, error)
+	DeleteQuarantined(id string) error
 }
 
-type LinkStorageImpl struct{ fs *filestore.FileStore }
+// NewLinkStorage opens the backend chosen in config
+func NewLinkStorage(lc fx.Lifecycle) (LinkStorage, error) {
+	if viper.GetString(config.StorageBackend) == "bolt" {
+		bs, err := boltstore.NewBoltStorer(lc)
+		if err != nil {
+			return nil, err
+		}
+		return NewBoltLinkStorage(bs), nil
+	}
+
+	fs, err := filestore.NewFileStorer(lc)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileLinkStorage(fs), nil
+}
+
+// FileLinkStorage keeps sets in segments of links file
+type FileLinkStorage struct{ fs *filestore.FileStore }
+
+func NewFileLinkStorage(fs *filestore.FileStore) LinkStorage { return &FileLinkStorage{fs: fs} }
+
+func (s *FileLinkStorage) SaveLinkSet(ctx context.Context, set *models.Set) (int, error) {
+	return s.fs.AppendSet(ctx, set)
+}
+
+func (s *FileLinkStorage) GetLinkSet(number int) (*models.Set, error) {
+	set, err := s.fs.FindSet(number)
+	return set, translate(err)
+}
 
-func NewLinkStorage(fs *filestore.FileStore) LinkStorage { return &LinkStorageImpl{fs: fs} }
+func (s *FileLinkStorage) GetLinkSets(numbers []int) ([]*models.Set, error) {
+	sets, err := s.fs.FindSets(numbers)
+	return sets, translate(err)
+}
+
+func (s *FileLinkStorage) DeleteLinkSet(number int) error {
+	return translate(s.fs.DeleteSet(number))
+}
+
+func (s *FileLinkStorage) MaintainLinkSets() (models.MaintenanceReport, error) {
+	return s.fs.Maintain()
+}
+
+func (s *FileLinkStorage) QuarantinedRecords() ([]models.QuarantinedRecord, error) {
+	return s.fs.QuarantinedRecords()
+}
+
+func (s *FileLinkStorage) ReadQuarantined(id string) ([]byte, error) {
+	data, err := s.fs.ReadQuarantined(id)
+	return data, translate(err)
+}
+
+func (s *FileLinkStorage) DeleteQuarantined(id string) error {
+	return translate(s.fs.DeleteQuarantined(id))
+}
+
+func (s *FileLinkStorage) ReserveSetNumber() int {
+	return s.fs.ReserveSetNumber()
+}
+
+func (s *FileLinkStorage) EnsureSetNumberReserved(number int) {
+	s.fs.EnsureSetNumberReserved(number)
+}
 
-func (s *LinkStorageImpl) SaveLinkSet(set *models.Set) (int, error) {
-	return s.fs.AppendSet(set)
+func (s *FileLinkStorage) CountLinkSets() int {
+	return s.fs.CountSets()
 }
 
-func (s *LinkStorageImpl) GetLinkSet(number int) (*models.Set, error) {
-	return s.fs.FindSet(number)
+func (s *FileLinkStorage) CheckWritable() error {
+	return s.fs.CheckWritable()
 }
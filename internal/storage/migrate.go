@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/pkg/boltstore"
+	"link-availability-checker/pkg/filestore"
+)
+
+const migrationBatch = 500
+
+// MigrateToBolt copies link sets of links file into bbolt database and stops the app. Sets already in the database are
+// kept, so an interrupted migration is simply run again. Links file isn't changed.
+func MigrateToBolt(shutdowner fx.Shutdowner) {
+	if err := migrateToBolt(); err != nil {
+		log.Printf("[MIGRATE] Migration failed: %v", err)
+		_ = shutdowner.Shutdown(fx.ExitCode(1))
+		return
+	}
+	_ = shutdowner.Shutdown()
+}
+
+func migrateToBolt() error {
+	fs, err := filestore.OpenFileStore()
+	if err != nil {
+		return fmt.Errorf("failed to open links file: %w", err)
+	}
+	defer fs.Close()
+
+	bs, err := boltstore.Open(viper.GetString(config.BoltPath))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := bs.Close(); err != nil {
+			log.Printf("[MIGRATE] Failed to close database: %v", err)
+		}
+	}()
+
+	numbers := fs.Numbers()
+	last, _ := fs.GetLastSetNumber()
+	log.Printf("[MIGRATE] Copying %d sets from %s to %s",
+		len(numbers), viper.GetString(config.LinksFilePath), viper.GetString(config.BoltPath))
+
+	copied := 0
+	for start := 0; start < len(numbers); start += migrationBatch {
+		batch := numbers[start:min(start+migrationBatch, len(numbers))]
+		sets, err := fs.FindSets(batch)
+		if err != nil {
+			return err
+		}
+		added, err := bs.Import(sets, 0)
+		if err != nil {
+			return err
+		}
+		copied += added
+		log.Printf("[MIGRATE] %d of %d sets done", start+len(batch), len(numbers))
+	}
+
+	// Deleted and expired sets still hold their numbers
+	if _, err = bs.Import(nil, last); err != nil {
+		return err
+	}
+
+	log.Printf("[MIGRATE] Done: %d sets copied, %d were already in the database, last set number is %d",
+		copied, len(numbers)-copied, last)
+	return nil
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/config"
+)
+
+// Setup installs global tracer provider with configured exporter. Trace context is propagated with W3C headers even
+// if tracing is disabled, so that traces of callers aren't broken by the service.
+func Setup(lc fx.Lifecycle) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Printf("[TRACING] %v", err)
+	}))
+
+	exporter, err := newExporter()
+	if err != nil {
+		log.Fatalf("Failed to create trace exporter: %v", err)
+	}
+	if exporter == nil {
+		return
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", viper.GetString(config.TracingServiceName)),
+	))
+	if err != nil {
+		log.Fatalf("Failed to build tracing resource: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(viper.GetFloat64(config.TracingSampleRatio)))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Printf("[TRACING] Exporting traces to %s", viper.GetString(config.TracingExporter))
+
+	lc.Append(fx.Hook{OnStop: func(ctx context.Context) error {
+		// Appended before the services, so spans of the shutdown itself are flushed too
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("[TRACING] Failed to flush traces: %v", err)
+		}
+		return nil
+	}})
+}
+
+func newExporter() (sdktrace.SpanExporter, error) {
+	switch viper.GetString(config.TracingExporter) {
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(viper.GetString(config.TracingEndpoint))}
+		if viper.GetBool(config.TracingInsecure) {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(context.Background(), opts...) // Connects lazily, collector may start later
+	default:
+		return nil, nil
+	}
+}
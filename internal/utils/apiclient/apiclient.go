@@ -0,0 +1,74 @@
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"link-availability-checker/internal/utils/closer"
+)
+
+// Client sends JSON requests to the coordinator API on behalf of worker processes and probe agents
+type Client struct {
+	baseURL     string
+	tokenHeader string
+	token       string
+	http        *http.Client
+}
+
+func New(baseURL, tokenHeader, token string) *Client {
+	return &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		tokenHeader: tokenHeader,
+		token:       token,
+		http:        &http.Client{},
+	}
+}
+
+func (c *Client) BaseURL() string { return c.baseURL }
+
+// Post sends body as JSON and decodes 200 response into out if it's not nil. Other 2xx statuses and the statuses
+// listed in expected are returned without error, the rest are returned as errors.
+func (c *Client) Post(ctx context.Context, path string, body, out any, expected ...int) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(c.tokenHeader, c.token)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close(resp.Body)
+
+	if resp.StatusCode == http.StatusOK && out != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 || isExpected(resp.StatusCode, expected) {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return resp.StatusCode, nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	return resp.StatusCode, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+}
+
+func isExpected(status int, expected []int) bool {
+	for _, e := range expected {
+		if status == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// New returns a random 128-bit identifier encoded as a hex string
+func New() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b) // crypto/rand.Read never returns an error since Go 1.24
+	return hex.EncodeToString(b)
+}
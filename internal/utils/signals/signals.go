@@ -5,8 +5,14 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"time"
+
+	"link-availability-checker/internal/config"
 )
 
+// restartLockWait covers Fx stop timeout and health drain delay of the old process
+const restartLockWait = 2 * time.Minute
+
 func SendInterruptSignal() {
 	p, err := os.FindProcess(os.Getpid())
 	if err != nil {
@@ -34,6 +40,8 @@ func RestartSelf() error {
 
 	const delaySeconds = 10
 	cmd := exec.Command("sh", "-c", fmt.Sprintf("sleep %d && nohup %s%s &", delaySeconds, self, args))
+	// Old process may still be draining after the delay, the new one waits for it to release data directories
+	cmd.Env = append(os.Environ(), config.RestartLockWaitEnv+"="+restartLockWait.String())
 
 	if err = cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start new process: %w", err)
@@ -0,0 +1,262 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/api/middlewares"
+	apiModels "link-availability-checker/internal/api/models"
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/services"
+	"link-availability-checker/internal/utils/apiclient"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	maxBackoff     = 30 * time.Second
+)
+
+var errLeaseLost = errors.New("lease lost")
+
+// Worker checks link sets leased from the coordinator, results are reported with heartbeats as they come, so that
+// another worker only rechecks the rest if this one dies
+type Worker struct {
+	as     services.AvailabilityService
+	client *apiclient.Client
+	id     string
+
+	stop       chan struct{}
+	pollCtx    context.Context // Canceled on stop to interrupt waiting for tasks
+	pollCancel context.CancelFunc
+	taskCtx    context.Context // Canceled when shutdown deadline passes, unfinished tasks are released
+	taskCancel context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+func New(as services.AvailabilityService) *Worker {
+	id := viper.GetString(config.WorkerID)
+	if id == "" {
+		host, _ := os.Hostname()
+		id = host + "-" + strconv.Itoa(os.Getpid())
+	}
+
+	w := &Worker{
+		as:     as,
+		client: apiclient.New(viper.GetString(config.WorkerCoordinator), middlewares.WorkerTokenHeader, viper.GetString(config.WorkerToken)),
+		id:     id,
+		stop:   make(chan struct{}),
+	}
+	w.pollCtx, w.pollCancel = context.WithCancel(context.Background())
+	w.taskCtx, w.taskCancel = context.WithCancel(context.Background())
+	return w
+}
+
+func Run(lc fx.Lifecycle, w *Worker) {
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			log.Printf("[WORKER] Worker %s is leasing tasks from %s", w.id, w.client.BaseURL())
+			for i := 0; i < viper.GetInt(config.WorkerConcurrency); i++ {
+				w.wg.Add(1)
+				go w.loop()
+			}
+			return nil
+		},
+		OnStop: w.shutdown,
+	})
+}
+
+func (w *Worker) loop() {
+	defer w.wg.Done()
+
+	backoff := time.Second
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		lease, ok, err := w.lease()
+		if err != nil {
+			if w.pollCtx.Err() != nil {
+				return
+			}
+			log.Printf("[WORKER] Failed to lease a task, retrying in %s: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-w.stop:
+				return
+			}
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		backoff = time.Second
+
+		if ok {
+			w.process(lease)
+		}
+	}
+}
+
+func (w *Worker) lease() (apiModels.LeaseResponse, bool, error) {
+	var lease apiModels.LeaseResponse
+	status, err := w.client.Post(w.pollCtx, "/workers/lease", apiModels.LeaseRequest{WorkerID: w.id}, &lease)
+	if err != nil {
+		return lease, false, err
+	}
+	return lease, status == http.StatusOK, nil
+}
+
+func (w *Worker) process(lease apiModels.LeaseResponse) {
+	log.Printf("[WORKER] Checking job %s (set #%d, %d links)", lease.JobID, lease.LinksNum, len(lease.Links))
+
+	domains := make([]string, len(lease.Links))
+	for i, l := range lease.Links {
+		domains[i] = l.Domain
+	}
+
+	ctx, cancel := context.WithTimeout(w.taskCtx, services.SetCheckTimeout)
+	defer cancel()
+
+	var mutex sync.Mutex
+	var pending []apiModels.LinkResult
+	takePending := func() []apiModels.LinkResult {
+		mutex.Lock()
+		defer mutex.Unlock()
+		results := pending
+		pending = nil
+		return results
+	}
+	putBack := func(results []apiModels.LinkResult) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		pending = append(results, pending...)
+	}
+
+	// Heartbeats extend the lease and checkpoint results, lost lease means the task was canceled or given to another
+	// worker, so checking stops
+	lost := make(chan struct{})
+	heartbeatDone := make(chan struct{})
+	go func() {
+		defer close(heartbeatDone)
+		ticker := time.NewTicker(time.Duration(max(lease.HeartbeatIntervalMs, 100)) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			results := takePending()
+			err := w.report(lease.LeaseID, "heartbeat", results)
+			if errors.Is(err, errLeaseLost) {
+				log.Printf("[WORKER] Lease of job %s is lost, dropping it", lease.JobID)
+				close(lost)
+				cancel()
+				return
+			}
+			if err != nil {
+				log.Printf("[WORKER] Heartbeat of job %s failed: %v", lease.JobID, err)
+				putBack(results)
+			}
+		}
+	}()
+
+	_, err := services.CheckDomains(ctx, w.as, domains, func(i int, res models.CheckResult) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		pending = append(pending, apiModels.LinkResult{
+			Index:     lease.Links[i].Index,
+			Status:    res.Available,
+			Reason:    res.Reason,
+			LatencyMs: float64(res.Latency) / float64(time.Millisecond),
+			Time:      time.Now(),
+		})
+	})
+	cancel()
+	<-heartbeatDone
+
+	select {
+	case <-lost:
+		return
+	default:
+	}
+
+	if w.taskCtx.Err() != nil {
+		if err = w.report(lease.LeaseID, "release", takePending()); err != nil {
+			log.Printf("[WORKER] Failed to release job %s, it will be requeued once the lease expires: %v", lease.JobID, err)
+			return
+		}
+		log.Printf("[WORKER] Released job %s", lease.JobID)
+		return
+	}
+
+	// Links left unchecked when the check times out are reported as unavailable, as local workers do
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("[WORKER] Check of job %s failed: %v", lease.JobID, err)
+	}
+	results := takePending()
+	for attempt := 1; ; attempt++ {
+		err = w.report(lease.LeaseID, "complete", results)
+		if err == nil {
+			log.Printf("[WORKER] Completed job %s", lease.JobID)
+			return
+		}
+		if errors.Is(err, errLeaseLost) || attempt == 3 {
+			log.Printf("[WORKER] Failed to complete job %s: %v", lease.JobID, err)
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// report sends results to heartbeat, complete or release endpoint of the lease
+func (w *Worker) report(leaseID, action string, results []apiModels.LinkResult) error {
+	if results == nil {
+		results = []apiModels.LinkResult{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	status, err := w.client.Post(ctx, "/workers/leases/"+leaseID+"/"+action, apiModels.LeaseResultsRequest{Results: results}, nil, http.StatusGone)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusGone {
+		return errLeaseLost
+	}
+	return nil
+}
+
+func (w *Worker) shutdown(ctx context.Context) error {
+	log.Println("[WORKER] Stopping, finishing current tasks...")
+	close(w.stop)
+	w.pollCancel()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("[WORKER] Tasks didn't finish before Fx deadline, releasing them")
+		w.taskCancel()
+		<-done
+	}
+	w.taskCancel()
+	return nil
+}
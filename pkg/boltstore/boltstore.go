@@ -0,0 +1,297 @@
+package boltstore
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+)
+
+// Sets are kept in bucket "sets" under big-endian numbers, so the keys are sorted by number. Bucket "meta" holds the
+// largest number ever stored, deleted sets included, so that numbers aren't handed out again.
+var (
+	setsBucket = []byte("sets")
+	metaBucket = []byte("meta")
+	lastKey    = []byte("last")
+	probeKey   = []byte("probe")
+)
+
+var ErrSetNotFound = errors.New("set not found")
+
+var tracer = otel.Tracer("link-availability-checker/pkg/boltstore")
+
+type BoltStore struct {
+	db      *bolt.DB
+	counter uint64 // Last handed out number, atomic
+	count   int64  // Stored sets, atomic
+
+	mutex    sync.RWMutex
+	failure  error     // Error of the last append, nil once an append succeeds
+	written  time.Time // Last time a write transaction was committed or failed, by an append or a probe
+	writeErr error     // Error of that write
+
+	probeMutex sync.Mutex // Concurrent health checks wait for a single probe
+}
+
+// writeProbeInterval is how long result of a write is trusted, probing commits a transaction and syncs the file, so
+// doing it on every health check would load the disk
+const writeProbeInterval = 10 * time.Second
+
+// NewBoltStorer opens the database for the lifetime of the app
+func NewBoltStorer(lc fx.Lifecycle) (*BoltStore, error) {
+	bs, err := Open(viper.GetString(config.BoltPath))
+	if err != nil {
+		return nil, err
+	}
+
+	lc.Append(fx.Hook{OnStop: func(context.Context) error {
+		return bs.Close()
+	}})
+	return bs, nil
+}
+
+// Open opens or creates the database, bbolt locks the file, so another process can't open it at the same time
+func Open(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	bs := &BoltStore{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		sets, err := tx.CreateBucketIfNotExists(setsBucket)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		last := decodeNumber(meta.Get(lastKey))
+		if key, _ := sets.Cursor().Last(); key != nil {
+			last = max(last, decodeNumber(key))
+		}
+		bs.counter = uint64(last)
+		bs.count = int64(sets.Stats().KeyN)
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to prepare %s: %w", path, err)
+	}
+	return bs, nil
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+// AppendSet stores the set, assigning next number to it unless it already has one reserved with ReserveSetNumber. A set
+// stored under the same number before is kept, as links file keeps the first record of a number. The set is stored
+// even if ctx is done, ctx only carries trace of the caller.
+func (bs *BoltStore) AppendSet(ctx context.Context, set *models.Set) (number int, err error) {
+	_, span := tracer.Start(ctx, "BoltStore.AppendSet", trace.WithAttributes(attribute.Int("links.count", len(set.Links))))
+	defer func() {
+		span.SetAttributes(attribute.Int("set.number", number))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	if set.Number == 0 {
+		set.Number = bs.ReserveSetNumber()
+	} else {
+		bs.EnsureSetNumberReserved(set.Number)
+	}
+
+	if _, err = bs.Import([]*models.Set{set}, set.Number); err != nil {
+		bs.mutex.Lock()
+		bs.failure = err
+		bs.mutex.Unlock()
+		return 0, err
+	}
+
+	bs.mutex.Lock()
+	bs.failure = nil
+	bs.written, bs.writeErr = time.Now(), nil
+	bs.mutex.Unlock()
+	return set.Number, nil
+}
+
+// Import stores the sets in a single transaction and moves the largest stored number up to last, sets already stored
+// under their numbers are skipped. It returns how many sets were added.
+func (bs *BoltStore) Import(sets []*models.Set, last int) (int, error) {
+	values := make([][]byte, len(sets))
+	for i, set := range sets {
+		data, err := json.Marshal(set)
+		if err != nil {
+			return 0, fmt.Errorf("marshal set %d: %w", set.Number, err)
+		}
+		values[i] = data
+		last = max(last, set.Number)
+	}
+
+	added := 0
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(setsBucket)
+		for i, set := range sets {
+			key := encodeNumber(set.Number)
+			if bucket.Get(key) != nil {
+				continue
+			}
+			if err := bucket.Put(key, values[i]); err != nil {
+				return fmt.Errorf("put set %d: %w", set.Number, err)
+			}
+			added++
+		}
+
+		meta := tx.Bucket(metaBucket)
+		if decodeNumber(meta.Get(lastKey)) < last {
+			return meta.Put(lastKey, encodeNumber(last))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	atomic.AddInt64(&bs.count, int64(added))
+	bs.EnsureSetNumberReserved(last)
+	return added, nil
+}
+
+// DeleteSet removes the set, the number is never handed out again
+func (bs *BoltStore) DeleteSet(number int) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(setsBucket)
+		key := encodeNumber(number)
+		if bucket.Get(key) == nil {
+			return ErrSetNotFound
+		}
+		return bucket.Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&bs.count, -1)
+	return nil
+}
+
+func (bs *BoltStore) FindSet(number int) (*models.Set, error) {
+	sets, err := bs.FindSets([]int{number})
+	if err != nil {
+		return nil, err
+	}
+	return sets[0], nil
+}
+
+// FindSets reads the sets in a single read transaction and returns them in order of numbers
+func (bs *BoltStore) FindSets(numbers []int) ([]*models.Set, error) {
+	result := make([]*models.Set, len(numbers))
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(setsBucket)
+		for i, n := range numbers {
+			data := bucket.Get(encodeNumber(n))
+			if data == nil {
+				return fmt.Errorf("set %d: %w", n, ErrSetNotFound)
+			}
+			var set models.Set
+			if err := json.Unmarshal(data, &set); err != nil { // data is only valid within the transaction
+				return fmt.Errorf("failed to decode set %d: %w", n, err)
+			}
+			result[i] = &set
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ReserveSetNumber hands out next set number without storing anything
+func (bs *BoltStore) ReserveSetNumber() int {
+	return int(atomic.AddUint64(&bs.counter, 1))
+}
+
+// EnsureSetNumberReserved moves the counter forward so that number will never be handed out again
+func (bs *BoltStore) EnsureSetNumberReserved(number int) {
+	for {
+		current := atomic.LoadUint64(&bs.counter)
+		if current >= uint64(number) || atomic.CompareAndSwapUint64(&bs.counter, current, uint64(number)) {
+			return
+		}
+	}
+}
+
+// CheckWritable returns error if the last append failed or a write transaction can't be committed, e.g. when the disk
+// is full or mounted read-only. A transaction is only committed if nothing was written for writeProbeInterval.
+func (bs *BoltStore) CheckWritable() error {
+	bs.probeMutex.Lock()
+	defer bs.probeMutex.Unlock()
+
+	bs.mutex.RLock()
+	failure, written, writeErr := bs.failure, bs.written, bs.writeErr
+	bs.mutex.RUnlock()
+	if failure != nil {
+		return fmt.Errorf("last append failed: %w", failure)
+	}
+	if time.Since(written) < writeProbeInterval {
+		return writeErr
+	}
+
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if err := meta.Put(probeKey, []byte("ok")); err != nil {
+			return err
+		}
+		return meta.Delete(probeKey)
+	})
+
+	bs.mutex.Lock()
+	bs.written, bs.writeErr = time.Now(), err
+	bs.mutex.Unlock()
+	return err
+}
+
+// CountSets returns number of stored sets
+func (bs *BoltStore) CountSets() int {
+	return int(atomic.LoadInt64(&bs.count))
+}
+
+func encodeNumber(number int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(number))
+	return key
+}
+
+func decodeNumber(key []byte) int {
+	if len(key) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(key))
+}
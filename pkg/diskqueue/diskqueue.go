@@ -0,0 +1,102 @@
+package diskqueue
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+// Queue is a FIFO queue of JSON records kept in a file instead of memory
+//
+// It holds overflow that doesn't fit into in-memory queue. Records are appended to the end of the file and read from
+// the head offset, the file is truncated once everything is read. Queue is not meant to survive restarts (durability
+// is provided by the journal), so the file is reset when the queue is opened.
+type Queue struct {
+	path        string
+	file        *os.File
+	mutex       sync.Mutex
+	readOffset  int64
+	writeOffset int64
+	length      int
+}
+
+// ErrMalformedRecord is returned by Pop for a record that can't be decoded, the record is removed from the queue
+var ErrMalformedRecord = errors.New("malformed record")
+
+func Open(path string) (*Queue, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open/create spill file: %w", err)
+	}
+	return &Queue{path: path, file: file}, nil
+}
+
+// Push appends record to the tail of the queue
+func (q *Queue) Push(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal record: %w", err)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	n, err := q.file.WriteAt(append(data, '\n'), q.writeOffset)
+	if err != nil {
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	q.writeOffset += int64(n)
+	q.length++
+	return nil
+}
+
+// Pop reads record from the head of the queue into v, returns false if queue is empty. A failed read leaves the record
+// at the head, a record that can't be decoded is dropped with ErrMalformedRecord.
+func (q *Queue) Pop(v any) (bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.length == 0 {
+		return false, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(q.file, q.readOffset, math.MaxInt64-q.readOffset))
+	data, err := reader.ReadBytes('\n')
+	if err != nil {
+		return false, fmt.Errorf("failed to read spill file: %w", err)
+	}
+	q.readOffset += int64(len(data))
+	q.length--
+
+	if q.length == 0 { // Reclaim disk space once everything is read
+		if err = q.file.Truncate(0); err == nil {
+			q.readOffset, q.writeOffset = 0, 0
+		}
+	}
+
+	if err = json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("%w: %v", ErrMalformedRecord, err)
+	}
+	return true, nil
+}
+
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.length
+}
+
+// Close closes and removes the spill file
+func (q *Queue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	err := q.file.Close()
+	_ = os.Remove(q.path)
+	return err
+}
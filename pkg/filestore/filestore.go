@@ -1,15 +1,24 @@
 package filestore
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
 
 	"link-availability-checker/internal/config"
 	"link-availability-checker/internal/models"
@@ -17,34 +26,122 @@ import (
 )
 
 type FileStore struct {
-	path    string
-	file    *os.File
-	mutex   sync.RWMutex
-	counter uint64 // фещьшс
+	path      string
+	file      *os.File   // Links file opened for appends
+	segments  []*segment // Ordered by id, the last one is links file itself, guarded by mutex
+	mutex     sync.RWMutex
+	counter   uint64    // фещьшс
+	index     *setIndex // Guarded by mutex
+	indexPath string    // Sidecar file of the index, empty if it isn't saved
+	failure   error     // Error of the last append, nil once an append succeeds
+
+	quarantinePath  string
+	quarantineMutex sync.Mutex
+
+	activeSince     time.Time     // When links file was started, guarded by mutex
+	dirty           bool          // Segments changed since the index was saved, guarded by mutex
+	maintenance     sync.Mutex    // Held while sealed segments are rewritten or removed
+	stopMaintenance chan struct{} // nil unless maintenance runs in background
+	maintenanceDone chan struct{}
 }
 
 var ErrSetNotFound = errors.New("set not found")
 
-func NewFileStorer() (*FileStore, error) {
-	fs := &FileStore{path: viper.GetString(config.LinksFilePath)}
+var tracer = otel.Tracer("link-availability-checker/pkg/filestore")
 
-	last, err := fs.getLastSetNumberFromFile()
+// NewFileStorer opens links file for the lifetime of the app and maintains its segments in background
+func NewFileStorer(lc fx.Lifecycle) (*FileStore, error) {
+	fs, err := OpenFileStore()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get last set number: %w", err)
+		return nil, err
 	}
 
-	file, err := os.OpenFile(fs.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open/create links file: %w", err)
+	fs.stopMaintenance = make(chan struct{})
+	fs.maintenanceDone = make(chan struct{})
+	go fs.maintainSegments(fs.stopMaintenance, fs.maintenanceDone)
+	lc.Append(fx.Hook{OnStop: func(context.Context) error {
+		fs.Close()
+		return nil
+	}})
+	return fs, nil
+}
+
+// OpenFileStore opens segments of links file and their index, segments are only maintained on request
+func OpenFileStore() (*FileStore, error) {
+	fs := &FileStore{
+		path:           viper.GetString(config.LinksFilePath),
+		indexPath:      viper.GetString(config.IndexPath),
+		quarantinePath: viper.GetString(config.QuarantinePath),
+	}
+
+	if err := os.MkdirAll(fs.quarantinePath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	if err := fs.openSegments(); err != nil {
+		fs.closeFiles()
+		return nil, err
+	}
+
+	if err := fs.openIndex(); err != nil {
+		fs.closeFiles()
+		return nil, err
 	}
-	fs.file = file
 
-	atomic.StoreUint64(&fs.counter, uint64(last))
+	atomic.StoreUint64(&fs.counter, uint64(fs.index.last))
 	return fs, nil
 }
 
-func (fs *FileStore) AppendSet(set *models.Set) (int, error) {
-	set.Number = int(atomic.AddUint64(&fs.counter, 1))
+// Close stops segment maintenance, saves the index, so that the next start doesn't read all segments, and closes the
+// files
+func (fs *FileStore) Close() {
+	if fs.stopMaintenance != nil {
+		close(fs.stopMaintenance)
+		<-fs.maintenanceDone
+	}
+
+	fs.maintenance.Lock()
+	defer fs.maintenance.Unlock()
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.indexPath != "" {
+		if err := fs.saveIndex(); err != nil {
+			log.Printf("[FILESTORE] Failed to save index: %v", err)
+		}
+	}
+	fs.closeFiles()
+}
+
+func (fs *FileStore) closeFiles() {
+	if fs.file != nil {
+		closer.Close(fs.file)
+	}
+	for _, seg := range fs.segments {
+		if seg.reader != nil {
+			closer.Close(seg.reader)
+		}
+	}
+}
+
+// AppendSet stores the set, assigning next number to it unless it already has one reserved with ReserveSetNumber. The
+// set is stored even if ctx is done, ctx only carries trace of the caller.
+func (fs *FileStore) AppendSet(ctx context.Context, set *models.Set) (number int, err error) {
+	_, span := tracer.Start(ctx, "FileStore.AppendSet", trace.WithAttributes(attribute.Int("links.count", len(set.Links))))
+	defer func() {
+		span.SetAttributes(attribute.Int("set.number", number))
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	if set.Number == 0 {
+		set.Number = fs.ReserveSetNumber()
+	} else {
+		fs.EnsureSetNumberReserved(set.Number)
+	}
 
 	bytes, err := json.Marshal(set)
 	if err != nil {
@@ -54,74 +151,195 @@ func (fs *FileStore) AppendSet(set *models.Set) (int, error) {
 	fs.mutex.Lock()
 	defer fs.mutex.Unlock()
 
-	if _, err = fs.file.WriteString(string(bytes) + "\n"); err != nil {
-		return 0, fmt.Errorf("failed to append set to links file: %w", err)
+	e, err := fs.appendRecord(bytes)
+	if err != nil {
+		return 0, err
 	}
+	fs.indexRecord(recordHead{Number: set.Number}, e)
+
+	return set.Number, nil
+}
 
-	if err = fs.file.Sync(); err != nil {
-		return 0, fmt.Errorf("failed to sync links file after append: %w", err)
+// DeleteSet appends a tombstone of the set, its record is removed from disk by compaction. The number is never handed
+// out again.
+func (fs *FileStore) DeleteSet(number int) error {
+	record, err := json.Marshal(models.Set{Number: number, Deleted: true})
+	if err != nil {
+		return fmt.Errorf("marshal tombstone: %w", err)
 	}
 
-	return set.Number, nil
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if _, ok := fs.index.entries[number]; !ok {
+		return ErrSetNotFound
+	}
+	if _, err = fs.appendRecord(record); err != nil {
+		return err
+	}
+	fs.dropEntry(number)
+	return nil
 }
 
+// FindSet reads the set with a single read at its offset, sets in compressed segments are decompressed up to it
 func (fs *FileStore) FindSet(number int) (*models.Set, error) {
 	fs.mutex.RLock()
 	defer fs.mutex.RUnlock()
 
-	file, err := os.Open(fs.path) // Opening new file descriptor to avoid interfering with appends
+	e, ok := fs.index.entries[number]
+	if !ok {
+		return nil, ErrSetNotFound
+	}
+	set, err := fs.decode(fs.segment(e.segment), e)
 	if err != nil {
-		return nil, fmt.Errorf("open file for find: %w", err)
+		return nil, err
 	}
-	defer closer.Close(file)
+	if set.Number != number {
+		return nil, fmt.Errorf("index points set %d to offset %d holding set %d", number, e.offset, set.Number)
+	}
+	return set, nil
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
+// FindSets reads the sets in a single forward pass over each segment and returns them in order of numbers
+func (fs *FileStore) FindSets(numbers []int) ([]*models.Set, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	type wanted struct {
+		number int
+		entry  indexEntry
+	}
+	order := make([]wanted, 0, len(numbers))
+	for _, n := range numbers {
+		e, ok := fs.index.entries[n]
+		if !ok {
+			return nil, fmt.Errorf("set %d: %w", n, ErrSetNotFound)
+		}
+		order = append(order, wanted{number: n, entry: e})
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i].entry, order[j].entry
+		return a.segment < b.segment || a.segment == b.segment && a.offset < b.offset
+	})
+
+	sets := make(map[int]*models.Set, len(order))
+	var reader *recordReader
+	defer func() {
+		if reader != nil {
+			reader.close()
+		}
+	}()
+	for _, w := range order {
+		if _, ok := sets[w.number]; ok {
+			continue // Requested more than once
+		}
+		if reader == nil || reader.seg.id != w.entry.segment {
+			if reader != nil {
+				reader.close()
+			}
+			reader = newRecordReader(fs.segment(w.entry.segment))
+		}
+
+		line, err := reader.read(w.entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read set %d: %w", w.number, err)
+		}
+		record, err := unframe(line)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read set %d: %w", w.number, err)
+		}
 		var set models.Set
-		if err = json.Unmarshal(scanner.Bytes(), &set); err != nil {
-			continue //TODO: Comment
+		if err = json.Unmarshal(record, &set); err != nil {
+			return nil, fmt.Errorf("failed to decode set %d: %w", w.number, err)
 		}
-		if set.Number == number {
-			return &set, nil
+		if set.Number != w.number {
+			return nil, fmt.Errorf("index points set %d to offset %d holding set %d", w.number, w.entry.offset, set.Number)
 		}
+		sets[w.number] = &set
+	}
+
+	result := make([]*models.Set, len(numbers))
+	for i, n := range numbers {
+		result[i] = sets[n]
 	}
+	return result, nil
+}
 
-	if err = scanner.Err(); err != nil {
-		return nil, fmt.Errorf("scan error in find: %w", err) //TODO: Malformed 2 will break if we looked for correct 3?
+// decode reads and decodes a single record, caller must hold the mutex
+func (fs *FileStore) decode(seg *segment, e indexEntry) (*models.Set, error) {
+	line, err := seg.read(e)
+	if err != nil {
+		return nil, err
 	}
+	record, err := unframe(line)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read set at offset %d: %w", e.offset, err)
+	}
+
+	var set models.Set
+	if err = json.Unmarshal(record, &set); err != nil {
+		return nil, fmt.Errorf("failed to decode set at offset %d: %w", e.offset, err)
+	}
+	return &set, nil
+}
 
-	return nil, ErrSetNotFound
+// ReserveSetNumber hands out next set number without storing anything
+func (fs *FileStore) ReserveSetNumber() int {
+	return int(atomic.AddUint64(&fs.counter, 1))
+}
+
+// EnsureSetNumberReserved moves the counter forward so that number will never be handed out again
+func (fs *FileStore) EnsureSetNumberReserved(number int) {
+	for {
+		current := atomic.LoadUint64(&fs.counter)
+		if current >= uint64(number) || atomic.CompareAndSwapUint64(&fs.counter, current, uint64(number)) {
+			return
+		}
+	}
 }
 
 func (fs *FileStore) GetLastSetNumber() (int, error) {
 	return int(atomic.LoadUint64(&fs.counter)), nil
 }
 
-func (fs *FileStore) getLastSetNumberFromFile() (int, error) {
-	file, err := os.Open(fs.path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return 0, nil // we created new file if none existed or fell down if was unable to, but double check
-		}
-		return 0, err
+// CheckWritable returns error if the last append failed or a file can't be created next to links file, e.g. when the
+// disk is full or mounted read-only
+func (fs *FileStore) CheckWritable() error {
+	fs.mutex.RLock()
+	failure := fs.failure
+	fs.mutex.RUnlock()
+	if failure != nil {
+		return fmt.Errorf("last append failed: %w", failure)
 	}
-	defer closer.Close(file)
 
-	scanner := bufio.NewScanner(file)
-	last := 0
-	for scanner.Scan() {
-		var set models.Set
-		if err = json.Unmarshal(scanner.Bytes(), &set); err != nil {
-			continue //TODO: Comment
-		}
-		if set.Number > last {
-			last = set.Number
-		}
+	probe, err := os.CreateTemp(filepath.Dir(fs.path), ".write-probe-*")
+	if err != nil {
+		return err
+	}
+	_, err = probe.WriteString("ok")
+	closer.Close(probe)
+	if removeErr := os.Remove(probe.Name()); err == nil {
+		err = removeErr
 	}
+	return err
+}
 
-	if err = scanner.Err(); err != nil {
-		return 0, err
+// Numbers returns numbers of stored sets in ascending order
+func (fs *FileStore) Numbers() []int {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	numbers := make([]int, 0, len(fs.index.entries))
+	for n := range fs.index.entries {
+		numbers = append(numbers, n)
 	}
+	sort.Ints(numbers)
+	return numbers
+}
 
-	return last, nil
+// CountSets returns number of sets in all segments
+func (fs *FileStore) CountSets() int {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+	return len(fs.index.entries)
 }
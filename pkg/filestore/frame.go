@@ -0,0 +1,78 @@
+package filestore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"strconv"
+)
+
+// Records are stored one per line as "<length> <crc> <record>", where length and CRC-32C of the JSON record are hex
+// numbers, the length takes 8 digits or more for records over 4 GB. Lines starting with '{' are records written before
+// framing, they are read as is.
+const minLengthDigits = 8
+
+var ErrCorruptRecord = errors.New("corrupt record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// set numbers are the first field of marshalled models.Set, so the number often survives damage to the rest
+var salvagedNumber = regexp.MustCompile(`\{"Number":(\d+)[,}]`)
+
+// frame wraps a record into a line without trailing newline
+func frame(record []byte) []byte {
+	buf := make([]byte, 0, len(record)+32)
+	buf = fmt.Appendf(buf, "%08x %08x ", len(record), crc32.Checksum(record, crcTable))
+	return append(buf, record...)
+}
+
+// unframe checks a line read without trailing newline and returns the record in it
+func unframe(line []byte) ([]byte, error) {
+	if len(line) > 0 && line[0] == '{' {
+		return line, nil
+	}
+	digits := bytes.IndexByte(line, ' ')
+	if digits < minLengthDigits || digits > 16 || len(line) < digits+10 || line[digits+9] != ' ' {
+		return nil, fmt.Errorf("%w: malformed header", ErrCorruptRecord)
+	}
+	length, lengthErr := strconv.ParseUint(string(line[:digits]), 16, 63)
+	sum, sumErr := strconv.ParseUint(string(line[digits+1:digits+9]), 16, 32)
+	if lengthErr != nil || sumErr != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrCorruptRecord)
+	}
+
+	record := line[digits+10:]
+	if uint64(len(record)) != length {
+		return nil, fmt.Errorf("%w: %d bytes, header says %d", ErrCorruptRecord, len(record), length)
+	}
+	if crc32.Checksum(record, crcTable) != uint32(sum) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptRecord)
+	}
+	return record, nil
+}
+
+// decodeHead unframes a line and decodes the fields index is built from
+func decodeHead(line []byte) ([]byte, recordHead, error) {
+	record, err := unframe(line)
+	if err != nil {
+		return nil, recordHead{}, err
+	}
+	var head recordHead
+	if err = json.Unmarshal(record, &head); err != nil {
+		return nil, recordHead{}, fmt.Errorf("%w: %v", ErrCorruptRecord, err)
+	}
+	return record, head, nil
+}
+
+// salvageNumber returns set number found in a damaged record or 0
+func salvageNumber(raw []byte) int {
+	match := salvagedNumber.FindSubmatch(raw)
+	if match == nil {
+		return 0
+	}
+	number, _ := strconv.Atoi(string(match[1]))
+	return number
+}
@@ -0,0 +1,350 @@
+package filestore
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/utils/closer"
+)
+
+// HistoryStore keeps results of checks per domain. It doesn't depend on the backend of link sets. Domains come from
+// public requests, so the number of domain files is capped and records older than retention are pruned in background.
+type HistoryStore struct {
+	path      string
+	mutex     sync.RWMutex
+	files     int // Domain files in the directory, guarded by mutex
+	maxFiles  int // 0 - no limit
+	retention time.Duration
+	capLogged bool // Reaching the cap was logged since it was last below it, guarded by mutex
+	stopPrune chan struct{}
+	pruneDone chan struct{}
+}
+
+const (
+	historyPruneInterval = time.Hour
+	// historySlack covers records appended out of order by concurrent checks of the same domain
+	historySlack = time.Minute
+	// historyScanWindow is the part of a file read line by line once seeking has narrowed down to it
+	historyScanWindow = 64 << 10
+)
+
+func NewHistoryStore(lc fx.Lifecycle) (*HistoryStore, error) {
+	hs := &HistoryStore{
+		path:      viper.GetString(config.HistoryPath),
+		maxFiles:  viper.GetInt(config.HistoryDomains),
+		retention: viper.GetDuration(config.HistoryKeep),
+		stopPrune: make(chan struct{}),
+		pruneDone: make(chan struct{}),
+	}
+	if err := os.MkdirAll(hs.path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create history directory: %w", err)
+	}
+	entries, err := os.ReadDir(hs.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history directory: %w", err)
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".jsonl") {
+			hs.files++
+		}
+	}
+
+	go hs.pruneLoop()
+	lc.Append(fx.Hook{OnStop: func(context.Context) error {
+		close(hs.stopPrune)
+		<-hs.pruneDone
+		return nil
+	}})
+	return hs, nil
+}
+
+// AppendChecks adds check results to history of their domains, every domain has its own file of JSON lines. Results of
+// domains without history are dropped once the number of domain files reaches the limit.
+func (hs *HistoryStore) AppendChecks(records []models.CheckRecord) error {
+	byDomain := make(map[string][]byte)
+	for _, r := range records {
+		r.Domain = normalizeDomain(r.Domain)
+		bytes, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("marshal check record: %w", err)
+		}
+		byDomain[r.Domain] = append(append(byDomain[r.Domain], bytes...), '\n')
+	}
+
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+
+	dropped := 0
+	for domain, data := range byDomain {
+		added, err := hs.appendHistoryFile(domain, data)
+		if err != nil {
+			return err
+		}
+		if !added {
+			dropped++
+		}
+	}
+	if dropped > 0 && !hs.capLogged {
+		log.Printf("[HISTORY] %d domain files reached the limit, checks of %d new domains aren't recorded until retention frees some",
+			hs.files, dropped)
+		hs.capLogged = true
+	}
+	return nil
+}
+
+// appendHistoryFile isn't synced, losing last few records on power loss is fine for statistics. It returns false if the
+// domain has no file and no more files may be created. Caller must hold the mutex.
+func (hs *HistoryStore) appendHistoryFile(domain string, data []byte) (bool, error) {
+	path := hs.historyFile(domain)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if os.IsNotExist(err) {
+		if hs.maxFiles > 0 && hs.files >= hs.maxFiles {
+			return false, nil
+		}
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			hs.files++
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open/create history of %s: %w", domain, err)
+	}
+	defer closer.Close(file)
+
+	if _, err = file.Write(data); err != nil {
+		return false, fmt.Errorf("failed to append history of %s: %w", domain, err)
+	}
+	return true, nil
+}
+
+// ReadChecks returns history records of the domain made within [from, to) in the order they were added. Records are
+// appended in time order, so reading starts at from found by binary search and stops after to.
+func (hs *HistoryStore) ReadChecks(domain string, from, to time.Time) ([]models.CheckRecord, error) {
+	domain = normalizeDomain(domain)
+
+	hs.mutex.RLock()
+	defer hs.mutex.RUnlock()
+
+	records := make([]models.CheckRecord, 0)
+	file, err := os.Open(hs.historyFile(domain))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, fmt.Errorf("open history of %s: %w", domain, err)
+	}
+	defer closer.Close(file)
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat history of %s: %w", domain, err)
+	}
+	offset, err := seekTime(file, info.Size(), from.Add(-historySlack))
+	if err != nil {
+		return nil, fmt.Errorf("seek in history of %s: %w", domain, err)
+	}
+
+	scanner := bufio.NewScanner(io.NewSectionReader(file, offset, info.Size()-offset))
+	for scanner.Scan() {
+		var r models.CheckRecord
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue // Torn last line after crash
+		}
+		if !r.Time.Before(to.Add(historySlack)) {
+			break
+		}
+		if !r.Time.Before(from) && r.Time.Before(to) {
+			records = append(records, r)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan error in history of %s: %w", domain, err)
+	}
+	return records, nil
+}
+
+// seekTime returns offset of a line at or before the first record made at t, narrowing the file down by binary search
+// to a window that is read line by line
+func seekTime(file *os.File, size int64, t time.Time) (int64, error) {
+	lo, hi := int64(0), size // lo is always a line start whose record is before t
+	for hi-lo > historyScanWindow {
+		mid := lo + (hi-lo)/2
+		reader := bufio.NewReader(io.NewSectionReader(file, mid, size-mid))
+		skipped, err := reader.ReadBytes('\n') // Rest of the line mid points into
+		if err != nil {
+			hi = mid
+			continue
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+
+		var r models.CheckRecord
+		if json.Unmarshal(line, &r) != nil || !r.Time.Before(t) {
+			hi = mid
+		} else {
+			lo = mid + int64(len(skipped))
+		}
+	}
+	return lo, nil
+}
+
+func (hs *HistoryStore) pruneLoop() {
+	defer close(hs.pruneDone)
+	if hs.retention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(historyPruneInterval)
+	defer ticker.Stop()
+	for {
+		hs.prune()
+		select {
+		case <-hs.stopPrune:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune drops records older than retention, files left without records are removed
+func (hs *HistoryStore) prune() {
+	cutoff := time.Now().Add(-hs.retention)
+	entries, err := os.ReadDir(hs.path)
+	if err != nil {
+		log.Printf("[HISTORY] Failed to read history directory: %v", err)
+		return
+	}
+
+	removed, trimmed := 0, 0
+	for _, e := range entries {
+		select {
+		case <-hs.stopPrune:
+			return
+		default:
+		}
+		if !strings.HasSuffix(e.Name(), ".jsonl") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(hs.path, e.Name())
+
+		hs.mutex.Lock()
+		if info.ModTime().Before(cutoff) {
+			err = os.Remove(path) // Nothing was appended since cutoff
+			if err == nil {
+				hs.files--
+				removed++
+			}
+		} else {
+			var changed bool
+			changed, err = trimHistoryFile(path, cutoff)
+			if changed {
+				trimmed++
+			}
+		}
+		if hs.files < hs.maxFiles {
+			hs.capLogged = false
+		}
+		hs.mutex.Unlock()
+
+		if err != nil {
+			log.Printf("[HISTORY] Failed to prune %s: %v", e.Name(), err)
+		}
+	}
+	if removed > 0 || trimmed > 0 {
+		log.Printf("[HISTORY] Pruned records older than %s: %d domain files removed, %d trimmed", hs.retention, removed, trimmed)
+	}
+}
+
+// trimHistoryFile rewrites the file without records made before cutoff, caller must hold the mutex
+func trimHistoryFile(path string, cutoff time.Time) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer closer.Close(file)
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	offset, err := seekTime(file, info.Size(), cutoff.Add(-historySlack))
+	if err != nil {
+		return false, err
+	}
+
+	// Skip to the first record made at cutoff, the rest is kept as is
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, info.Size()-offset))
+	for {
+		line, err := reader.ReadBytes('\n')
+		var r models.CheckRecord
+		if len(line) > 0 && json.Unmarshal(line, &r) == nil && !r.Time.Before(cutoff) {
+			break
+		}
+		offset += int64(len(line))
+		if err != nil {
+			break
+		}
+	}
+	if offset == 0 {
+		return false, nil
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	if _, err = io.Copy(out, io.NewSectionReader(file, offset, info.Size()-offset)); err != nil {
+		closer.Close(out)
+		_ = os.Remove(tmp)
+		return false, err
+	}
+	if err = out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSpace(domain))
+}
+
+// historyFile returns path of domain history, domains that aren't safe file names are replaced with their hash
+func (hs *HistoryStore) historyFile(domain string) string {
+	safe := len(domain) > 0 && len(domain) <= 200 && domain[0] != '.'
+	for _, c := range domain {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			safe = false
+			break
+		}
+	}
+	if !safe {
+		sum := sha256.Sum256([]byte(domain))
+		domain = "#" + hex.EncodeToString(sum[:])
+	}
+	return filepath.Join(hs.path, domain+".jsonl")
+}
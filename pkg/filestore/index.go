@@ -0,0 +1,283 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"link-availability-checker/internal/utils/closer"
+)
+
+// setIndex maps set numbers to their records in segments of links file, so that a set is read with a single disk read
+// instead of decoding the file from the start. It's guarded by FileStore.mutex.
+type setIndex struct {
+	entries map[int]indexEntry
+	last    int // The largest number ever stored, including deleted and expired sets
+}
+
+type indexEntry struct {
+	segment int
+	offset  int64
+	length  int64 // Without trailing newline
+}
+
+// savedSegment describes a segment at the moment the index was saved
+type savedSegment struct {
+	id         int
+	size       int64
+	dead       int64
+	fileSize   int64 // Size on disk of sealed segment, 0 for the active one
+	compressed bool
+}
+
+var indexMagic = [4]byte{'L', 'I', 'D', 'X'}
+
+const indexVersion = 2
+
+func newSetIndex() *setIndex {
+	return &setIndex{entries: make(map[int]indexEntry)}
+}
+
+// indexRecord applies a record to the index, caller must hold the mutex. Tombstones remove the set, the first record of
+// a number is kept as lookups by scanning used to return it, later ones are dead.
+func (fs *FileStore) indexRecord(head recordHead, e indexEntry) {
+	fs.index.last = max(fs.index.last, head.Number)
+	if head.Deleted {
+		fs.dropEntry(head.Number)
+		return
+	}
+	if _, ok := fs.index.entries[head.Number]; ok {
+		if seg := fs.segment(e.segment); seg != nil {
+			seg.dead += e.length + 1
+		}
+		return
+	}
+	fs.index.entries[head.Number] = e
+}
+
+// dropEntry removes the set from index, its record is dead until compaction. Caller must hold the mutex.
+func (fs *FileStore) dropEntry(number int) bool {
+	e, ok := fs.index.entries[number]
+	if !ok {
+		return false
+	}
+	delete(fs.index.entries, number)
+	if seg := fs.segment(e.segment); seg != nil {
+		seg.dead += e.length + 1
+	}
+	return true
+}
+
+// saveIndex writes the index to the sidecar file atomically: header, segments, entries and CRC of all of them. Caller
+// must hold the mutex.
+func (fs *FileStore) saveIndex() error {
+	tmp := fs.indexPath + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp) }() // No-op after rename
+
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(file, crc))
+
+	numbers := make([]int, 0, len(fs.index.entries))
+	for n := range fs.index.entries {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	// Errors of buffered writer are returned by Flush
+	_ = binary.Write(w, binary.LittleEndian, indexMagic)
+	_ = binary.Write(w, binary.LittleEndian, uint32(indexVersion))
+	_ = binary.Write(w, binary.LittleEndian, [2]int64{int64(fs.index.last), int64(len(fs.segments))})
+	for _, seg := range fs.segments {
+		var fileSize, compressed int64
+		if seg != fs.active() {
+			info, err := os.Stat(seg.path)
+			if err != nil {
+				closer.Close(file)
+				return err
+			}
+			fileSize = info.Size()
+		}
+		if seg.compressed {
+			compressed = 1
+		}
+		_ = binary.Write(w, binary.LittleEndian, [5]int64{int64(seg.id), seg.size, seg.dead, fileSize, compressed})
+	}
+	_ = binary.Write(w, binary.LittleEndian, int64(len(numbers)))
+	for _, n := range numbers {
+		e := fs.index.entries[n]
+		_ = binary.Write(w, binary.LittleEndian, [4]int64{int64(n), int64(e.segment), e.offset, e.length})
+	}
+
+	if err = w.Flush(); err != nil {
+		closer.Close(file)
+		return err
+	}
+	if err = binary.Write(file, binary.LittleEndian, crc.Sum32()); err != nil {
+		closer.Close(file)
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		closer.Close(file)
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fs.indexPath)
+}
+
+// loadSetIndex reads index saved by saveIndex, damaged or foreign file is reported as error
+func loadSetIndex(path string) (*setIndex, []savedSegment, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < 4 {
+		return nil, nil, errors.New("file is too short")
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, nil, errors.New("checksum mismatch")
+	}
+
+	r := bytes.NewReader(body)
+	var header struct {
+		Magic    [4]byte
+		Version  uint32
+		Last     int64
+		Segments int64
+	}
+	if err = binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, nil, fmt.Errorf("failed to read header: %w", err)
+	}
+	if header.Magic != indexMagic || header.Version != indexVersion {
+		return nil, nil, fmt.Errorf("unknown format %q version %d", header.Magic[:], header.Version)
+	}
+	if header.Segments < 1 || header.Segments*40 > int64(r.Len()) {
+		return nil, nil, errors.New("segment count doesn't match file size")
+	}
+
+	segments := make([]savedSegment, header.Segments)
+	for i := range segments {
+		var s [5]int64
+		if err = binary.Read(r, binary.LittleEndian, &s); err != nil {
+			return nil, nil, fmt.Errorf("failed to read segment: %w", err)
+		}
+		segments[i] = savedSegment{id: int(s[0]), size: s[1], dead: s[2], fileSize: s[3], compressed: s[4] == 1}
+	}
+
+	var count int64
+	if err = binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, nil, fmt.Errorf("failed to read entry count: %w", err)
+	}
+	if count < 0 || count*32 != int64(r.Len()) {
+		return nil, nil, errors.New("entry count doesn't match file size")
+	}
+
+	idx := &setIndex{entries: make(map[int]indexEntry, count), last: int(header.Last)}
+	for i := int64(0); i < count; i++ {
+		var e [4]int64
+		if err = binary.Read(r, binary.LittleEndian, &e); err != nil {
+			return nil, nil, fmt.Errorf("failed to read entry: %w", err)
+		}
+		idx.entries[int(e[0])] = indexEntry{segment: int(e[1]), offset: e[2], length: e[3]}
+	}
+	return idx, segments, nil
+}
+
+// openIndex loads sidecar index if it matches the segments and indexes records appended to links file after it was
+// saved, otherwise all segments are indexed. Caller must hold the mutex.
+func (fs *FileStore) openIndex() error {
+	if fs.indexPath != "" {
+		idx, saved, err := loadSetIndex(fs.indexPath)
+		if err == nil {
+			err = fs.checkIndex(idx, saved)
+		}
+		switch {
+		case err == nil:
+			fs.index = idx
+			for i, seg := range fs.segments {
+				seg.size, seg.dead = saved[i].size, saved[i].dead
+			}
+			active := fs.active()
+			from := active.size
+			if err = fs.scanSegment(active, from); err != nil {
+				return fmt.Errorf("failed to index links file: %w", err)
+			}
+			log.Printf("[FILESTORE] Loaded index of %d sets in %d segments, %d bytes appended since it was saved",
+				len(idx.entries), len(fs.segments), active.size-from)
+			return nil
+		case !errors.Is(err, os.ErrNotExist):
+			log.Printf("[FILESTORE] Rebuilding index, saved one doesn't match links file: %v", err)
+		}
+	}
+
+	fs.index = newSetIndex()
+	for _, seg := range fs.segments {
+		seg.size, seg.dead = 0, 0
+		if err := fs.scanSegment(seg, 0); err != nil {
+			return fmt.Errorf("failed to index links file: %w", err)
+		}
+	}
+
+	if fs.indexPath != "" {
+		if err := fs.saveIndex(); err != nil {
+			log.Printf("[FILESTORE] Failed to save index: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkIndex tells if saved index describes the segments: sealed ones must be unchanged, links file may only have
+// grown since and the last indexed record in it must still be where the index says
+func (fs *FileStore) checkIndex(idx *setIndex, saved []savedSegment) error {
+	if len(saved) != len(fs.segments) {
+		return fmt.Errorf("index has %d segments, found %d", len(saved), len(fs.segments))
+	}
+	for i, seg := range fs.segments {
+		s := saved[i]
+		if s.id != seg.id || s.compressed != seg.compressed {
+			return fmt.Errorf("segment %d isn't in index", seg.id)
+		}
+		info, err := os.Stat(seg.path)
+		if err != nil {
+			return err
+		}
+		if seg != fs.active() && info.Size() != s.fileSize {
+			return fmt.Errorf("segment %d has changed since index was saved", seg.id)
+		}
+		if seg == fs.active() && info.Size() < s.size {
+			return fmt.Errorf("index covers %d bytes, links file has %d", s.size, info.Size())
+		}
+	}
+
+	active := fs.active()
+	number, last, found := 0, indexEntry{offset: -1}, false
+	for n, e := range idx.entries {
+		if e.segment == active.id && e.offset > last.offset {
+			number, last, found = n, e, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	set, err := fs.decode(active, last)
+	if err != nil {
+		return err
+	}
+	if set.Number != number {
+		return fmt.Errorf("set %d is not at offset %d", number, last.offset)
+	}
+	return nil
+}
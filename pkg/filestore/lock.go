@@ -0,0 +1,161 @@
+package filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/fx"
+
+	"link-availability-checker/internal/config"
+)
+
+const lockFileName = ".lock"
+
+var (
+	ErrDirLocked = errors.New("data directory is locked by another instance")
+	errLockBusy  = errors.New("lock is held")
+)
+
+// DirLock is an exclusive advisory lock of the data directory. Set numbers are counted in memory from the links file,
+// so two instances on the same directory would hand out duplicate numbers and interleave their writes.
+type DirLock struct {
+	file *os.File
+}
+
+// LockDataDir locks every directory holding data of the app for its lifetime, startup fails if another instance
+// holds any of them longer than lock wait. A process started by restart waits for the old one at least RestartLockWait.
+func LockDataDir(lc fx.Lifecycle) {
+	wait := viper.GetDuration(config.LockWait)
+	if restart, err := time.ParseDuration(os.Getenv(config.RestartLockWaitEnv)); err == nil {
+		wait = max(wait, restart)
+	}
+
+	deadline := time.Now().Add(wait)
+	var locks []*DirLock
+	for _, dir := range dataDirs() {
+		lock, err := LockDir(dir, max(time.Until(deadline), 0))
+		if err != nil {
+			for _, l := range locks {
+				_ = l.Unlock()
+			}
+			log.Fatalf("Failed to lock data directory: %v", err)
+		}
+		locks = append(locks, lock)
+	}
+
+	lc.Append(fx.Hook{OnStop: func(context.Context) error {
+		// Appended first, so released after everything else is closed
+		var errs []error
+		for _, l := range locks {
+			errs = append(errs, l.Unlock())
+		}
+		return errors.Join(errs...)
+	}})
+}
+
+// dataDirs returns directories of configured data files, sorted so that instances sharing some of them lock in the
+// same order
+func dataDirs() []string {
+	var dirs []string
+	add := func(dir string) {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, key := range []string{
+		config.LinksFilePath, config.BoltPath, config.IndexPath, config.QueueFilePath, config.QueueSpillPath,
+		config.IdempotencyPath, config.WebhookOutboxPath, config.WebhookLogPath, config.SchedulerPath,
+		config.SchedulerRunsPath, config.IncidentStatePath, config.IncidentLogPath,
+	} {
+		if path := viper.GetString(key); path != "" {
+			add(filepath.Dir(path))
+		}
+	}
+	for _, key := range []string{config.HistoryPath, config.QuarantinePath} {
+		if path := viper.GetString(key); path != "" {
+			add(path)
+		}
+	}
+
+	slices.Sort(dirs)
+	return dirs
+}
+
+// LockDir locks dir, waiting up to wait for the instance holding it to exit, fails at once if wait is 0
+func LockDir(dir string, wait time.Duration) (*DirLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	path := filepath.Join(dir, lockFileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		err = tryLock(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLockBusy) {
+			_ = file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+
+		if time.Now().After(deadline) {
+			holder := lockHolder(file)
+			_ = file.Close()
+			return nil, fmt.Errorf("%w: %s is held by %s", ErrDirLocked, path, holder)
+		}
+		if !logged {
+			log.Printf("[FILESTORE] Data directory %s is locked by %s, waiting up to %s for it to exit", dir, lockHolder(file), wait.Round(time.Second))
+			logged = true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	// PID is only informational, the lock itself is released by the kernel even if the process crashes
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		log.Printf("[FILESTORE] Failed to write PID to lock file %s: %v", path, err)
+	}
+
+	return &DirLock{file: file}, nil
+}
+
+func (l *DirLock) Unlock() error {
+	// Lock file isn't removed, another instance may already wait on it
+	if err := unlock(l.file); err != nil {
+		_ = l.file.Close()
+		return fmt.Errorf("failed to unlock data directory: %w", err)
+	}
+	return l.file.Close()
+}
+
+func lockHolder(file *os.File) string {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 32))
+	pid := strings.TrimSpace(string(data))
+	if err != nil || pid == "" {
+		return "unknown process"
+	}
+	return "pid " + pid
+}
@@ -0,0 +1,21 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package filestore
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+var warnNoLock sync.Once
+
+// tryLock doesn't lock on platforms without file locks, running a single instance is up to the operator
+func tryLock(*os.File) error {
+	warnNoLock.Do(func() {
+		log.Printf("[FILESTORE] File locks aren't supported on this platform, data directories aren't locked")
+	})
+	return nil
+}
+
+func unlock(*os.File) error { return nil }
@@ -0,0 +1,29 @@
+//go:build windows
+
+package filestore
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// The last byte of the largest possible file is locked instead of its content, Windows locks are mandatory and would
+// keep waiting instance from reading PID of the holder
+const lockOffset = ^uint32(0)
+
+// tryLock takes exclusive lock of the file without waiting, errLockBusy is returned if another process holds it
+func tryLock(file *os.File) error {
+	overlapped := &windows.Overlapped{Offset: lockOffset, OffsetHigh: lockOffset}
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, overlapped)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return errLockBusy
+	}
+	return err
+}
+
+func unlock(file *os.File) error {
+	overlapped := &windows.Overlapped{Offset: lockOffset, OffsetHigh: lockOffset}
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, overlapped)
+}
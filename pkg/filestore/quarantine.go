@@ -0,0 +1,130 @@
+package filestore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/utils/closer"
+)
+
+// Damaged records found in segments are copied to quarantine directory as <id>.bad, their descriptions are appended to
+// records.jsonl there. The records themselves are dead and dropped by compaction.
+const quarantineLog = "records.jsonl"
+
+var ErrQuarantinedNotFound = errors.New("quarantined record not found")
+
+var quarantineID = regexp.MustCompile(`^\d{6,}-\d+-[0-9a-f]{8}$`)
+
+// quarantine keeps bytes of a damaged record and returns set number salvaged from it, 0 if there is none. Records are
+// identified by segment, offset and checksum of the bytes, so rescans don't duplicate them.
+func (fs *FileStore) quarantine(seg *segment, offset int64, raw []byte, reason error) int {
+	number := salvageNumber(raw)
+	log.Printf("[FILESTORE] Corrupt record at %s:%d, %d bytes (%v), salvaged set number %d",
+		filepath.Base(seg.path), offset, len(raw), reason, number)
+
+	rec := models.QuarantinedRecord{
+		ID:      fmt.Sprintf("%06d-%d-%08x", seg.id, offset, crc32.Checksum(raw, crcTable)),
+		Segment: filepath.Base(seg.path),
+		Offset:  offset,
+		Length:  int64(len(raw)),
+		Reason:  reason.Error(),
+		Number:  number,
+		Time:    time.Now(),
+	}
+	if err := fs.saveQuarantined(rec, raw); err != nil {
+		log.Printf("[FILESTORE] Failed to quarantine record at %s:%d: %v", rec.Segment, offset, err)
+	}
+	return number
+}
+
+func (fs *FileStore) saveQuarantined(rec models.QuarantinedRecord, raw []byte) error {
+	fs.quarantineMutex.Lock()
+	defer fs.quarantineMutex.Unlock()
+
+	path := filepath.Join(fs.quarantinePath, rec.ID+".bad")
+	if _, err := os.Stat(path); err == nil {
+		return nil // Already quarantined by previous scan
+	}
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(fs.quarantinePath, quarantineLog), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer closer.Close(file)
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// QuarantinedRecords lists damaged records which weren't deleted from quarantine, oldest first
+func (fs *FileStore) QuarantinedRecords() ([]models.QuarantinedRecord, error) {
+	fs.quarantineMutex.Lock()
+	defer fs.quarantineMutex.Unlock()
+
+	file, err := os.Open(filepath.Join(fs.quarantinePath, quarantineLog))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer closer.Close(file)
+
+	var records []models.QuarantinedRecord
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec models.QuarantinedRecord
+		if json.Unmarshal(scanner.Bytes(), &rec) != nil || seen[rec.ID] {
+			continue
+		}
+		seen[rec.ID] = true
+		if _, err = os.Stat(filepath.Join(fs.quarantinePath, rec.ID+".bad")); err == nil {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// ReadQuarantined returns bytes of a quarantined record
+func (fs *FileStore) ReadQuarantined(id string) ([]byte, error) {
+	if !quarantineID.MatchString(id) {
+		return nil, ErrQuarantinedNotFound
+	}
+	data, err := os.ReadFile(filepath.Join(fs.quarantinePath, id+".bad"))
+	if os.IsNotExist(err) {
+		return nil, ErrQuarantinedNotFound
+	}
+	return data, err
+}
+
+// DeleteQuarantined removes a record from quarantine once it was inspected
+func (fs *FileStore) DeleteQuarantined(id string) error {
+	if !quarantineID.MatchString(id) {
+		return ErrQuarantinedNotFound
+	}
+
+	fs.quarantineMutex.Lock()
+	defer fs.quarantineMutex.Unlock()
+
+	err := os.Remove(filepath.Join(fs.quarantinePath, id+".bad"))
+	if os.IsNotExist(err) {
+		return ErrQuarantinedNotFound
+	}
+	return err
+}
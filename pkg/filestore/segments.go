@@ -0,0 +1,722 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/models"
+	"link-availability-checker/internal/utils/closer"
+)
+
+// segment is a file of links file records. The active segment is links file itself, on seal it's renamed to
+// <links file>.<id> and may be gzipped later. Offsets in index are offsets in uncompressed records.
+type segment struct {
+	id         int
+	path       string
+	compressed bool
+	size       int64     // Bytes of records, uncompressed
+	dead       int64     // Bytes of records missing from index: deleted, expired or stored more than once
+	reader     *os.File  // Used for ReadAt, nil for compressed segments which are read from the start
+	sealedAt   time.Time // Modification time of sealed segment, kept on compaction and compression
+}
+
+// recordHead is the part of a record the index is built from
+type recordHead struct {
+	Number  int
+	Deleted bool
+}
+
+var segmentSuffix = regexp.MustCompile(`^\.(\d{6,})(\.gz)?$`)
+
+func (fs *FileStore) segmentPath(id int, compressed bool) string {
+	path := fmt.Sprintf("%s.%06d", fs.path, id)
+	if compressed {
+		path += ".gz"
+	}
+	return path
+}
+
+// openSegments finds sealed segments next to links file and opens links file as the active segment. Leftovers of
+// interrupted compaction or compression are removed.
+func (fs *FileStore) openSegments() error {
+	dir, base := filepath.Dir(fs.path), filepath.Base(fs.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list segments: %w", err)
+	}
+
+	found := make(map[int]*segment)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".tmp") && segmentSuffix.MatchString(strings.TrimSuffix(name, ".tmp")[len(base):]) {
+			log.Printf("[FILESTORE] Removing leftover %s", name)
+			_ = os.Remove(path)
+			continue
+		}
+		match := segmentSuffix.FindStringSubmatch(name[len(base):])
+		if match == nil {
+			continue
+		}
+		id, _ := strconv.Atoi(match[1])
+		if seg, ok := found[id]; ok {
+			// Compression was interrupted after gzipped copy was complete
+			plain := seg.path
+			if seg.compressed {
+				plain = path
+			}
+			log.Printf("[FILESTORE] Removing %s, its compressed copy exists", filepath.Base(plain))
+			_ = os.Remove(plain)
+			found[id] = &segment{id: id, path: fs.segmentPath(id, true), compressed: true}
+			continue
+		}
+		found[id] = &segment{id: id, path: path, compressed: match[2] != ""}
+	}
+
+	fs.segments = make([]*segment, 0, len(found)+1)
+	for _, seg := range found {
+		fs.segments = append(fs.segments, seg)
+	}
+	sort.Slice(fs.segments, func(i, j int) bool { return fs.segments[i].id < fs.segments[j].id })
+
+	fs.activeSince = time.Now()
+	for _, seg := range fs.segments {
+		info, err := os.Stat(seg.path)
+		if err != nil {
+			return fmt.Errorf("failed to open segment: %w", err)
+		}
+		seg.sealedAt = info.ModTime()
+		fs.activeSince = seg.sealedAt // The active segment was started when the newest one was sealed
+		if !seg.compressed {
+			if seg.reader, err = os.Open(seg.path); err != nil {
+				return fmt.Errorf("failed to open segment: %w", err)
+			}
+		}
+	}
+
+	file, err := os.OpenFile(fs.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open/create links file: %w", err)
+	}
+	reader, err := os.Open(fs.path)
+	if err != nil {
+		closer.Close(file)
+		return fmt.Errorf("failed to open links file for reading: %w", err)
+	}
+	fs.file = file
+
+	id := 1
+	if len(fs.segments) > 0 {
+		id = fs.segments[len(fs.segments)-1].id + 1
+	}
+	fs.segments = append(fs.segments, &segment{id: id, path: fs.path, reader: reader})
+	return nil
+}
+
+// active returns the segment appends go to, caller must hold the mutex
+func (fs *FileStore) active() *segment {
+	return fs.segments[len(fs.segments)-1]
+}
+
+// segment returns segment by id or nil, caller must hold the mutex
+func (fs *FileStore) segment(id int) *segment {
+	i := sort.Search(len(fs.segments), func(i int) bool { return fs.segments[i].id >= id })
+	if i < len(fs.segments) && fs.segments[i].id == id {
+		return fs.segments[i]
+	}
+	return nil
+}
+
+// open returns uncompressed records of the segment starting at offset
+func (seg *segment) open(offset int64) (io.ReadCloser, error) {
+	if !seg.compressed {
+		return io.NopCloser(io.NewSectionReader(seg.reader, offset, math.MaxInt64-offset)), nil
+	}
+
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		closer.Close(file)
+		return nil, fmt.Errorf("failed to read %s: %w", filepath.Base(seg.path), err)
+	}
+	r := &gzipFile{Reader: gz, file: file}
+	if _, err = io.CopyN(io.Discard, gz, offset); err != nil {
+		closer.Close(r)
+		return nil, fmt.Errorf("failed to seek in %s: %w", filepath.Base(seg.path), err)
+	}
+	return r, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	return errors.Join(f.Reader.Close(), f.file.Close())
+}
+
+// read returns a single record, compressed segment is decompressed up to it
+func (seg *segment) read(e indexEntry) ([]byte, error) {
+	buf := make([]byte, e.length)
+	if !seg.compressed {
+		if _, err := seg.reader.ReadAt(buf, e.offset); err != nil {
+			return nil, fmt.Errorf("failed to read set at offset %d: %w", e.offset, err)
+		}
+		return buf, nil
+	}
+
+	r, err := seg.open(e.offset)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close(r)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read set at offset %d: %w", e.offset, err)
+	}
+	return buf, nil
+}
+
+// recordReader reads records of a segment in order of offsets. Small gaps are skipped within the buffer, far records
+// of uncompressed segment are reached by moving the reader forward, compressed segment is decompressed once.
+type recordReader struct {
+	seg *segment
+	buf *bufio.Reader
+	src io.ReadCloser
+	pos int64 // Offset of buf in the segment, -1 until it's positioned
+}
+
+func newRecordReader(seg *segment) *recordReader {
+	return &recordReader{seg: seg, buf: bufio.NewReaderSize(nil, 64*1024), pos: -1}
+}
+
+func (r *recordReader) read(e indexEntry) ([]byte, error) {
+	gap := e.offset - r.pos
+	if r.pos < 0 || (!r.seg.compressed && gap > int64(r.buf.Buffered())) {
+		r.close()
+		src, err := r.seg.open(e.offset)
+		if err != nil {
+			return nil, err
+		}
+		r.src = src
+		r.buf.Reset(src)
+	} else if _, err := r.buf.Discard(int(gap)); err != nil {
+		return nil, fmt.Errorf("failed to seek to offset %d: %w", e.offset, err)
+	}
+
+	buf := make([]byte, e.length)
+	if _, err := io.ReadFull(r.buf, buf); err != nil {
+		return nil, fmt.Errorf("failed to read set at offset %d: %w", e.offset, err)
+	}
+	r.pos = e.offset + e.length
+	return buf, nil
+}
+
+func (r *recordReader) close() {
+	if r.src != nil {
+		closer.Close(r.src)
+		r.src = nil
+	}
+}
+
+// scanSegment indexes records of the segment starting at offset, caller must hold the mutex. Damaged records are
+// quarantined, except for the last one in links file: it's a write torn by a crash and links file is truncated before it.
+func (fs *FileStore) scanSegment(seg *segment, offset int64) error {
+	src, err := seg.open(offset)
+	if err != nil {
+		return err
+	}
+	defer closer.Close(src)
+
+	var bad []byte // Damaged line, it's quarantined once another line follows it
+	var badOffset int64
+	var badErr error
+	flushBad := func() {
+		if bad != nil {
+			fs.index.last = max(fs.index.last, fs.quarantine(seg, badOffset, bad, badErr))
+			seg.dead += int64(len(bad))
+			bad = nil
+		}
+	}
+
+	seg.size = offset
+	reader := bufio.NewReaderSize(src, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			flushBad()
+			if !bytes.HasSuffix(line, []byte("\n")) {
+				bad, badOffset, badErr = line, seg.size, fmt.Errorf("%w: no end of line", ErrCorruptRecord)
+			} else if _, head, decodeErr := decodeHead(line[:len(line)-1]); decodeErr != nil {
+				bad, badOffset, badErr = line, seg.size, decodeErr
+			} else {
+				fs.indexRecord(head, indexEntry{segment: seg.id, offset: seg.size, length: int64(len(line) - 1)})
+			}
+			seg.size += int64(len(line))
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to scan %s: %w", filepath.Base(seg.path), err)
+		}
+	}
+
+	if bad == nil || seg != fs.active() {
+		flushBad()
+		return nil
+	}
+	if err = fs.file.Truncate(badOffset); err != nil {
+		return fmt.Errorf("failed to truncate torn record of links file: %w", err)
+	}
+	log.Printf("[FILESTORE] Truncated torn record at the end of links file, offset %d, %d bytes (%v)", badOffset, len(bad), badErr)
+	seg.size = badOffset
+	return nil
+}
+
+// appendRecord writes a record to the active segment and seals the segment once it's full, caller must hold the mutex
+func (fs *FileStore) appendRecord(record []byte) (indexEntry, error) {
+	active := fs.active()
+	line := frame(record)
+	e := indexEntry{segment: active.id, offset: active.size, length: int64(len(line))}
+
+	if _, err := fs.file.Write(append(line, '\n')); err != nil {
+		fs.failure = err
+		if truncErr := fs.file.Truncate(active.size); truncErr != nil { // Drop the part of the record that was written
+			if info, statErr := fs.file.Stat(); statErr == nil {
+				active.dead += info.Size() - active.size
+				active.size = info.Size()
+			}
+		}
+		return indexEntry{}, fmt.Errorf("failed to append record to links file: %w", err)
+	}
+	active.size += e.length + 1
+
+	if err := fs.file.Sync(); err != nil {
+		fs.failure = err
+		active.dead += e.length + 1 // Not indexed, it will be indexed after restart if it reached the disk
+		return indexEntry{}, fmt.Errorf("failed to sync links file after append: %w", err)
+	}
+	fs.failure = nil
+
+	if maxSize := int64(viper.GetInt(config.SegmentMaxSize)) << 20; maxSize > 0 && active.size >= maxSize {
+		if err := fs.seal(); err != nil {
+			log.Printf("[FILESTORE] Failed to seal links file, appending to it further: %v", err)
+		}
+	}
+	return e, nil
+}
+
+// seal renames links file to a sealed segment and starts a new one, caller must hold the mutex. Handles of links file
+// are closed before the rename, Windows doesn't rename open files.
+func (fs *FileStore) seal() error {
+	active := fs.active()
+	if active.size == 0 {
+		return nil
+	}
+
+	closer.Close(fs.file)
+	closer.Close(active.reader)
+	sealedPath := fs.segmentPath(active.id, false)
+	if err := os.Rename(fs.path, sealedPath); err != nil {
+		return errors.Join(err, fs.reopenActive())
+	}
+	reader, err := os.Open(sealedPath)
+	if err != nil {
+		if renameErr := os.Rename(sealedPath, fs.path); renameErr != nil {
+			log.Printf("[FILESTORE] Failed to restore links file from %s: %v", sealedPath, renameErr)
+		}
+		return errors.Join(err, fs.reopenActive())
+	}
+	active.path, active.reader, active.sealedAt = sealedPath, reader, time.Now()
+	_ = os.Chtimes(sealedPath, active.sealedAt, active.sealedAt) // Seal time survives restart as modification time
+	fs.segments = append(fs.segments, &segment{id: active.id + 1, path: fs.path})
+	fs.activeSince, fs.dirty = time.Now(), true
+	log.Printf("[FILESTORE] Sealed segment %s, %d bytes", filepath.Base(sealedPath), active.size)
+	return fs.reopenActive()
+}
+
+// reopenActive opens links file for appends and reads of the active segment, caller must hold the mutex
+func (fs *FileStore) reopenActive() error {
+	file, err := os.OpenFile(fs.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		fs.failure = err
+		return fmt.Errorf("failed to open/create links file: %w", err)
+	}
+	reader, err := os.Open(fs.path)
+	if err != nil {
+		closer.Close(file)
+		fs.failure = err
+		return fmt.Errorf("failed to open links file for reading: %w", err)
+	}
+	fs.file, fs.active().reader = file, reader
+	return nil
+}
+
+// maintainSegments runs Maintain every interval until stop is closed
+func (fs *FileStore) maintainSegments(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(viper.GetDuration(config.SegmentMaintenance))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := fs.Maintain(); err != nil {
+				log.Printf("[FILESTORE] Segment maintenance failed: %v", err)
+			}
+		}
+	}
+}
+
+// Maintain seals links file by age, drops segments past retention, compacts segments with deleted or duplicate
+// records and gzips old ones. Set numbers never change.
+func (fs *FileStore) Maintain() (models.MaintenanceReport, error) {
+	fs.maintenance.Lock()
+	defer fs.maintenance.Unlock()
+
+	var report models.MaintenanceReport
+	err := fs.sealByAge(&report)
+	if err == nil {
+		err = fs.expireSegments(&report)
+	}
+	if err == nil {
+		err = fs.compactSegments(&report)
+	}
+	if err == nil {
+		err = fs.compressSegments(&report)
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.dirty && fs.indexPath != "" {
+		if saveErr := fs.saveIndex(); saveErr != nil {
+			log.Printf("[FILESTORE] Failed to save index: %v", saveErr)
+		} else {
+			fs.dirty = false
+		}
+	}
+	return report, err
+}
+
+func (fs *FileStore) sealByAge(report *models.MaintenanceReport) error {
+	maxAge := viper.GetDuration(config.SegmentMaxAge)
+	if maxAge == 0 {
+		return nil
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.active().size == 0 || time.Since(fs.activeSince) < maxAge {
+		return nil
+	}
+	if err := fs.seal(); err != nil {
+		return fmt.Errorf("failed to seal links file: %w", err)
+	}
+	report.Sealed = true
+	return nil
+}
+
+// expireSegments removes sealed segments past retention together with their sets. If the newest set number goes with
+// them, a tombstone of it is appended so that the number isn't handed out again after restart.
+func (fs *FileStore) expireSegments(report *models.MaintenanceReport) error {
+	retention := viper.GetDuration(config.SegmentRetention)
+	if retention == 0 {
+		return nil
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	expired := make(map[int]bool)
+	for _, seg := range fs.segments[:len(fs.segments)-1] {
+		if time.Since(seg.sealedAt) > retention {
+			expired[seg.id] = true
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	for number, e := range fs.index.entries {
+		if expired[e.segment] {
+			delete(fs.index.entries, number)
+			report.ExpiredSets++
+		}
+	}
+
+	kept := fs.segments[:0]
+	var errs []error
+	for _, seg := range fs.segments {
+		if !expired[seg.id] {
+			kept = append(kept, seg)
+			continue
+		}
+		if seg.reader != nil {
+			closer.Close(seg.reader)
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err) // Its sets are gone from index anyway, it will be picked up after restart
+		}
+		report.Expired++
+		log.Printf("[FILESTORE] Removed segment %s sealed at %s", filepath.Base(seg.path), seg.sealedAt.Format(time.RFC3339))
+	}
+	fs.segments, fs.dirty = kept, true
+
+	if _, ok := fs.index.entries[fs.index.last]; !ok && fs.index.last > 0 {
+		record, _ := json.Marshal(models.Set{Number: fs.index.last, Deleted: true})
+		if _, err := fs.appendRecord(record); err != nil {
+			errs = append(errs, fmt.Errorf("failed to keep last set number: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (fs *FileStore) compactSegments(report *models.MaintenanceReport) error {
+	fs.mutex.RLock()
+	var candidates []*segment
+	for _, seg := range fs.segments[:len(fs.segments)-1] {
+		if seg.dead > 0 {
+			candidates = append(candidates, seg)
+		}
+	}
+	fs.mutex.RUnlock()
+
+	for _, seg := range candidates {
+		reclaimed, err := fs.compactSegment(seg)
+		if err != nil {
+			return fmt.Errorf("failed to compact %s: %w", filepath.Base(seg.path), err)
+		}
+		report.Compacted++
+		report.Reclaimed += reclaimed
+	}
+	return nil
+}
+
+// compactSegment rewrites a sealed segment keeping only indexed records and tombstones, index is moved to new offsets.
+// Tombstones stay until retention drops the segment, the newest one keeps set numbers from being handed out again.
+// Damaged records are quarantined and replaced by tombstones of numbers salvaged from them.
+func (fs *FileStore) compactSegment(seg *segment) (int64, error) {
+	type keptRecord struct {
+		number   int
+		from, to int64
+		length   int64
+	}
+
+	fs.mutex.RLock()
+	live := make(map[int64]int) // Offsets of indexed records in the segment
+	for number, e := range fs.index.entries {
+		if e.segment == seg.id {
+			live[e.offset] = number
+		}
+	}
+	fs.mutex.RUnlock()
+
+	src, err := seg.open(0) // Sealed segments only change under maintenance mutex, no need to hold the mutex
+	if err != nil {
+		return 0, err
+	}
+	defer closer.Close(src)
+
+	tmpPath := seg.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = os.Remove(tmpPath) }() // No-op after rename
+	defer closer.Close(tmp)
+
+	var out io.Writer = tmp
+	var gz *gzip.Writer
+	if seg.compressed {
+		gz = gzip.NewWriter(tmp)
+		out = gz
+	}
+	w := bufio.NewWriterSize(out, 64*1024)
+
+	var kept []keptRecord
+	var offset, written int64
+	var salvaged int // The largest set number found in damaged records
+	reader := bufio.NewReaderSize(src, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			record, head, decodeErr := decodeHead(bytes.TrimSuffix(line, []byte("\n")))
+			if decodeErr == nil && !bytes.HasSuffix(line, []byte("\n")) {
+				decodeErr = fmt.Errorf("%w: no end of line", ErrCorruptRecord)
+			}
+			number, isLive := live[offset]
+			switch {
+			case decodeErr != nil:
+				number = fs.quarantine(seg, offset, line, decodeErr)
+				if number == 0 {
+					break
+				}
+				// A tombstone takes place of the record, so that the number isn't handed out again after restart
+				salvaged = max(salvaged, number)
+				tombstone, _ := json.Marshal(models.Set{Number: number, Deleted: true})
+				framed := frame(tombstone)
+				if _, err = w.Write(append(framed, '\n')); err != nil {
+					return 0, err
+				}
+				written += int64(len(framed)) + 1
+			case head.Deleted || isLive && head.Number == number:
+				framed := frame(record) // Records written before framing get a checksum
+				if _, err = w.Write(append(framed, '\n')); err != nil {
+					return 0, err
+				}
+				if !head.Deleted {
+					kept = append(kept, keptRecord{number: number, from: offset, to: written, length: int64(len(framed))})
+				}
+				written += int64(len(framed)) + 1
+			}
+			offset += int64(len(line))
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		return 0, err
+	}
+	if gz != nil {
+		if err = gz.Close(); err != nil {
+			return 0, err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return 0, err
+	}
+	// Windows doesn't rename over open files, both the copy and the segment are closed first
+	closer.Close(src)
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if seg.reader != nil {
+		closer.Close(seg.reader)
+	}
+	err = os.Rename(tmpPath, seg.path)
+	var reopenErr error
+	if !seg.compressed {
+		if seg.reader, reopenErr = os.Open(seg.path); reopenErr != nil {
+			reopenErr = fmt.Errorf("failed to reopen segment: %w", reopenErr)
+		}
+	}
+	if err != nil {
+		return 0, errors.Join(err, reopenErr)
+	}
+	_ = os.Chtimes(seg.path, seg.sealedAt, seg.sealedAt)
+
+	fs.index.last = max(fs.index.last, salvaged)
+	fs.EnsureSetNumberReserved(salvaged)
+	seg.dead = 0
+	for _, k := range kept {
+		if e, ok := fs.index.entries[k.number]; ok && e.segment == seg.id && e.offset == k.from {
+			fs.index.entries[k.number] = indexEntry{segment: seg.id, offset: k.to, length: k.length}
+		} else {
+			seg.dead += k.length + 1 // Deleted while the segment was compacted
+		}
+	}
+	reclaimed := seg.size - written
+	seg.size, fs.dirty = written, true
+	log.Printf("[FILESTORE] Compacted segment %s, %d bytes reclaimed", filepath.Base(seg.path), reclaimed)
+	return reclaimed, reopenErr
+}
+
+func (fs *FileStore) compressSegments(report *models.MaintenanceReport) error {
+	if !viper.GetBool(config.SegmentCompress) {
+		return nil
+	}
+	after := viper.GetDuration(config.SegmentCompressAfter)
+
+	fs.mutex.RLock()
+	var candidates []*segment
+	for _, seg := range fs.segments[:len(fs.segments)-1] {
+		if !seg.compressed && time.Since(seg.sealedAt) >= after {
+			candidates = append(candidates, seg)
+		}
+	}
+	fs.mutex.RUnlock()
+
+	for _, seg := range candidates {
+		if err := fs.compressSegment(seg); err != nil {
+			return fmt.Errorf("failed to compress %s: %w", filepath.Base(seg.path), err)
+		}
+		report.Compressed++
+	}
+	return nil
+}
+
+// compressSegment replaces a sealed segment with its gzipped copy, offsets in index don't change
+func (fs *FileStore) compressSegment(seg *segment) error {
+	gzPath := fs.segmentPath(seg.id, true)
+	tmpPath := gzPath + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmpPath) }() // No-op after rename
+	defer closer.Close(tmp)
+
+	gz := gzip.NewWriter(tmp)
+	if _, err = io.Copy(gz, io.NewSectionReader(seg.reader, 0, seg.size)); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil { // Windows doesn't rename open files
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if err = os.Rename(tmpPath, gzPath); err != nil {
+		return err
+	}
+	_ = os.Chtimes(gzPath, seg.sealedAt, seg.sealedAt)
+	closer.Close(seg.reader) // Nor removes open files
+	if err = os.Remove(seg.path); err != nil {
+		log.Printf("[FILESTORE] Failed to remove %s after compression: %v", filepath.Base(seg.path), err)
+	}
+	seg.path, seg.reader, seg.compressed, fs.dirty = gzPath, nil, true, true
+	log.Printf("[FILESTORE] Compressed segment %s", filepath.Base(gzPath))
+	return nil
+}
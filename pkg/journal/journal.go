@@ -0,0 +1,355 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"link-availability-checker/internal/config"
+	"link-availability-checker/internal/utils/closer"
+)
+
+// Journal is an append-only, fsync'd write-ahead log of task events
+//
+// Every task is recorded as "enqueue" before it is put into the in-memory queue, "start" when a worker picks it up,
+// "progress" for each checkpoint made while processing and "complete" once its result is stored. Tasks without
+// "complete" record are replayed on startup together with their checkpoints. When the file grows past compaction
+// threshold it is rewritten with records of unfinished tasks only.
+type Journal struct {
+	path      string
+	file      *os.File
+	mutex     sync.Mutex
+	pending   map[string]*Task
+	order     []string // Enqueue order of pending tasks, may contain completed IDs until next compaction
+	records   int      // Number of records currently in file
+	live      int      // Number of records belonging to pending tasks
+	threshold int
+}
+
+type EventType string
+
+const (
+	EventEnqueue  EventType = "enqueue"
+	EventStart    EventType = "start"
+	EventProgress EventType = "progress"
+	EventComplete EventType = "complete"
+)
+
+type Entry struct {
+	Type    EventType       `json:"type"`
+	ID      string          `json:"id"`
+	Time    time.Time       `json:"time"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Task is an unfinished task known to the journal
+type Task struct {
+	ID       string
+	Payload  json.RawMessage
+	Started  bool
+	Start    json.RawMessage   // Payload of the first start record, nil if it had none
+	Progress []json.RawMessage // Checkpoint payloads in the order they were recorded
+}
+
+var ErrClosed = errors.New("journal is closed")
+
+// NewJournal opens journal of the link check queue, importing queue saved in legacy format. Errors are logged as well,
+// the app doesn't start without the journal and fx log may be muted.
+func NewJournal() (j *Journal, err error) {
+	defer func() {
+		if err != nil {
+			log.Printf("[JOURNAL] Failed to open queue journal: %v", err)
+		}
+	}()
+
+	path := viper.GetString(config.QueueFilePath)
+	legacy, err := detachLegacyQueue(path)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err = Open(path, viper.GetInt(config.QueueCompactThreshold))
+	if err != nil {
+		return nil, err
+	}
+	if legacy != "" {
+		if err = j.importLegacy(legacy); err != nil {
+			_ = j.Close()
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// Open opens journal at path replaying its records, compactThreshold <= 0 disables compaction while running
+func Open(path string, compactThreshold int) (*Journal, error) {
+	j := &Journal{
+		path:      path,
+		pending:   make(map[string]*Task),
+		threshold: compactThreshold,
+	}
+
+	if err := j.replay(); err != nil {
+		return nil, fmt.Errorf("failed to replay journal %s: %w", path, err)
+	}
+
+	// Compact on startup to drop completed tasks and possible torn tail left by a crash
+	if err := j.compact(); err != nil {
+		return nil, fmt.Errorf("failed to compact journal %s: %w", path, err)
+	}
+
+	return j, nil
+}
+
+// Enqueue records a new task with its payload
+func (j *Journal) Enqueue(id string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+	return j.append(Entry{Type: EventEnqueue, ID: id, Payload: data})
+}
+
+// Start records that a worker has picked up the task, payload may hold data assigned to the task at that moment, nil
+// if there is none
+func (j *Journal) Start(id string, payload any) error {
+	e := Entry{Type: EventStart, ID: id}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("marshal payload: %w", err)
+		}
+		e.Payload = data
+	}
+	return j.append(e)
+}
+
+// Progress records a checkpoint of the task, e.g. result of a single link
+func (j *Journal) Progress(id string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal payload: %w", err)
+	}
+	return j.append(Entry{Type: EventProgress, ID: id, Payload: data})
+}
+
+// Complete records that the task is finished and must not be replayed
+func (j *Journal) Complete(id string) error {
+	return j.append(Entry{Type: EventComplete, ID: id})
+}
+
+// Pending returns unfinished tasks in enqueue order
+func (j *Journal) Pending() []Task {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	tasks := make([]Task, 0, len(j.pending))
+	for _, id := range j.order {
+		if t, ok := j.pending[id]; ok {
+			tasks = append(tasks, *t)
+		}
+	}
+	return tasks
+}
+
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+func (j *Journal) append(e Entry) error {
+	e.Time = time.Now()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal journal entry: %w", err)
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.file == nil {
+		return ErrClosed
+	}
+
+	if _, err = j.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err = j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	j.records++
+	j.apply(e)
+
+	if j.threshold > 0 && j.records-j.live >= j.threshold {
+		if err = j.compact(); err != nil {
+			log.Printf("[JOURNAL] Compaction failed: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// apply updates in-memory state with the entry, caller must hold the mutex
+func (j *Journal) apply(e Entry) {
+	switch e.Type {
+	case EventEnqueue:
+		if t, ok := j.pending[e.ID]; ok {
+			j.live -= t.records()
+		} else {
+			j.order = append(j.order, e.ID)
+		}
+		j.pending[e.ID] = &Task{ID: e.ID, Payload: e.Payload}
+		j.live++
+	case EventStart:
+		if t, ok := j.pending[e.ID]; ok && !t.Started {
+			t.Started = true
+			t.Start = e.Payload
+			j.live++
+		}
+	case EventProgress:
+		if t, ok := j.pending[e.ID]; ok {
+			t.Progress = append(t.Progress, e.Payload)
+			j.live++
+		}
+	case EventComplete:
+		if t, ok := j.pending[e.ID]; ok {
+			j.live -= t.records()
+			delete(j.pending, e.ID)
+		}
+	}
+}
+
+func (j *Journal) replay() error {
+	file, err := os.Open(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // No journal means no queued tasks
+		}
+		return err
+	}
+	defer closer.Close(file)
+
+	parsed, malformed := 0, 0
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(data) > 0 {
+				log.Printf("[JOURNAL] Dropping torn record at line %d", line) // Crash in the middle of a write
+			}
+			if malformed > 0 && parsed == 0 {
+				// Compaction would leave an empty journal, the file is most likely not a journal at all
+				return fmt.Errorf("none of %d records could be parsed, refusing to overwrite the file", malformed)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var e Entry
+		if err = json.Unmarshal(data, &e); err != nil {
+			log.Printf("[JOURNAL] Skipping malformed record at line %d: %v", line, err)
+			malformed++
+			continue
+		}
+		parsed++
+		j.apply(e)
+	}
+}
+
+// compact rewrites the journal with records of pending tasks only, caller must hold the mutex (or be the constructor)
+func (j *Journal) compact() error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	order := make([]string, 0, len(j.pending))
+	records := 0
+	writer := bufio.NewWriter(tmp)
+	for _, id := range j.order {
+		t, ok := j.pending[id]
+		if !ok {
+			continue
+		}
+		order = append(order, id)
+
+		entries := []Entry{{Type: EventEnqueue, ID: t.ID, Time: time.Now(), Payload: t.Payload}}
+		if t.Started {
+			entries = append(entries, Entry{Type: EventStart, ID: t.ID, Time: time.Now(), Payload: t.Start})
+		}
+		for _, p := range t.Progress {
+			entries = append(entries, Entry{Type: EventProgress, ID: t.ID, Time: time.Now(), Payload: p})
+		}
+		for _, e := range entries {
+			data, _ := json.Marshal(e) // Entry only contains marshallable fields
+			_, _ = writer.Write(append(data, '\n'))
+			records++
+		}
+	}
+
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, j.path); err != nil {
+		return err // Old file is still open and valid, keep appending to it
+	}
+	syncDir(filepath.Dir(j.path))
+
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if j.file != nil {
+		closer.Close(j.file)
+	}
+	j.file = file
+	j.order = order
+	j.records = records
+
+	return nil
+}
+
+// records returns number of records the task takes in a compacted journal
+func (t *Task) records() int {
+	n := 1 + len(t.Progress)
+	if t.Started {
+		n++
+	}
+	return n
+}
+
+// syncDir makes rename durable, errors are ignored since not every platform supports syncing directories
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer closer.Close(dir)
+	_ = dir.Sync()
+}
@@ -0,0 +1,100 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"link-availability-checker/internal/utils/closer"
+)
+
+// Before the journal the queue was saved on shutdown to queue.txt as indented JSON array of {"set": ...} objects. Such
+// a file is moved aside as queue.txt.legacy and its tasks are enqueued into the journal once, whether it is at the
+// configured path or next to it under the old default name. The moved file is kept as queue.txt.imported.
+const legacyQueueFile = "queue.txt"
+
+// detachLegacyQueue moves legacy snapshot away from the journal path and returns where it is now, empty if there is
+// none. A snapshot moved by a start that crashed before importing it is returned as well.
+func detachLegacyQueue(path string) (string, error) {
+	held := filepath.Join(filepath.Dir(path), legacyQueueFile+".legacy")
+
+	for _, candidate := range []string{path, filepath.Join(filepath.Dir(path), legacyQueueFile)} {
+		legacy, err := isLegacySnapshot(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !legacy {
+			continue
+		}
+		if _, err = os.Stat(held); err == nil {
+			return "", fmt.Errorf("legacy queue %s can't be imported while %s is still there", candidate, held)
+		}
+		if err = os.Rename(candidate, held); err != nil {
+			return "", fmt.Errorf("failed to move legacy queue %s: %w", candidate, err)
+		}
+		log.Printf("[JOURNAL] Found queue saved in legacy format at %s, importing it into %s", candidate, path)
+		break
+	}
+
+	if _, err := os.Stat(held); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return held, nil
+}
+
+// isLegacySnapshot tells if the file starts with '[', journal records always start with '{'
+func isLegacySnapshot(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer closer.Close(file)
+
+	reader := bufio.NewReader(file)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return false, nil // Empty file
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b == '[', nil
+	}
+}
+
+// importLegacy enqueues tasks of legacy snapshot, they get IDs by their position, so a repeated import after a crash
+// doesn't duplicate them
+func (j *Journal) importLegacy(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var tasks []json.RawMessage
+	if err = json.Unmarshal(data, &tasks); err != nil {
+		return fmt.Errorf("legacy queue %s is damaged, fix or remove it to start: %w", path, err)
+	}
+
+	for i, payload := range tasks {
+		if err = j.Enqueue(fmt.Sprintf("legacy-%d", i+1), payload); err != nil {
+			return fmt.Errorf("failed to import legacy task %d: %w", i+1, err)
+		}
+	}
+
+	imported := filepath.Join(filepath.Dir(path), legacyQueueFile+".imported")
+	if err = os.Rename(path, imported); err != nil {
+		return fmt.Errorf("failed to move imported legacy queue: %w", err)
+	}
+	log.Printf("[JOURNAL] Imported %d tasks of legacy queue, the file is kept as %s", len(tasks), imported)
+	return nil
+}
@@ -0,0 +1,210 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"link-availability-checker/internal/utils/closer"
+)
+
+type Event string
+
+const (
+	EventDown Event = "down"
+	EventUp   Event = "up"
+)
+
+// Alert is a change of domain availability
+type Alert struct {
+	Domain    string        `json:"domain"`
+	Event     Event         `json:"event"`
+	Reason    string        `json:"reason"`     // Reason of the last failed check of the outage
+	Failures  int           `json:"failures"`   // Consecutive failed checks
+	DownSince time.Time     `json:"down_since"` // Time of the first failed check of the outage
+	Duration  time.Duration `json:"duration"`   // How long the outage lasted so far, or in total for EventUp
+	Time      time.Time     `json:"time"`
+}
+
+func (a Alert) Subject() string {
+	if a.Event == EventUp {
+		return fmt.Sprintf("%s is back up after %s", a.Domain, a.Duration.Round(time.Second))
+	}
+	return fmt.Sprintf("%s is down: %s", a.Domain, a.Reason)
+}
+
+func (a Alert) Text() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Domain: %s\n", a.Domain)
+	fmt.Fprintf(&sb, "Event: %s\n", a.Event)
+	fmt.Fprintf(&sb, "Reason: %s\n", a.Reason)
+	fmt.Fprintf(&sb, "Down since: %s\n", a.DownSince.Format(time.RFC3339))
+	fmt.Fprintf(&sb, "Outage duration: %s\n", a.Duration.Round(time.Second))
+	fmt.Fprintf(&sb, "Failed checks: %d\n", a.Failures)
+	fmt.Fprintf(&sb, "Time: %s\n", a.Time.Format(time.RFC3339))
+	return sb.String()
+}
+
+// Notifier delivers alerts to a single destination
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// Webhook POSTs alert as JSON, signed like link set callbacks if secret is set
+type Webhook struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+func (n *Webhook) Name() string { return "webhook " + n.URL }
+
+func (n *Webhook) Notify(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(n.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Timestamp", timestamp)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closer.Close(resp.Body)
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SMTP sends alert as plain text email, STARTTLS is used if the server supports it
+type SMTP struct {
+	Addr     string // host:port
+	Username string // Authentication is skipped if empty
+	Password string
+	From     string
+	To       []string
+}
+
+func (n *SMTP) Name() string { return "smtp " + n.Addr }
+
+func (n *SMTP) Notify(ctx context.Context, alert Alert) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, err := net.SplitHostPort(n.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.Username, n.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(alert.Subject())) // Domain comes from users
+	fmt.Fprintf(&msg, "Date: %s\r\n", alert.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(alert.Text(), "\n", "\r\n"))
+
+	// net/smtp doesn't take context, so the send is abandoned instead of interrupted
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(n.Addr, auth, n.From, n.To, msg.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// File appends alerts to a file as JSON lines
+type File struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+func (n *File) Name() string { return "file " + n.Path }
+
+func (n *File) Notify(_ context.Context, alert Alert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	file, err := os.OpenFile(n.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer closer.Close(file)
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// Exec runs a command with alert as JSON on stdin and its main fields in ALERT_* environment variables
+type Exec struct {
+	Command []string
+}
+
+func (n *Exec) Name() string { return "exec " + strings.Join(n.Command, " ") }
+
+func (n *Exec) Notify(ctx context.Context, alert Alert) error {
+	if len(n.Command) == 0 {
+		return fmt.Errorf("empty command")
+	}
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, n.Command[0], n.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Env = append(os.Environ(),
+		"ALERT_DOMAIN="+alert.Domain,
+		"ALERT_EVENT="+string(alert.Event),
+		"ALERT_REASON="+alert.Reason,
+		"ALERT_DURATION="+strconv.FormatInt(int64(alert.Duration.Seconds()), 10),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testAlert = Alert{
+	Domain:    "example.com",
+	Event:     EventDown,
+	Reason:    "timeout",
+	Failures:  3,
+	DownSince: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	Duration:  time.Minute,
+	Time:      time.Date(2026, 1, 2, 3, 5, 5, 0, time.UTC),
+}
+
+func TestWebhookSendsSignedAlert(t *testing.T) {
+	const secret = "s3cret"
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	n := &Webhook{URL: server.URL, Secret: secret, Client: server.Client()}
+	if err := n.Notify(context.Background(), testAlert); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	r, body := <-received, <-bodies
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got %s with content type %q", r.Method, r.Header.Get("Content-Type"))
+	}
+
+	var got Alert
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("body isn't an alert: %v", err)
+	}
+	if got != testAlert {
+		t.Errorf("got alert %+v, want %+v", got, testAlert)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "."))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-Webhook-Signature") != want {
+		t.Errorf("got signature %q, want %q", r.Header.Get("X-Webhook-Signature"), want)
+	}
+}
+
+func TestWebhookUnsignedWithoutSecret(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Webhook-Signature") != "" {
+			t.Errorf("alert is signed without secret")
+		}
+	}))
+	defer server.Close()
+
+	if err := (&Webhook{URL: server.URL}).Notify(context.Background(), testAlert); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+}
+
+func TestWebhookFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	err := (&Webhook{URL: server.URL, Client: server.Client()}).Notify(context.Background(), testAlert)
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got error %v, want unexpected status 503", err)
+	}
+}
+
+func TestWebhookRespectsContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := (&Webhook{URL: server.URL, Client: server.Client()}).Notify(ctx, testAlert); err == nil {
+		t.Fatal("Notify succeeded past deadline")
+	}
+}
+
+// smtpMessage is a mail accepted by fakeSMTP
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// fakeSMTP accepts a single mail over plain SMTP without extensions, so net/smtp skips STARTTLS and auth
+func fakeSMTP(t *testing.T) (string, <-chan smtpMessage) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	messages := make(chan smtpMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		text := textproto.NewConn(conn)
+		_ = text.PrintfLine("220 localhost ready")
+		var msg smtpMessage
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				_ = text.PrintfLine("250 localhost")
+			case strings.HasPrefix(cmd, "MAIL FROM:"):
+				msg.From = strings.Trim(line[len("MAIL FROM:"):], "<>")
+				_ = text.PrintfLine("250 OK")
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				msg.To = append(msg.To, strings.Trim(line[len("RCPT TO:"):], "<>"))
+				_ = text.PrintfLine("250 OK")
+			case cmd == "DATA":
+				_ = text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				msg.Data = string(data)
+				_ = text.PrintfLine("250 OK")
+				messages <- msg
+			case cmd == "QUIT":
+				_ = text.PrintfLine("221 bye")
+				return
+			default:
+				_ = text.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), messages
+}
+
+func TestSMTPSendsAlert(t *testing.T) {
+	addr, messages := fakeSMTP(t)
+
+	n := &SMTP{Addr: addr, From: "checker@example.com", To: []string{"ops@example.com", "dev@example.com"}}
+	if err := n.Notify(context.Background(), testAlert); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	msg := <-messages
+	if msg.From != n.From || strings.Join(msg.To, ",") != "ops@example.com,dev@example.com" {
+		t.Errorf("got envelope from %q to %v", msg.From, msg.To)
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(msg.Data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("malformed message header: %v", err)
+	}
+	if got := header.Get("Subject"); got != testAlert.Subject() {
+		t.Errorf("got subject %q, want %q", got, testAlert.Subject())
+	}
+	if got := header.Get("To"); got != "ops@example.com, dev@example.com" {
+		t.Errorf("got To header %q", got)
+	}
+	if !strings.Contains(msg.Data, "Failed checks: 3") {
+		t.Errorf("message body lacks alert text:\n%s", msg.Data)
+	}
+}
+
+func TestSMTPSubjectCantInjectHeaders(t *testing.T) {
+	addr, messages := fakeSMTP(t)
+
+	alert := testAlert
+	alert.Domain = "evil.com\r\nBcc: victim@example.com"
+	n := &SMTP{Addr: addr, From: "checker@example.com", To: []string{"ops@example.com"}}
+	if err := n.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader((<-messages).Data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("malformed message header: %v", err)
+	}
+	if bcc := header.Get("Bcc"); bcc != "" {
+		t.Errorf("domain injected Bcc header %q", bcc)
+	}
+}
+
+func TestSMTPFailsWhenServerIsDown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	n := &SMTP{Addr: addr, From: "checker@example.com", To: []string{"ops@example.com"}}
+	if err = n.Notify(context.Background(), testAlert); err == nil {
+		t.Fatal("Notify succeeded without server")
+	}
+}
@@ -8,7 +8,8 @@ import (
 	"codeberg.org/go-pdf/fpdf"
 )
 
-func GeneratePDF(sets []int, text [][]string) (string, error) {
+// GeneratePDF renders link lines of every set followed by its incidents section, if any
+func GeneratePDF(sets []int, text [][]string, incidents [][]string) (string, error) {
 	pdf := fpdf.New("P", "mm", "A4", "")
 	pdf.AddPage()
 
@@ -26,6 +27,19 @@ func GeneratePDF(sets []int, text [][]string) (string, error) {
 			pdf.Cell(40, 10, line)
 			pdf.Ln(10)
 		}
+
+		if i < len(incidents) && len(incidents[i]) > 0 {
+			pdf.SetFont("Arial", "B", 12)
+			pdf.Cell(40, 10, "Incidents")
+			pdf.Ln(8)
+
+			pdf.SetFont("Courier", "", 10)
+			for _, line := range incidents[i] {
+				pdf.Cell(40, 6, line)
+				pdf.Ln(6)
+			}
+			pdf.Ln(4)
+		}
 	}
 
 	var filePath string
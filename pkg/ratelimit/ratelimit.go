@@ -0,0 +1,91 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter keeps token buckets by key, e.g. client ID and limit name
+//
+// A bucket holds up to burst tokens and is refilled by perMinute tokens every minute, every allowed request takes
+// some tokens out. Buckets that are full again are forgotten, so idle clients cost nothing.
+type Limiter struct {
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	rate     float64 // Tokens per second
+	capacity float64
+}
+
+// Result describes state of the bucket after Take, suitable for X-RateLimit-* headers
+type Result struct {
+	Allowed    bool
+	Limit      int           // Bucket capacity
+	Remaining  int           // Whole tokens left
+	Reset      time.Duration // Time until the bucket is full again
+	RetryAfter time.Duration // Time until the rejected request would be allowed, 0 if allowed
+}
+
+func New() *Limiter {
+	return &Limiter{buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// Take takes n tokens from the bucket if it has enough of them, n larger than burst is never allowed and gets zero
+// RetryAfter
+func (l *Limiter) Take(key string, n, perMinute, burst int) Result {
+	now := time.Now()
+	rate := float64(perMinute) / 60 // Tokens per second
+	capacity := float64(burst)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	b.rate, b.capacity = rate, capacity // Limits may change with config
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	res := Result{Limit: burst}
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		res.Allowed = true
+	} else if rate > 0 && float64(n) <= capacity {
+		res.RetryAfter = seconds((float64(n) - b.tokens) / rate)
+	}
+
+	res.Remaining = int(b.tokens)
+	if rate > 0 {
+		res.Reset = seconds((capacity - b.tokens) / rate)
+	}
+	return res
+}
+
+// sweep drops buckets that have been refilled, at most once a minute, caller must hold the mutex
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}